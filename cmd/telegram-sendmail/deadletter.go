@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/spf13/viper"
+)
+
+// deadLetterDir is the state_dir subdirectory for messages serve gave up on.
+// processQueue skips directories, so nothing in it is retried until an
+// operator runs `queue requeue`.
+const deadLetterDir = "dead"
+
+// ErrQueueIDExists is returned when requeueing would overwrite a queued
+// message with the same ID.
+var ErrQueueIDExists = errors.New("a queued message with this ID already exists")
+
+// retryPolicy bounds how long a failing message is retried. Zero values
+// mean unlimited; permanent Telegram errors are never retried.
+type retryPolicy struct {
+	maxAttempts int
+	maxAge      time.Duration
+}
+
+func retryPolicyFromConfig() retryPolicy {
+	return retryPolicy{
+		maxAttempts: viper.GetInt("max_attempts"),
+		maxAge:      viper.GetDuration("max_age"),
+	}
+}
+
+// deadLetterReason returns why a message that just failed with err should
+// stop being retried, or "" to keep it queued.
+func (p retryPolicy) deadLetterReason(err error, status queueStatus, enqueued, now time.Time) string {
+	switch {
+	case telegram.IsPermanent(err):
+		return "permanent error: " + err.Error()
+	case p.maxAttempts > 0 && status.Attempts >= p.maxAttempts:
+		return fmt.Sprintf("gave up after %d attempts: %v", status.Attempts, err)
+	case p.maxAge > 0 && now.Sub(enqueued) >= p.maxAge:
+		return fmt.Sprintf("gave up after %s in queue: %v", now.Sub(enqueued).Round(time.Second), err)
+	default:
+		return ""
+	}
+}
+
+// moveToDeadLetter moves a message and its status (with the reason added)
+// into the dead-letter directory. The caller must hold the message's lock.
+func moveToDeadLetter(stateDir, id string, status queueStatus, reason string, now time.Time) error {
+	deadDir := filepath.Join(stateDir, deadLetterDir)
+	if err := os.MkdirAll(deadDir, stateDirPerm); err != nil {
+		return err
+	}
+	if err := chownToDir(deadDir, stateDir); err != nil {
+		return err
+	}
+	status.DeadReason = reason
+	status.DeadAt = now
+	// Status first: a crash in between leaves a dead status with a live
+	// message, which is retried (and re-dead-lettered) rather than lost.
+	if err := saveQueueStatus(deadDir, id, status); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(stateDir, id), filepath.Join(deadDir, id)); err != nil {
+		return err
+	}
+	if err := os.Remove(statusPath(stateDir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// requeueDeadLetter moves a dead letter back into the queue with a fresh
+// delivery history, so serve picks it up on its next pass.
+func requeueDeadLetter(stateDir, id string) error {
+	deadDir := filepath.Join(stateDir, deadLetterDir)
+	deadPath, err := queueFilePath(deadDir, id)
+	if err != nil {
+		return err
+	}
+	lock, err := lockQueueFile(deadPath)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(stateDir, id)
+	if _, err := os.Lstat(target); err == nil {
+		return errors.Join(ErrQueueIDExists, lock.Close())
+	}
+	if err := os.Rename(deadPath, target); err != nil {
+		return errors.Join(err, lock.Close())
+	}
+	if err := os.Remove(statusPath(deadDir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Join(err, lock.Close())
+	}
+	return lock.Close()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/spf13/viper"
+)
+
+func TestDeadLetterReason(t *testing.T) {
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	transient := &telegram.Error{StatusCode: http.StatusBadGateway, Message: "bad gateway"}
+	permanent := fmt.Errorf("chat 1: %w", &telegram.Error{StatusCode: http.StatusForbidden, Message: "bot was kicked"})
+
+	tests := []struct {
+		name     string
+		policy   retryPolicy
+		err      error
+		attempts int
+		enqueued time.Time
+		want     string
+	}{
+		{name: "transient unlimited", err: transient, attempts: 1000, enqueued: now.Add(-24 * 365 * time.Hour), want: ""},
+		{name: "permanent always", err: permanent, attempts: 1, enqueued: now, want: "permanent error"},
+		{name: "attempts left", policy: retryPolicy{maxAttempts: 3}, err: transient, attempts: 2, enqueued: now, want: ""},
+		{name: "attempts exhausted", policy: retryPolicy{maxAttempts: 3}, err: transient, attempts: 3, enqueued: now, want: "gave up after 3 attempts"},
+		{name: "young enough", policy: retryPolicy{maxAge: time.Hour}, err: transient, attempts: 1, enqueued: now.Add(-time.Minute), want: ""},
+		{name: "too old", policy: retryPolicy{maxAge: time.Hour}, err: transient, attempts: 1, enqueued: now.Add(-2 * time.Hour), want: "gave up after 2h0m0s in queue"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.deadLetterReason(tt.err, queueStatus{Attempts: tt.attempts}, tt.enqueued, now)
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Fatalf("deadLetterReason=%q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessQueueDeadLettersPermanentFailure(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, "001"), []byte("Subject: s\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("default_subject", "Message")
+	viper.Set("hostname", "host")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		if _, err := w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the group chat"}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	empty, sent, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false)
+	if !empty || sent != 0 || errs != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d, want the dead letter out of the queue", empty, sent, errs)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "001")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("message still queued: %v", err)
+	}
+	deadDir := filepath.Join(stateDir, deadLetterDir)
+	status, err := loadQueueStatus(deadDir, "001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Attempts != 1 || !strings.Contains(status.DeadReason, "bot was kicked") || status.DeadAt.IsZero() {
+		t.Fatalf("dead status=%+v", status)
+	}
+	if _, err := os.Stat(statusPath(stateDir, "001")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("live status left behind: %v", err)
+	}
+
+	// Requeue puts it back with a clean history.
+	if err := requeueDeadLetter(stateDir, "001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "001")); err != nil {
+		t.Fatalf("requeued message missing: %v", err)
+	}
+	if status, err := loadQueueStatus(stateDir, "001"); err != nil || status.Attempts != 0 {
+		t.Fatalf("requeued status=%+v err=%v", status, err)
+	}
+	if _, err := os.Stat(statusPath(deadDir, "001")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("dead status left behind: %v", err)
+	}
+}
+
+func TestProcessQueueMaxAttempts(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, "001"), []byte("Subject: s\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("max_attempts", 2)
+	defer viper.Set("max_attempts", 0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	if empty, _, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false); empty || errs != 1 {
+		t.Fatalf("first pass empty=%v errs=%d, want retry", empty, errs)
+	}
+	if empty, _, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, true); !empty || errs != 0 {
+		t.Fatalf("second pass empty=%v errs=%d, want dead-lettered", empty, errs)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, deadLetterDir, "001")); err != nil {
+		t.Fatalf("dead letter missing: %v", err)
+	}
+}
+
+func TestRequeueDeadLetterErrors(t *testing.T) {
+	stateDir := t.TempDir()
+	deadDir := filepath.Join(stateDir, deadLetterDir)
+	if err := os.MkdirAll(deadDir, stateDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{stateDir, deadDir} {
+		if err := os.WriteFile(filepath.Join(dir, "1"), []byte("m"), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := requeueDeadLetter(stateDir, "1"); !errors.Is(err, ErrQueueIDExists) {
+		t.Fatalf("collision: got %v, want ErrQueueIDExists", err)
+	}
+	if err := requeueDeadLetter(stateDir, "2"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("missing: got %v", err)
+	}
+	if err := requeueDeadLetter(stateDir, "../1"); !errors.Is(err, ErrInvalidQueueID) {
+		t.Fatalf("traversal: got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/lucasew/telegram-sendmail/internal/utils"
+	"github.com/spf13/viper"
+)
+
+// dedupStateFile records recently delivered messages by fingerprint. serve
+// exits when idle, so suppression must survive restarts.
+const dedupStateFile = ".dedup.json"
+
+// defaultDedupIgnore strips the parts of cron and syslog output that change
+// between otherwise identical alerts: timestamps, clock times and PIDs.
+var defaultDedupIgnore = []string{
+	`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?`,
+	`\b\d{1,2}:\d{2}(:\d{2})?\b`,
+	`\[\d+\]`,
+	`(?i)\bpid[ =:]*\d+`,
+}
+
+// dedupPolicy suppresses messages identical to one delivered less than
+// window ago, after removing every match of ignore. A zero window disables
+// suppression.
+type dedupPolicy struct {
+	window time.Duration
+	ignore []*regexp.Regexp
+}
+
+func dedupPolicyFromConfig() (dedupPolicy, error) {
+	p := dedupPolicy{window: viper.GetDuration("dedup_window")}
+	if p.window <= 0 {
+		return dedupPolicy{}, nil
+	}
+	for _, expr := range viper.GetStringSlice("dedup_ignore") {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return dedupPolicy{}, fmt.Errorf("dedup ignore pattern %q: %w", expr, err)
+		}
+		p.ignore = append(p.ignore, re)
+	}
+	return p, nil
+}
+
+// fingerprint identifies a message by destination, normalized subject and a
+// hash of the normalized body.
+func (p dedupPolicy) fingerprint(chats []string, parsed parsedMail) string {
+	h := sha256.New()
+	for _, part := range []string{strings.Join(chats, ","), p.normalize(parsed.subject), p.normalize(parsed.body)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (p dedupPolicy) normalize(s string) string {
+	for _, re := range p.ignore {
+		s = re.ReplaceAllString(s, "")
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// dedupEntry is a delivered message and the repeats suppressed since.
+type dedupEntry struct {
+	Subject string   `json:"subject"`
+	Chats   []string `json:"chats"`
+	// Since is when the message, or the last repeat report, went out.
+	Since      time.Time `json:"since"`
+	Suppressed int       `json:"suppressed,omitempty"`
+	// Reported lists the chats that already got the current repeat report,
+	// so a retry after a failure part-way through goes to the rest only.
+	Reported []string `json:"reported,omitempty"`
+}
+
+func loadDedupState(stateDir string) (map[string]dedupEntry, error) {
+	state := map[string]dedupEntry{}
+	data, err := os.ReadFile(filepath.Join(stateDir, dedupStateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read dedup state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return map[string]dedupEntry{}, fmt.Errorf("parse dedup state: %w", err)
+	}
+	return state, nil
+}
+
+func saveDedupState(stateDir string, state map[string]dedupEntry) error {
+	if err := writeStateFile(stateDir, dedupStateFile, state); err != nil {
+		return fmt.Errorf("write dedup state: %w", err)
+	}
+	return nil
+}
+
+// suppressDuplicate counts the message as a repeat and reports true when
+// one with the same fingerprint went out less than window ago.
+func (p dedupPolicy) suppressDuplicate(stateDir, fingerprint string, now time.Time) (bool, error) {
+	state, err := loadDedupState(stateDir)
+	if err != nil {
+		return false, err
+	}
+	entry, ok := state[fingerprint]
+	if !ok || now.Sub(entry.Since) >= p.window {
+		return false, nil
+	}
+	entry.Suppressed++
+	state[fingerprint] = entry
+	return true, saveDedupState(stateDir, state)
+}
+
+// dedupMessage is a message checked for repeats.
+type dedupMessage struct {
+	fingerprint string
+	subject     string
+	chats       []string
+}
+
+// recordDelivered starts a suppression window for a message that was just
+// sent. Repeats still unreported from an expired window are dropped: the
+// new message itself shows the alert is still firing.
+func recordDelivered(stateDir string, m dedupMessage, now time.Time) error {
+	state, loadErr := loadDedupState(stateDir)
+	state[m.fingerprint] = dedupEntry{Subject: m.subject, Chats: m.chats, Since: now}
+	return errors.Join(loadErr, saveDedupState(stateDir, state))
+}
+
+// reportRepeats sends "repeated N times" follow-ups for suppression windows
+// that have ended, and forgets windows with nothing to report. serve does
+// not stay up for a window to end: the follow-up goes out on the first pass
+// after it, usually on serve's next activation.
+func (p dedupPolicy) reportRepeats(client *telegram.Client, stateDir string, now time.Time) error {
+	state, err := loadDedupState(stateDir)
+	if err != nil {
+		return err
+	}
+	if len(state) == 0 {
+		return nil
+	}
+	hostname := viper.GetString("hostname")
+	var errs []error
+	for fp, entry := range state {
+		if now.Sub(entry.Since) < p.window {
+			continue
+		}
+		if entry.Suppressed == 0 {
+			delete(state, fp)
+			continue
+		}
+		body := fmt.Sprintf("Repeated %d times since %s", entry.Suppressed, entry.Since.Local().Format("15:04"))
+		var sendErr error
+		for _, chat := range entry.Chats {
+			if slices.Contains(entry.Reported, chat) {
+				continue
+			}
+			if _, err := client.Send(chat, entry.Subject, body, hostname); err != nil {
+				sendErr = fmt.Errorf("chat %s: %w", chat, err)
+				break
+			}
+			entry.Reported = append(entry.Reported, chat)
+		}
+		if sendErr != nil {
+			state[fp] = entry
+			errs = append(errs, sendErr)
+			if _, ok := telegram.RetryAfter(sendErr); ok {
+				// Flood control refuses the rest too; keep what went out.
+				break
+			}
+			continue
+		}
+		slog.Info("Reported repeated message", "subject", entry.Subject, "count", entry.Suppressed)
+		// A new window starts so a still-firing alert is reported again.
+		entry.Since, entry.Suppressed, entry.Reported = now, 0, nil
+		state[fp] = entry
+	}
+	if err := saveDedupState(stateDir, state); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// check fingerprints a message about to be delivered. suppressed is
+// true when it repeats a recent one and was counted instead; otherwise m is
+// passed to recordDelivered once delivery succeeds.
+func (p dedupPolicy) check(stateDir string, router chatRouter, env envelope, payload *io.SectionReader, now time.Time) (m dedupMessage, suppressed bool) {
+	parsed := parseMailMessage(payload, viper.GetString("default_subject"))
+	m.subject = parsed.subject
+	m.chats = messageChats(router, env, payload)
+	m.fingerprint = p.fingerprint(m.chats, parsed)
+	suppressed, err := p.suppressDuplicate(stateDir, m.fingerprint, now)
+	if err != nil {
+		utils.ReportError(err, "Failed to check for duplicate message", "dir", stateDir)
+	}
+	return m, suppressed
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/spf13/viper"
+)
+
+func TestDedupIgnoreDefaultsSurviveFlagBinding(t *testing.T) {
+	if got := viper.GetStringSlice("dedup_ignore"); !slices.Equal(got, defaultDedupIgnore) {
+		t.Fatalf("dedup_ignore=%q want %q", got, defaultDedupIgnore)
+	}
+}
+
+func TestDedupFingerprintIgnoresVolatileParts(t *testing.T) {
+	viper.Set("dedup_window", time.Hour)
+	defer viper.Set("dedup_window", 0)
+	p, err := dedupPolicyFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats := []string{"123"}
+	a := p.fingerprint(chats, parsedMail{subject: "backup failed", body: "2026-01-02 03:04:05 rsync[4242]: error at 03:04"})
+	b := p.fingerprint(chats, parsedMail{subject: "backup  failed", body: "2026-01-02T05:06:07Z rsync[77]: error at 5:06"})
+	if a != b {
+		t.Fatal("timestamps and PIDs changed the fingerprint")
+	}
+	if c := p.fingerprint(chats, parsedMail{subject: "backup failed", body: "rsync: disk full"}); c == a {
+		t.Fatal("different bodies share a fingerprint")
+	}
+	if d := p.fingerprint([]string{"456"}, parsedMail{subject: "backup failed", body: "2026-01-02 03:04:05 rsync[4242]: error at 03:04"}); d == a {
+		t.Fatal("different chats share a fingerprint")
+	}
+}
+
+func TestDedupPolicyFromConfigBadPattern(t *testing.T) {
+	viper.Set("dedup_window", time.Hour)
+	viper.Set("dedup_ignore", []string{"("})
+	defer viper.Set("dedup_window", 0)
+	defer viper.Set("dedup_ignore", defaultDedupIgnore)
+	if _, err := dedupPolicyFromConfig(); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestProcessQueueSuppressesRepeats(t *testing.T) {
+	viper.Set("dedup_window", time.Hour)
+	defer viper.Set("dedup_window", 0)
+	viper.Set("hostname", "host")
+
+	var mu sync.Mutex
+	var texts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		texts = append(texts, r.FormValue("text"))
+		if _, err := w.Write([]byte(`{"ok":true}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+	router := chatRouter{defaultChat: "123"}
+
+	stateDir := t.TempDir()
+	for i, id := range []string{"001", "002", "003"} {
+		payload := "Subject: cron failed\n\nexit 1 at 10:0" + string(rune('0'+i))
+		if err := os.WriteFile(filepath.Join(stateDir, id), []byte(payload), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A pending report does not keep serve up.
+	empty, sent, errs := processQueue(client, stateDir, router, false)
+	if !empty || sent != 1 || errs != 0 || len(texts) != 1 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d texts=%d, want one send and an idle queue", empty, sent, errs, len(texts))
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "003")); err == nil {
+		t.Fatal("suppressed message left in the queue")
+	}
+
+	// Once the window ends the next pass reports the repeats.
+	state, err := loadDedupState(stateDir)
+	if err != nil || len(state) != 1 {
+		t.Fatalf("state=%v err=%v", state, err)
+	}
+	for fp, entry := range state {
+		if entry.Suppressed != 2 {
+			t.Fatalf("suppressed=%d want 2", entry.Suppressed)
+		}
+		entry.Since = entry.Since.Add(-2 * time.Hour)
+		state[fp] = entry
+	}
+	if err := saveDedupState(stateDir, state); err != nil {
+		t.Fatal(err)
+	}
+	empty, _, errs = processQueue(client, stateDir, router, false)
+	if !empty || errs != 0 || len(texts) != 2 || !strings.Contains(texts[1], "Repeated 2 times since") {
+		t.Fatalf("empty=%v errs=%d texts=%q", empty, errs, texts)
+	}
+}
+
+func TestReportRepeatsResumesAfterFailedChat(t *testing.T) {
+	viper.Set("hostname", "host")
+
+	var mu sync.Mutex
+	var chats []string
+	failB := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		chat := r.FormValue("chat_id")
+		if chat == "b" && failB {
+			failB = false
+			http.Error(w, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`, http.StatusBadGateway)
+			return
+		}
+		chats = append(chats, chat)
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	stateDir := t.TempDir()
+	now := time.Now()
+	state := map[string]dedupEntry{
+		"fp": {Subject: "cron failed", Chats: []string{"a", "b", "c"}, Since: now.Add(-2 * time.Hour), Suppressed: 3},
+	}
+	if err := saveDedupState(stateDir, state); err != nil {
+		t.Fatal(err)
+	}
+	p := dedupPolicy{window: time.Hour}
+	if err := p.reportRepeats(client, stateDir, now); err == nil {
+		t.Fatal("report with a failing chat succeeded")
+	}
+	if err := p.reportRepeats(client, stateDir, now); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if strings.Join(chats, ",") != "a,b,c" {
+		t.Fatalf("reported to %v, want each chat once", chats)
+	}
+	state, err := loadDedupState(stateDir)
+	if entry := state["fp"]; err != nil || entry.Suppressed != 0 || entry.Reported != nil || !entry.Since.Equal(now) {
+		t.Fatalf("state=%+v err=%v, want a new window", state, err)
+	}
+}
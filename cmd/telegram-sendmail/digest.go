@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/lucasew/telegram-sendmail/internal/utils"
+	"github.com/spf13/viper"
+)
+
+// Values of digest_by.
+const (
+	digestBySubject = "subject"
+	digestBySender  = "sender"
+)
+
+// digestFilename names the document carrying every message of a digest.
+const digestFilename = "digest.txt"
+
+// ErrInvalidDigestBy is returned for an unknown digest_by value.
+var ErrInvalidDigestBy = errors.New("digest grouping must be subject or sender")
+
+// digestPolicy holds new messages for window so bursts to the same chats
+// with the same subject (or sender) go out as one Telegram message. A zero
+// window disables digests.
+type digestPolicy struct {
+	window time.Duration
+	by     string
+}
+
+func digestPolicyFromConfig() (digestPolicy, error) {
+	p := digestPolicy{
+		window: viper.GetDuration("digest_window"),
+		by:     viper.GetString("digest_by"),
+	}
+	if p.window > 0 && p.by != digestBySubject && p.by != digestBySender {
+		return digestPolicy{}, fmt.Errorf("%w, got %q", ErrInvalidDigestBy, p.by)
+	}
+	return p, nil
+}
+
+// digestMessage is a queued message considered for a digest. Grouping
+// needs only the envelope and headers; parsed is filled in when the message
+// is sent.
+type digestMessage struct {
+	id       string
+	env      envelope
+	chats    []string
+	subject  string
+	sender   string
+	enqueued time.Time
+	parsed   parsedMail
+	// size and modTime are of the file the rest was read from.
+	size    int64
+	modTime time.Time
+}
+
+// key groups messages that go to the same chats and share the subject or
+// sender.
+func (p digestPolicy) key(m digestMessage) string {
+	value := m.subject
+	if p.by == digestBySender {
+		value = m.sender
+	}
+	return strings.Join(m.chats, ",") + "\x00" + value
+}
+
+// messageSender is who a message is from for digest_by=sender: the envelope
+// sender, else the From header, else the submitting process.
+func messageSender(env envelope, header headerGetter) string {
+	if env.sender != "" {
+		return strings.ToLower(env.sender)
+	}
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		return strings.ToLower(from.Address)
+	}
+	if env.peer != nil {
+		return env.peer.origin()
+	}
+	return ""
+}
+
+// digestState carries digest grouping of one state directory from one serve
+// pass to the next: the metadata of every message, so each file is read
+// once, and the messages held last time, which stay held without regrouping
+// until a window closes or the queue changes.
+type digestState struct {
+	messages map[string]digestMessage
+	// Valid while ids is non-nil: the pass that held these saw ids with
+	// policy and no window closes before until (zero when none was held).
+	policy digestPolicy
+	ids    []string
+	until  time.Time
+	held   map[string]bool
+}
+
+// digestStates is the digestState of each state directory.
+var digestStates struct {
+	sync.Mutex
+	dirs map[string]*digestState
+}
+
+// reusable reports whether the last pass's outcome still holds for ids.
+func (s *digestState) reusable(policy digestPolicy, ids []string, now time.Time) bool {
+	return s.ids != nil && s.policy == policy && slices.Equal(s.ids, ids) &&
+		(s.until.IsZero() || now.Before(s.until))
+}
+
+// message returns the digest metadata of queued message id, read from its
+// envelope and headers only when the file is new or changed since.
+func (s *digestState) message(stateDir, id string, router chatRouter) (digestMessage, error) {
+	fpath := filepath.Join(stateDir, id)
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return digestMessage{}, err
+	}
+	if m, ok := s.messages[id]; ok && m.size == info.Size() && m.modTime.Equal(info.ModTime()) {
+		return m, nil
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return digestMessage{}, err
+	}
+	defer f.Close()
+	env, payload, err := readQueuedMessage(f, info.Size())
+	if err != nil {
+		return digestMessage{}, err
+	}
+	// Without a parsable header the defaults apply, as on delivery.
+	header, _, _ := readMIMEHeader(payload)
+	return digestMessage{
+		id:       id,
+		env:      env,
+		chats:    messageChats(router, env, payload),
+		subject:  mailSubject(header, viper.GetString("default_subject")),
+		sender:   messageSender(env, header),
+		enqueued: enqueueTime(id, env, info.ModTime()),
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+	}, nil
+}
+
+// digestResult is what processDigests did with the queue. handled holds
+// the IDs the per-message loop must skip this pass.
+type digestResult struct {
+	handled        map[string]bool
+	sent, failed   int
+	waiting        int
+	floodRetryWait time.Duration
+}
+
+// processDigests groups never-attempted messages by policy, holds each group
+// until its oldest message is window old (or force is set), then sends
+// groups of two or more as one digest. Single messages and retries are left
+// to the per-message loop so backoff and dead-lettering apply as usual.
+//
+// Only the envelope and headers of a message are read, once; while the
+// queue is unchanged, the held messages stay held without regrouping until
+// the first window closes.
+func processDigests(client *telegram.Client, stateDir string, router chatRouter, policy digestPolicy, ids []string, now time.Time, force bool) digestResult {
+	digestStates.Lock()
+	defer digestStates.Unlock()
+	state := digestStates.dirs[stateDir]
+	if state == nil {
+		state = &digestState{}
+		if digestStates.dirs == nil {
+			digestStates.dirs = map[string]*digestState{}
+		}
+		digestStates.dirs[stateDir] = state
+	}
+	if !force && state.reusable(policy, ids, now) {
+		return digestResult{handled: state.held, waiting: len(state.held)}
+	}
+	// Kept only if this pass sends nothing; see the end.
+	state.ids = nil
+
+	res := digestResult{handled: map[string]bool{}}
+	messages := make(map[string]digestMessage, len(ids))
+	groups := map[string][]digestMessage{}
+	var order []string
+	for _, id := range ids {
+		status, err := loadQueueStatus(stateDir, id)
+		if err != nil || status.Attempts > 0 {
+			continue
+		}
+		m, err := state.message(stateDir, id, router)
+		if err != nil {
+			continue
+		}
+		messages[id] = m
+		key := policy.key(m)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], m)
+	}
+	state.messages = messages
+
+	var until time.Time
+	sending := false
+	for _, key := range order {
+		group := groups[key]
+		if closes := group[0].enqueued.Add(policy.window); !force && now.Before(closes) {
+			for _, m := range group {
+				res.handled[m.id] = true
+			}
+			res.waiting += len(group)
+			if until.IsZero() || closes.Before(until) {
+				until = closes
+			}
+			continue
+		}
+		if len(group) < 2 {
+			continue
+		}
+		sending = true
+		for _, m := range group {
+			res.handled[m.id] = true
+		}
+		err := deliverDigest(client, stateDir, group)
+		switch {
+		case errors.Is(err, ErrQueueFileBusy):
+			res.waiting += len(group)
+		case err != nil:
+			if wait, ok := telegram.RetryAfter(err); ok {
+				res.floodRetryWait = wait
+				res.failed += len(group)
+				return res
+			}
+			utils.ReportError(err, "Failed to send digest", "messages", len(group), "subject", group[0].subject)
+			res.failed += len(group)
+		default:
+			slog.Info("Digest sent", "messages", len(group), "subject", group[0].subject)
+			res.sent += len(group)
+		}
+	}
+	if !sending {
+		state.policy, state.ids, state.until, state.held = policy, slices.Clone(ids), until, res.handled
+	}
+	return res
+}
+
+// deliverDigest locks every message of group, parses it, sends one summary
+// per chat with the full set attached, and removes the messages. On failure
+// each message is charged an attempt, so it is retried on its own with
+// backoff. ErrQueueFileBusy means part of the group is locked elsewhere.
+func deliverDigest(client *telegram.Client, stateDir string, group []digestMessage) error {
+	var locks []*queueLock
+	defer func() {
+		for _, lock := range locks {
+			if err := lock.Close(); err != nil {
+				utils.ReportError(err, "Failed to unlock message file")
+			}
+		}
+	}()
+	for i, m := range group {
+		lock, err := lockQueueFile(filepath.Join(stateDir, m.id))
+		if err != nil {
+			// Removed or being handled by a queue command: try again next pass.
+			return fmt.Errorf("%s: %w", m.id, ErrQueueFileBusy)
+		}
+		locks = append(locks, lock)
+		_, payload, err := lock.message()
+		if err != nil {
+			return fmt.Errorf("%s: read message: %w", m.id, err)
+		}
+		group[i].parsed = parseMailMessage(payload, viper.GetString("default_subject"))
+	}
+
+	err := sendDigest(client, group)
+	if _, ok := telegram.RetryAfter(err); ok {
+		return err
+	}
+	now := time.Now()
+	for _, m := range group {
+		if err != nil {
+			if _, statusErr := recordFailedAttempt(stateDir, m.id, now, err); statusErr != nil {
+				utils.ReportError(statusErr, "Failed to record delivery attempt", "id", m.id)
+			}
+			continue
+		}
+		if rmErr := removeQueueFile(stateDir, m.id); rmErr != nil {
+			utils.ReportError(rmErr, "Failed to remove sent file", "id", m.id)
+		}
+	}
+	return err
+}
+
+// sendDigest posts the first message's body with a count, replying with a
+// document holding every message of the group. Original attachments are not
+// forwarded.
+func sendDigest(client *telegram.Client, group []digestMessage) error {
+	first, last := group[0], group[len(group)-1]
+	subject := fmt.Sprintf("%s (%d messages)", first.subject, len(group))
+	body := fmt.Sprintf("%d messages from %s to %s, all attached. First:\n\n%s",
+		len(group),
+		first.enqueued.Local().Format(time.DateTime),
+		last.enqueued.Local().Format(time.DateTime),
+		plainBody(first.parsed),
+	)
+	var all strings.Builder
+	for _, m := range group {
+		fmt.Fprintf(&all, "--- %s  %s\n%s\n\n", m.enqueued.Local().Format(time.DateTime), m.subject, strings.TrimRight(plainBody(m.parsed), "\n"))
+	}
+
+	hostname := headingSource(viper.GetString("hostname"), first.env, viper.GetBool("show_sender"))
+	for _, chat := range first.chats {
+		messageID, err := client.Send(chat, subject, body, hostname)
+		if err != nil {
+			return fmt.Errorf("chat %s: %w", chat, err)
+		}
+		digest := telegram.NewFile(digestFilename, "text/plain", strings.NewReader(all.String()), int64(all.Len()))
+		if _, err := client.SendAttachment(chat, messageID, digest); err != nil {
+			// The summary is already in the chat; re-sending would duplicate it.
+			utils.ReportError(err, "Failed to send digest attachment", "chat", chat)
+		}
+	}
+	return nil
+}
+
+// plainBody is the message body as plain text. Of a long body only the
+// start is kept, followed by a note.
+func plainBody(p parsedMail) string {
+	if p.html {
+		return telegram.PlainText(p.body)
+	}
+	if p.long != nil {
+		return p.body + fmt.Sprintf("\n[... %d bytes in all, shortened]", p.long.content.size)
+	}
+	return p.body
+}
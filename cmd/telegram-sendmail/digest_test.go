@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/spf13/viper"
+)
+
+// writeQueued queues payload under an ID enqueued age ago.
+func writeQueued(t *testing.T, stateDir string, age time.Duration, seq int, payload string) string {
+	t.Helper()
+	id := strconv.FormatInt(time.Now().Add(-age).UnixNano()+int64(seq), 10)
+	if err := os.WriteFile(filepath.Join(stateDir, id), []byte(payload), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestProcessQueueDigest(t *testing.T) {
+	viper.Set("digest_window", time.Minute)
+	viper.Set("digest_by", digestBySubject)
+	defer viper.Set("digest_window", 0)
+
+	stateDir := t.TempDir()
+	for i := range 3 {
+		writeQueued(t, stateDir, 2*time.Minute, i, "Subject: backup failed\n\nrun "+strconv.Itoa(i))
+	}
+	writeQueued(t, stateDir, 2*time.Minute, 10, "Subject: disk full\n\n/var")
+	fresh := writeQueued(t, stateDir, 0, 0, "Subject: new\n\njust now")
+
+	var mu sync.Mutex
+	var texts, documents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("parse form: %v", err)
+			}
+			texts = append(texts, r.FormValue("text"))
+		} else {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("parse multipart: %v", err)
+			}
+			f, _, err := r.FormFile("document")
+			if err != nil {
+				t.Errorf("form file: %v", err)
+			} else if data, err := io.ReadAll(f); err != nil {
+				t.Errorf("read document: %v", err)
+			} else {
+				documents = append(documents, string(data))
+			}
+		}
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	empty, sent, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false)
+	if empty || sent != 4 || errs != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d, want 4 sent and the fresh one held", empty, sent, errs)
+	}
+	if len(texts) != 2 || !strings.Contains(texts[0], "backup failed (3 messages)") || !strings.Contains(texts[0], "run 0") {
+		t.Fatalf("texts=%q, want one digest and one single message", texts)
+	}
+	if len(documents) != 1 || !strings.Contains(documents[0], "run 0") || !strings.Contains(documents[0], "run 2") {
+		t.Fatalf("documents=%q, want the full digest attached", documents)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, fresh)); err != nil {
+		t.Fatalf("fresh message not held: %v", err)
+	}
+
+	// flush sends held messages without waiting for the window.
+	if empty, sent, _ := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, true); !empty || sent != 1 {
+		t.Fatalf("forced pass empty=%v sent=%d", empty, sent)
+	}
+}
+
+func TestDigestFailureChargesEachMessage(t *testing.T) {
+	viper.Set("digest_window", time.Minute)
+	viper.Set("digest_by", digestBySubject)
+	defer viper.Set("digest_window", 0)
+
+	stateDir := t.TempDir()
+	ids := []string{
+		writeQueued(t, stateDir, 2*time.Minute, 0, "Subject: s\n\na"),
+		writeQueued(t, stateDir, 2*time.Minute, 1, "Subject: s\n\nb"),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	if empty, sent, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false); empty || sent != 0 || errs != 2 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d", empty, sent, errs)
+	}
+	for _, id := range ids {
+		if status, err := loadQueueStatus(stateDir, id); err != nil || status.Attempts != 1 {
+			t.Fatalf("%s status=%+v err=%v", id, status, err)
+		}
+	}
+}
+
+func TestProcessDigestsReadsHeadersOnce(t *testing.T) {
+	stateDir := t.TempDir()
+	policy := digestPolicy{window: time.Minute, by: digestBySubject}
+	router := chatRouter{defaultChat: "123"}
+	first := writeQueued(t, stateDir, 0, 0, "Subject: a\n\none")
+	second := writeQueued(t, stateDir, 0, 1, "Subject: a\n\ntwo")
+	ids := []string{first, second}
+	now := time.Now()
+	subjects := func() (string, string) {
+		digestStates.Lock()
+		defer digestStates.Unlock()
+		messages := digestStates.dirs[stateDir].messages
+		return messages[first].subject, messages[second].subject
+	}
+
+	// Nothing closes a window, so no client is needed.
+	if res := processDigests(nil, stateDir, router, policy, ids, now, false); res.waiting != 2 || len(res.handled) != 2 {
+		t.Fatalf("first pass: %+v", res)
+	}
+
+	// An unchanged queue is not read again before the window closes.
+	if err := os.WriteFile(filepath.Join(stateDir, first), []byte("Subject: b\n\nchanged"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if res := processDigests(nil, stateDir, router, policy, ids, now.Add(time.Second), false); res.waiting != 2 {
+		t.Fatalf("second pass: %+v", res)
+	}
+	if a, _ := subjects(); a != "a" {
+		t.Fatalf("unchanged queue regrouped: subject %q", a)
+	}
+
+	// A new message regroups; only changed files are read again.
+	info, err := os.Stat(filepath.Join(stateDir, second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, second), []byte("Subject: c\n\ntwo"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(stateDir, second), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, writeQueued(t, stateDir, 0, 2, "Subject: a\n\nthree"))
+	if res := processDigests(nil, stateDir, router, policy, ids, now.Add(2*time.Second), false); res.waiting != 3 {
+		t.Fatalf("third pass: %+v", res)
+	}
+	if a, b := subjects(); a != "b" || b != "a" {
+		t.Fatalf("subjects %q, %q: want the changed file re-read and the same-size, same-mtime one cached", a, b)
+	}
+}
+
+func TestDigestPolicyFromConfig(t *testing.T) {
+	viper.Set("digest_window", time.Minute)
+	defer viper.Set("digest_window", 0)
+	viper.Set("digest_by", "recipient")
+	defer viper.Set("digest_by", digestBySubject)
+	if _, err := digestPolicyFromConfig(); !errors.Is(err, ErrInvalidDigestBy) {
+		t.Fatalf("got %v, want ErrInvalidDigestBy", err)
+	}
+}
+
+func TestMessageSender(t *testing.T) {
+	header := textproto.MIMEHeader{"From": {"Backup <Backup@example.com>"}, "Subject": {"s"}}
+	if got := messageSender(envelope{sender: "Cron@host"}, header); got != "cron@host" {
+		t.Fatalf("envelope sender: %q", got)
+	}
+	if got := messageSender(envelope{}, header); got != "backup@example.com" {
+		t.Fatalf("From header: %q", got)
+	}
+	if got := messageSender(envelope{}, textproto.MIMEHeader(nil)); got != "" {
+		t.Fatalf("no sender: %q", got)
+	}
+}
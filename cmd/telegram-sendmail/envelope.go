@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// envelopeMagicPrefix starts every envelope; the version follows it on
+	// the same line. Raw RFC 822 payloads can never start with it because
+	// it is not a valid header line (no colon).
+	envelopeMagicPrefix = "telegram-sendmail-envelope/"
+	// envelopeVersion is the version written by this build.
+	envelopeVersion = 1
+	// maxEnvelopeSize bounds the envelope header read ahead of a streamed
+	// payload; real ones are a few hundred bytes.
+	maxEnvelopeSize = 64 << 10
+	// maxQueuedEnvelopeSize bounds the envelope of a queue file: a client's
+	// plus the few fields serve adds.
+	maxQueuedEnvelopeSize = maxEnvelopeSize + 4<<10
+)
+
+// ErrUnsupportedEnvelope is returned for envelopes from a newer build.
+var ErrUnsupportedEnvelope = errors.New("unsupported envelope version")
+
+// envelope is the metadata kept in front of each message, both on the wire
+// (written by the sendmail client) and in queue files (written by serve).
+//
+// Layout: a magic line with the version, MIME-style header lines, a blank
+// line, then the message exactly as the caller piped it:
+//
+//	telegram-sendmail-envelope/1
+//	Recipient: root
+//	Sender: backup@host
+//	Sender-Name: Nightly backup
+//	Client-Uid: 1000
+//	Submitted: 2026-01-02T03:04:05.123456789Z
+//	Received: 2026-01-02T03:04:05.223456789Z
+//	Peer-Uid: 1000
+//	Peer-Gid: 1000
+//	Peer-Pid: 4242
+//	Peer-User: backup
+//	Peer-Command: telegram-sendma
+//	Peer-Parent: cron
+//
+//	Subject: ...
+type envelope struct {
+	// recipients are the sendmail positional arguments.
+	recipients []string
+	// sender is the envelope sender (-f), defaulting to the invoking user,
+	// and senderName the full name given with -F.
+	sender     string
+	senderName string
+	// clientUID is the UID the sendmail client reports for itself. It is
+	// informational only: any local process can write to the socket.
+	clientUID string
+	// submitted is when the client read the message; received is when serve
+	// accepted it. Both are zero when unknown (legacy queue files).
+	submitted time.Time
+	received  time.Time
+	// peer is the kernel-reported submitter, set by serve; nil when the
+	// connection carried no credentials (TCP, non-Linux, legacy files).
+	peer *peerCred
+	// authUser is the SMTP AUTH account that submitted the message, and chat
+	// the chat that account is pinned to. Both are set by serve only.
+	authUser string
+	chat     string
+}
+
+// clientFields returns the part of e a sendmail client may set. serve uses
+// it on wire envelopes so clients cannot forge server-side fields.
+func (e envelope) clientFields() envelope {
+	return envelope{
+		recipients: e.recipients,
+		sender:     e.sender,
+		senderName: e.senderName,
+		clientUID:  e.clientUID,
+		submitted:  e.submitted,
+	}
+}
+
+// header returns the envelope header block, including the blank separator
+// line. The payload follows it directly.
+func (e envelope) header() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%d\n", envelopeMagicPrefix, envelopeVersion)
+	for _, rcpt := range e.recipients {
+		writeEnvelopeField(&b, "Recipient", rcpt)
+	}
+	writeEnvelopeField(&b, "Sender", e.sender)
+	writeEnvelopeField(&b, "Sender-Name", e.senderName)
+	writeEnvelopeField(&b, "Client-Uid", e.clientUID)
+	writeEnvelopeTime(&b, "Submitted", e.submitted)
+	writeEnvelopeTime(&b, "Received", e.received)
+	if p := e.peer; p != nil {
+		writeEnvelopeField(&b, "Peer-Uid", strconv.Itoa(p.uid))
+		writeEnvelopeField(&b, "Peer-Gid", strconv.Itoa(p.gid))
+		writeEnvelopeField(&b, "Peer-Pid", strconv.Itoa(p.pid))
+		writeEnvelopeField(&b, "Peer-User", p.user)
+		writeEnvelopeField(&b, "Peer-Command", p.command)
+		writeEnvelopeField(&b, "Peer-Parent", p.parent)
+		writeEnvelopeField(&b, "Peer-Exe", p.exe)
+	}
+	writeEnvelopeField(&b, "Auth-User", e.authUser)
+	writeEnvelopeField(&b, "Chat", e.chat)
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// encode returns the envelope followed by payload.
+func (e envelope) encode(payload []byte) []byte {
+	return append(e.header(), payload...)
+}
+
+// writeEnvelopeField skips empty values and strips line breaks so a value
+// can never start a new header line.
+func writeEnvelopeField(b *strings.Builder, key, value string) {
+	value = strings.TrimSpace(strings.NewReplacer("\r", "", "\n", "").Replace(value))
+	if value != "" {
+		fmt.Fprintf(b, "%s: %s\n", key, value)
+	}
+}
+
+func writeEnvelopeTime(b *strings.Builder, key string, t time.Time) {
+	if !t.IsZero() {
+		writeEnvelopeField(b, key, t.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// splitEnvelope separates an envelope from its payload. Data without the
+// magic line (legacy queue files, netcat clients) is returned whole with
+// ok false so callers treat it as a bare message.
+func splitEnvelope(data []byte) (env envelope, payload []byte, ok bool, err error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagicPrefix)) {
+		return envelope{}, data, false, nil
+	}
+	// The writer only emits LF line endings, so the first blank line ends
+	// the envelope and everything after it is the payload, byte for byte.
+	end := bytes.Index(data, []byte("\n\n"))
+	if end < 0 {
+		return envelope{}, nil, true, errors.New("envelope is missing its blank separator line")
+	}
+	payload = data[end+2:]
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:end+2])))
+	magic, err := tp.ReadLine()
+	if err != nil {
+		return envelope{}, nil, true, err
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(magic, envelopeMagicPrefix))
+	if err != nil || version < 1 {
+		return envelope{}, nil, true, fmt.Errorf("malformed envelope line %q", magic)
+	}
+	if version > envelopeVersion {
+		return envelope{}, nil, true, fmt.Errorf("%w %d", ErrUnsupportedEnvelope, version)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return envelope{}, nil, true, fmt.Errorf("read envelope header: %w", err)
+	}
+
+	env = envelope{
+		recipients: header.Values("Recipient"),
+		sender:     header.Get("Sender"),
+		senderName: header.Get("Sender-Name"),
+		clientUID:  header.Get("Client-Uid"),
+		submitted:  parseEnvelopeTime(header.Get("Submitted")),
+		received:   parseEnvelopeTime(header.Get("Received")),
+		peer:       parseEnvelopePeer(header),
+		authUser:   header.Get("Auth-User"),
+		chat:       header.Get("Chat"),
+	}
+	return env, payload, true, nil
+}
+
+// readEnvelope is splitEnvelope for a stream: it consumes the envelope from
+// r and leaves r at the first payload byte. Without the magic line nothing
+// is consumed and ok is false.
+func readEnvelope(r *bufio.Reader) (env envelope, ok bool, err error) {
+	return readEnvelopeUpTo(r, maxEnvelopeSize)
+}
+
+// readQueuedMessage reads the envelope at the start of a queue file of size
+// bytes and returns it with the payload that follows as a section of f, so
+// the payload is read as it is needed rather than loaded whole. Files
+// without an envelope are all payload.
+func readQueuedMessage(f io.ReaderAt, size int64) (envelope, *io.SectionReader, error) {
+	sr := io.NewSectionReader(f, 0, size)
+	br := bufio.NewReader(sr)
+	env, _, err := readEnvelopeUpTo(br, maxQueuedEnvelopeSize)
+	if err != nil {
+		return envelope{}, nil, err
+	}
+	read, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return envelope{}, nil, err
+	}
+	off := read - int64(br.Buffered())
+	return env, io.NewSectionReader(f, off, size-off), nil
+}
+
+// byteSection is b as a payload section, for messages already in memory.
+func byteSection(b []byte) *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+}
+
+func readEnvelopeUpTo(r *bufio.Reader, limit int) (env envelope, ok bool, err error) {
+	// Peek errors surface again when the caller reads the payload.
+	if prefix, _ := r.Peek(len(envelopeMagicPrefix)); string(prefix) != envelopeMagicPrefix {
+		return envelope{}, false, nil
+	}
+	var header []byte
+	for !bytes.HasSuffix(header, []byte("\n\n")) {
+		line, err := r.ReadSlice('\n')
+		header = append(header, line...)
+		if len(header) > limit {
+			return envelope{}, true, fmt.Errorf("envelope is over %d bytes", limit)
+		}
+		if errors.Is(err, io.EOF) {
+			return envelope{}, true, errors.New("envelope is missing its blank separator line")
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return envelope{}, true, err
+		}
+	}
+	env, _, _, err = splitEnvelope(header)
+	return env, true, err
+}
+
+// parseEnvelopePeer returns nil unless all three kernel-reported IDs are
+// present and numeric; a partial peer would misattribute the message.
+func parseEnvelopePeer(header textproto.MIMEHeader) *peerCred {
+	var ids [3]int
+	for i, key := range []string{"Peer-Uid", "Peer-Gid", "Peer-Pid"} {
+		n, err := strconv.Atoi(header.Get(key))
+		if err != nil {
+			return nil
+		}
+		ids[i] = n
+	}
+	return &peerCred{
+		uid:     ids[0],
+		gid:     ids[1],
+		pid:     ids[2],
+		user:    header.Get("Peer-User"),
+		command: header.Get("Peer-Command"),
+		parent:  header.Get("Peer-Parent"),
+		exe:     header.Get("Peer-Exe"),
+	}
+}
+
+// parseEnvelopeTime returns the zero time for missing or malformed values;
+// timestamps are informational and must not block delivery.
+func parseEnvelopeTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
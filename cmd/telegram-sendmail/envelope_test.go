@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	submitted := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	env := envelope{
+		recipients: []string{"root", "backup@example.com"},
+		sender:     "cron@host",
+		senderName: "Nightly backup",
+		clientUID:  "1000",
+		submitted:  submitted,
+		received:   submitted.Add(time.Second),
+		peer: &peerCred{
+			uid: 34, gid: 34, pid: 4242,
+			user: "backup", command: "telegram-sendma", parent: "cron", exe: "/usr/bin/telegram-sendmail",
+		},
+		authUser: "grafana",
+		chat:     "-100123:7",
+	}
+	payload := []byte("Subject: s\n\nbody\n\nmore")
+
+	got, gotPayload, ok, err := splitEnvelope(env.encode(payload))
+	if err != nil || !ok {
+		t.Fatalf("splitEnvelope ok=%v err=%v", ok, err)
+	}
+	if !reflect.DeepEqual(got, env) {
+		t.Fatalf("envelope=%+v want %+v", got, env)
+	}
+	if string(gotPayload) != string(payload) {
+		t.Fatalf("payload=%q want %q", gotPayload, payload)
+	}
+}
+
+func TestEnvelopeStripsLineBreaks(t *testing.T) {
+	env := envelope{recipients: []string{"root\nReceived: 1999-01-01T00:00:00Z"}}
+	got, _, _, err := splitEnvelope(env.encode([]byte("x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.received.IsZero() {
+		t.Fatalf("recipient injected a Received field: %+v", got)
+	}
+}
+
+func TestSplitEnvelopeLegacyPayload(t *testing.T) {
+	data := []byte("Subject: old\n\nqueued before envelopes")
+	env, payload, ok, err := splitEnvelope(data)
+	if err != nil || ok {
+		t.Fatalf("legacy payload: ok=%v err=%v", ok, err)
+	}
+	if !reflect.DeepEqual(env, envelope{}) || string(payload) != string(data) {
+		t.Fatalf("legacy payload changed: %+v %q", env, payload)
+	}
+}
+
+func TestSplitEnvelopeErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"no separator":  "telegram-sendmail-envelope/1\nSender: x\n",
+		"bad version":   "telegram-sendmail-envelope/x\n\nbody",
+		"bad header":    "telegram-sendmail-envelope/1\nnot a header\n\nbody",
+		"newer version": "telegram-sendmail-envelope/99\n\nbody",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, ok, err := splitEnvelope([]byte(data))
+			if err == nil || !ok {
+				t.Fatalf("expected error for %q, got ok=%v err=%v", data, ok, err)
+			}
+		})
+	}
+	_, _, _, err := splitEnvelope([]byte("telegram-sendmail-envelope/99\n\nbody"))
+	if !errors.Is(err, ErrUnsupportedEnvelope) {
+		t.Fatalf("expected ErrUnsupportedEnvelope, got %v", err)
+	}
+}
+
+func TestEnvelopeClientFieldsDropsServerFields(t *testing.T) {
+	env := envelope{sender: "s", received: time.Now(), peer: &peerCred{uid: 0}, authUser: "u", chat: "1"}
+	if got := env.clientFields(); !got.received.IsZero() || got.peer != nil || got.authUser != "" || got.chat != "" || got.sender != "s" {
+		t.Fatalf("clientFields=%+v", got)
+	}
+}
+
+func TestSplitEnvelopePartialPeerIgnored(t *testing.T) {
+	data := "telegram-sendmail-envelope/1\nPeer-Uid: 0\nPeer-User: root\n\nbody"
+	env, _, _, err := splitEnvelope([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.peer != nil {
+		t.Fatalf("peer without gid/pid must be dropped, got %+v", env.peer)
+	}
+}
+
+func TestReadEnvelope(t *testing.T) {
+	env := envelope{recipients: []string{"root"}, sender: "cron@host"}
+	r := bufio.NewReader(strings.NewReader(string(env.encode([]byte("Subject: s\n\nbody")))))
+	got, ok, err := readEnvelope(r)
+	if err != nil || !ok {
+		t.Fatalf("readEnvelope ok=%v err=%v", ok, err)
+	}
+	if !reflect.DeepEqual(got, env) {
+		t.Fatalf("envelope=%+v want %+v", got, env)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "Subject: s\n\nbody" {
+		t.Fatalf("payload=%q", rest)
+	}
+
+	// A bare message is left for the caller, down to a short one.
+	for _, data := range []string{"Subject: old\n\nbody", "x", ""} {
+		r := bufio.NewReader(strings.NewReader(data))
+		if _, ok, err := readEnvelope(r); ok || err != nil {
+			t.Fatalf("bare %q: ok=%v err=%v", data, ok, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != data {
+			t.Fatalf("bare %q consumed, left %q", data, rest)
+		}
+	}
+}
+
+func TestReadEnvelopeErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"no separator": "telegram-sendmail-envelope/1\nSender: x\n",
+		"bad version":  "telegram-sendmail-envelope/x\n\nbody",
+		"too big":      "telegram-sendmail-envelope/1\n" + strings.Repeat("Recipient: root\n", maxEnvelopeSize/16) + "\nbody",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, ok, err := readEnvelope(bufio.NewReader(strings.NewReader(data)))
+			if err == nil || !ok {
+				t.Fatalf("expected error, got ok=%v err=%v", ok, err)
+			}
+		})
+	}
+}
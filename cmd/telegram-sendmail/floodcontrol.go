@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// floodControlFile records until when Telegram asked us to stop sending
+// (429 retry_after). The limit is per bot, so it pauses the whole queue, and
+// it is on disk so `queue flush` and a restarted serve honor it too.
+const floodControlFile = ".floodcontrol.json"
+
+type floodControlState struct {
+	Until time.Time `json:"until"`
+}
+
+// queuePausedUntil returns the end of the current flood control pause, or
+// the zero time. An unreadable state file does not hold the queue back.
+func queuePausedUntil(stateDir string) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, floodControlFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read flood control state: %w", err)
+	}
+	var state floodControlState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return time.Time{}, fmt.Errorf("parse flood control state: %w", err)
+	}
+	return state.Until, nil
+}
+
+// pauseQueue stops deliveries until the given time. An earlier pause never
+// shortens one already in effect.
+func pauseQueue(stateDir string, until time.Time) error {
+	current, _ := queuePausedUntil(stateDir)
+	if !until.After(current) {
+		return nil
+	}
+	if err := writeStateFile(stateDir, floodControlFile, floodControlState{Until: until}); err != nil {
+		return fmt.Errorf("write flood control state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+)
+
+func TestPauseQueueKeepsLongestPause(t *testing.T) {
+	dir := t.TempDir()
+	if until, err := queuePausedUntil(dir); err != nil || !until.IsZero() {
+		t.Fatalf("fresh state until=%s err=%v", until, err)
+	}
+	later := time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC)
+	if err := pauseQueue(dir, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := pauseQueue(dir, later.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if until, err := queuePausedUntil(dir); err != nil || !until.Equal(later) {
+		t.Fatalf("until=%s err=%v, want %s", until, err, later)
+	}
+}
+
+func TestProcessQueueFloodControl(t *testing.T) {
+	stateDir := t.TempDir()
+	for _, id := range []string{"001", "002"} {
+		if err := os.WriteFile(filepath.Join(stateDir, id), []byte("Subject: s\n\nbody"), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		if _, err := w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 30","parameters":{"retry_after":30}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	empty, sent, errs := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false)
+	if empty || sent != 0 || errs != 1 || calls.Load() != 1 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d calls=%d, want one request then pause", empty, sent, errs, calls.Load())
+	}
+	until, err := queuePausedUntil(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(until); d <= 25*time.Second || d > 30*time.Second {
+		t.Fatalf("paused for %s, want ~30s", d)
+	}
+	// Flood control is not charged to the message.
+	if status, err := loadQueueStatus(stateDir, "001"); err != nil || status.Attempts != 0 {
+		t.Fatalf("status=%+v err=%v", status, err)
+	}
+
+	// Neither serve nor a forced flush sends while paused.
+	for _, force := range []bool{false, true} {
+		if empty, _, _ := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, force); empty || calls.Load() != 1 {
+			t.Fatalf("force=%v: empty=%v calls=%d, want paused", force, empty, calls.Load())
+		}
+	}
+}
+
+func TestQueuePausedUntilCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, floodControlFile), []byte("{"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if until, err := queuePausedUntil(dir); err == nil || !until.IsZero() {
+		t.Fatalf("until=%s err=%v, want parse error", until, err)
+	}
+	if err := pauseQueue(dir, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queuePausedUntil(dir); err != nil {
+		t.Fatalf("rewritten state unreadable: %v", err)
+	}
+}
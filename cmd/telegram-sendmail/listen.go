@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultListenSocketMode matches SocketMode= of the packaged systemd socket:
+// any local user may submit mail.
+const defaultListenSocketMode = "0777"
+
+// ErrSocketInUse is returned when --listen names a Unix socket that another
+// process is still serving.
+var ErrSocketInUse = errors.New("socket is in use by another process")
+
+// parseListenAddress splits a --listen value of the form "unix:/path" or
+// "tcp:host:port" into the net.Listen network and address.
+func parseListenAddress(spec string) (network, address string, err error) {
+	network, address, ok := strings.Cut(spec, ":")
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("listen address %q: want unix:/path or tcp:host:port", spec)
+	}
+	switch network {
+	case "unix":
+		if !filepath.IsAbs(address) {
+			return "", "", fmt.Errorf("listen address %q: socket path must be absolute", spec)
+		}
+	case "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("listen address %q: %w", spec, err)
+		}
+	default:
+		return "", "", fmt.Errorf("listen address %q: unsupported network %q", spec, network)
+	}
+	return network, address, nil
+}
+
+// parseSocketMode parses an octal permission string such as "0660".
+func parseSocketMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("socket mode %q: want octal permissions such as 0660", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// listenAddress creates serve's own listener for daemon mode. Unix sockets
+// get their parent directory created, a stale socket file from a crashed run
+// removed, and mode applied so local users can connect.
+func listenAddress(spec string, mode fs.FileMode) (net.Listener, error) {
+	network, address, err := parseListenAddress(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		return net.Listen(network, address)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(address), stateDirPerm); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	// The umask applies at bind time; set the mode explicitly afterwards.
+	if err := os.Chmod(address, mode); err != nil {
+		return nil, errors.Join(err, l.Close())
+	}
+	return l, nil
+}
+
+// removeStaleSocket deletes a socket file nobody answers on. Anything else
+// at the path, or a socket a live process accepts on, is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		return errors.Join(fmt.Errorf("%s: %w", path, ErrSocketInUse), conn.Close())
+	}
+	return os.Remove(path)
+}
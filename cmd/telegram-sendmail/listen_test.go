@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		spec, network, address string
+		wantErr                bool
+	}{
+		{spec: "unix:/run/telegram-sendmail/socket.sock", network: "unix", address: "/run/telegram-sendmail/socket.sock"},
+		{spec: "tcp:127.0.0.1:2525", network: "tcp", address: "127.0.0.1:2525"},
+		{spec: "tcp:[::1]:2525", network: "tcp", address: "[::1]:2525"},
+		{spec: "unix:relative.sock", wantErr: true},
+		{spec: "tcp:2525", wantErr: true},
+		{spec: "udp:127.0.0.1:2525", wantErr: true},
+		{spec: "/run/socket.sock", wantErr: true},
+		{spec: "unix:", wantErr: true},
+	}
+	for _, tt := range tests {
+		network, address, err := parseListenAddress(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseListenAddress(%q): want error", tt.spec)
+			}
+			continue
+		}
+		if err != nil || network != tt.network || address != tt.address {
+			t.Errorf("parseListenAddress(%q)=%q,%q,%v", tt.spec, network, address, err)
+		}
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	if mode, err := parseSocketMode("0660"); err != nil || mode != 0o660 {
+		t.Fatalf("parseSocketMode(0660)=%o,%v", mode, err)
+	}
+	for _, s := range []string{"", "rw", "999", "01777"} {
+		if _, err := parseSocketMode(s); err == nil {
+			t.Errorf("parseSocketMode(%q): want error", s)
+		}
+	}
+}
+
+func TestListenAddressUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "socket.sock")
+	l, err := listenAddress("unix:"+path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Fatalf("mode=%o want 660", info.Mode().Perm())
+	}
+
+	// A live socket is not taken over.
+	if _, err := listenAddress("unix:"+path, 0o660); !errors.Is(err, ErrSocketInUse) {
+		t.Fatalf("second listen: got %v, want ErrSocketInUse", err)
+	}
+
+	// A socket left behind by a crash is replaced.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = listenAddress("unix:"+path, 0o660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenAddressRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAddress("unix:"+path, 0o660); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "keep me" {
+		t.Fatalf("regular file touched: %q %v", data, err)
+	}
+}
+
+func TestListenAddressTCP(t *testing.T) {
+	l, err := listenAddress("tcp:127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, ok := l.Addr().(*net.TCPAddr); !ok {
+		t.Fatalf("addr=%v", l.Addr())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+var (
+	// ErrQueueFileBusy is returned when another process holds a queue
+	// file's lock (serve delivering it, or a concurrent queue command).
+	ErrQueueFileBusy = errors.New("queue file is locked by another process")
+	// ErrNotRegularFile is returned for a queue or maildrop path that is a
+	// symlink, FIFO, directory or other non-regular file.
+	ErrNotRegularFile = errors.New("not a regular file")
+)
+
+// queueLock is an exclusive advisory lock on one queue file. serve and the
+// queue subcommands take it before delivering, rewriting or removing a file
+// so they never act on the same message at once.
+type queueLock struct {
+	f *os.File
+}
+
+// lockQueueFile opens path and locks it without blocking. It returns
+// ErrQueueFileBusy when the lock is held elsewhere, fs.ErrNotExist when
+// the file is gone, including when the previous holder removed it while we
+// were waiting on the lock, and ErrNotRegularFile when path is not a
+// regular file. Symlinks are not followed, so a link planted in the
+// world-writable maildrop cannot make root read another file.
+func lockQueueFile(path string) (*queueLock, error) {
+	f, err := openQueueFile(path)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := f.Stat()
+	if err != nil {
+		return nil, errors.Join(err, f.Close())
+	}
+	if !locked.Mode().IsRegular() {
+		return nil, errors.Join(fmt.Errorf("%s: %w", path, ErrNotRegularFile), f.Close())
+	}
+	if err := lockFile(f); err != nil {
+		return nil, errors.Join(err, f.Close())
+	}
+	// The holder may have removed (or replaced) the file before releasing the
+	// lock; our descriptor would then point at an unlinked inode.
+	current, err := os.Lstat(path)
+	if err != nil || !os.SameFile(locked, current) {
+		if closeErr := f.Close(); closeErr != nil {
+			return nil, closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, fs.ErrNotExist
+	}
+	return &queueLock{f: f}, nil
+}
+
+// message returns the locked file's envelope and its payload, which is
+// read from the file as it is used.
+func (l *queueLock) message() (envelope, *io.SectionReader, error) {
+	info, err := l.f.Stat()
+	if err != nil {
+		return envelope{}, nil, err
+	}
+	return readQueuedMessage(l.f, info.Size())
+}
+
+// Close releases the lock.
+func (l *queueLock) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; serve only runs under
+// systemd, so queue commands there are not coordinated.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// openQueueFile opens path for reading.
+func openQueueFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
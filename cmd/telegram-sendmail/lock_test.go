@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLockQueueFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("queue locking needs flock")
+	}
+	path := filepath.Join(t.TempDir(), "1")
+	if err := os.WriteFile(path, []byte("msg"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock locks belong to the open file description, so a second open in
+	// the same process conflicts just like another process would.
+	if _, err := lockQueueFile(path); !errors.Is(err, ErrQueueFileBusy) {
+		t.Fatalf("second lock: got %v, want ErrQueueFileBusy", err)
+	}
+	_, payload, err := lock.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(payload)
+	if err != nil || string(content) != "msg" {
+		t.Fatalf("read=%q err=%v", content, err)
+	}
+	if err := lock.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	if err := again.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockQueueFileRemovedOrReplaced(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := lockQueueFile(filepath.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("missing file: got %v", err)
+	}
+
+	// A file replaced after open must not be treated as the locked one.
+	path := filepath.Join(dir, "1")
+	if err := os.WriteFile(path, []byte("old"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("new"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatalf("lock new file: %v", err)
+	}
+	defer lock.Close()
+	_, payload, err := lock.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(payload)
+	if err != nil || string(content) != "new" {
+		t.Fatalf("read=%q err=%v", content, err)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes a non-blocking exclusive flock on f. The lock is released
+// when f is closed, including when the process dies.
+func lockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return ErrQueueFileBusy
+	}
+	return err
+}
+
+// openQueueFile opens path for reading. It does not follow a symlink in the
+// last component, and O_NONBLOCK keeps a FIFO from blocking the open until
+// a writer shows up; lockQueueFile then rejects anything but a regular file.
+func openQueueFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if errors.Is(err, unix.ELOOP) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotRegularFile)
+	}
+	return f, err
+}
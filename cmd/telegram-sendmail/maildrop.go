@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lucasew/telegram-sendmail/internal/utils"
+)
+
+const (
+	// defaultMaildropDir is where the sendmail client spools messages when
+	// the socket is unavailable (packaging tmpfiles.d + NixOS).
+	defaultMaildropDir = "/var/spool/telegram-sendmail"
+	// maildropTmp and maildropNew are the maildrop subdirectories, as in
+	// Maildir: a message is written under tmp, then renamed into new once
+	// complete, so a pickup never sees half a message. Both are
+	// world-writable and sticky (1733): anyone can drop a message, nobody
+	// can list or remove another user's.
+	maildropTmp = "tmp"
+	maildropNew = "new"
+)
+
+// spoolToMaildrop writes env and the message into the maildrop under dir
+// and returns the spooled file's path. A message over maxSize is refused
+// with ErrPayloadTooBig, as serve would.
+func spoolToMaildrop(dir string, env envelope, message io.Reader, maxSize int64) (path string, err error) {
+	// The name sorts by submission time and, like a Maildir name, is unique
+	// without coordination: time, pid, then CreateTemp's random suffix.
+	f, err := os.CreateTemp(filepath.Join(dir, maildropTmp), fmt.Sprintf("%d.%d.", time.Now().UnixNano(), os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(env.header()); err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(message, maxSize+1))
+	if err != nil {
+		return "", fmt.Errorf("copy stdin to maildrop: %w", err)
+	}
+	if n > maxSize {
+		return "", ErrPayloadTooBig
+	}
+	// The client reports success once the file is in new: it must be on disk.
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	path = filepath.Join(dir, maildropNew, filepath.Base(f.Name()))
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// pickupMaildrop moves the messages spooled under dir into the queue in
+// stateDir, oldest first, and returns how many it moved. They were already
+// accepted (sendmail exited 0), so queue caps and rate limits do not apply.
+// The submitter is the spooled file's owner.
+//
+// Reading other users' files takes root (the packaged units run `queue
+// pickup` as root before serve) or the users' own UID.
+func pickupMaildrop(dir, stateDir string, maxSize int64) (int, error) {
+	newDir := filepath.Join(dir, maildropNew)
+	entries, err := os.ReadDir(newDir)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		fpath := filepath.Join(newDir, entry.Name())
+		if !isQueueEntry(entry) || !entry.Type().IsRegular() {
+			removeMaildropEntry(fpath)
+			continue
+		}
+		// The lock keeps a concurrent pickup from queueing the file twice.
+		lock, err := lockQueueFile(fpath)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrQueueFileBusy) {
+			continue
+		}
+		if errors.Is(err, ErrNotRegularFile) {
+			// Swapped for a link or FIFO since the listing.
+			removeMaildropEntry(fpath)
+			continue
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			// Another user's message; left for a pickup run as root.
+			slog.Debug("Cannot read spooled message", "file", fpath, "error", err)
+			continue
+		}
+		if err != nil {
+			utils.ReportError(err, "Failed to open spooled message", "file", fpath)
+			continue
+		}
+		ok := pickupMaildropFile(lock, fpath, stateDir, maxSize)
+		if closeErr := lock.Close(); closeErr != nil {
+			utils.ReportError(closeErr, "Failed to unlock spooled message", "file", fpath)
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// removeMaildropEntry removes an entry spoolToMaildrop never creates: a
+// dotfile, directory, symlink, FIFO or other special file. Left in new, it
+// would keep the path unit triggering. Nothing is read from it.
+func removeMaildropEntry(fpath string) {
+	slog.Warn("Removing unexpected maildrop entry", "file", fpath)
+	if err := os.RemoveAll(fpath); err != nil {
+		utils.ReportError(err, "Failed to remove unexpected maildrop entry", "file", fpath)
+	}
+}
+
+// pickupMaildropFile queues one locked maildrop file and removes it. Files
+// serve would have rejected are removed unqueued. The queue file is written
+// before the spooled one is removed: a crash in between delivers the message
+// twice rather than not at all.
+func pickupMaildropFile(lock *queueLock, fpath, stateDir string, maxSize int64) bool {
+	info, err := lock.f.Stat()
+	if err != nil {
+		utils.ReportError(err, "Failed to stat spooled message", "file", fpath)
+		return false
+	}
+	r := bufio.NewReader(lock.f)
+	env, err := readSpooledEnvelope(r)
+	if err == nil && hardLinked(info) {
+		// A hard link to a file its planter cannot read, where the kernel
+		// allows such links; fileOwner would credit the file's owner.
+		err = fmt.Errorf("%w: hard-linked file", errInvalidSpooled)
+	}
+	var qpath string
+	if err == nil {
+		env.peer = fileOwner(info)
+		qpath, err = writeQueueFile(stateDir, env, r, maxSize)
+	}
+	switch {
+	case errors.Is(err, errInvalidSpooled), errors.Is(err, ErrPayloadTooBig):
+		utils.ReportError(err, "Dropping invalid spooled message", "file", fpath, "max_size", maxSize)
+		if err := os.Remove(fpath); err != nil {
+			utils.ReportError(err, "Failed to remove invalid spooled message", "file", fpath)
+		}
+		return false
+	case err != nil:
+		utils.ReportError(err, "Failed to queue spooled message", "file", fpath)
+		return false
+	}
+
+	if err := chownToDir(qpath, stateDir); err != nil {
+		utils.ReportError(err, "Failed to hand queued message to the service user", "file", qpath)
+	}
+	if err := os.Remove(fpath); err != nil {
+		// Left in place it would be queued again on every pickup.
+		utils.ReportError(err, "Failed to remove spooled message", "file", fpath)
+		if err := os.Remove(qpath); err != nil {
+			utils.ReportError(err, "Failed to remove queued copy of spooled message", "file", qpath)
+		}
+		return false
+	}
+	slog.Info("Queued spooled message", "file", fpath, "queue_file", qpath)
+	return true
+}
+
+// errInvalidSpooled marks spooled files serve would have rejected.
+var errInvalidSpooled = errors.New("invalid spooled message")
+
+// readSpooledEnvelope reads the envelope of a spooled file from r, leaving r
+// at the payload. Only client-settable fields are kept.
+func readSpooledEnvelope(r *bufio.Reader) (envelope, error) {
+	env, ok, err := readEnvelope(r)
+	if err != nil {
+		return envelope{}, fmt.Errorf("%w: malformed envelope: %w", errInvalidSpooled, err)
+	}
+	if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+		return envelope{}, fmt.Errorf("%w: empty message", errInvalidSpooled)
+	}
+	if ok {
+		env = env.clientFields()
+	}
+	return env, nil
+}
+
+// servePickup is a pickup pass from the serve loop. It returns the maildrop
+// for the next pass: "" once serve turns out unable to read it, as under the
+// packaged units, where `queue pickup` runs as root before serve instead.
+func servePickup(dir, stateDir string, maxSize int64) string {
+	if dir == "" {
+		return ""
+	}
+	_, err := pickupMaildrop(dir, stateDir, maxSize)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		slog.Debug("Not picking up the maildrop", "dir", dir, "error", err)
+		return ""
+	}
+	if err != nil {
+		utils.ReportError(err, "Failed to read the maildrop", "dir", dir)
+	}
+	return dir
+}
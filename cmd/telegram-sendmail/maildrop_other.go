@@ -0,0 +1,31 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileOwner is unknown where files carry no Unix owner.
+func fileOwner(info fs.FileInfo) *peerCred {
+	return nil
+}
+
+// hardLinked is false where link counts are unknown.
+func hardLinked(info fs.FileInfo) bool {
+	return false
+}
+
+// maildropWritable reports whether the maildrop's new directory exists;
+// permissions are left to the spool attempt.
+func maildropWritable(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, maildropNew))
+	return err == nil && info.IsDir()
+}
+
+// chownToDir is a no-op where files carry no Unix owner.
+func chownToDir(path, dir string) error {
+	return nil
+}
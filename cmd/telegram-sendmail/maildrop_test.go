@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testMaildrop returns a maildrop directory with its tmp and new
+// subdirectories, as tmpfiles.d creates them.
+func testMaildrop(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{maildropTmp, maildropNew} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestMaildropSpoolAndPickup(t *testing.T) {
+	dir, stateDir := testMaildrop(t), t.TempDir()
+	env := envelope{recipients: []string{"root"}, sender: "cron", clientUID: "1000"}
+	path, err := spoolToMaildrop(dir, env, strings.NewReader("Subject: s\n\nbody"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != filepath.Join(dir, maildropNew) {
+		t.Fatalf("spooled to %s, want under new", path)
+	}
+	if names := dirNames(t, filepath.Join(dir, maildropTmp)); len(names) != 0 {
+		t.Fatalf("tmp not empty after spooling: %v", names)
+	}
+
+	n, err := pickupMaildrop(dir, stateDir, 1024)
+	if err != nil || n != 1 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+	if names := dirNames(t, filepath.Join(dir, maildropNew)); len(names) != 0 {
+		t.Fatalf("new not empty after pickup: %v", names)
+	}
+	envs, payloads := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 || envs[0].sender != "cron" || envs[0].recipients[0] != "root" || payloads[0] != "Subject: s\n\nbody" {
+		t.Fatalf("queued %+v %q", envs, payloads)
+	}
+	if envs[0].received.IsZero() {
+		t.Fatal("received must be set at pickup")
+	}
+	if runtime.GOOS != "windows" && (envs[0].peer == nil || envs[0].peer.uid != os.Getuid()) {
+		t.Fatalf("peer=%+v, want the spooled file's owner %d", envs[0].peer, os.Getuid())
+	}
+}
+
+func TestMaildropSpoolTooBig(t *testing.T) {
+	dir := testMaildrop(t)
+	_, err := spoolToMaildrop(dir, envelope{}, strings.NewReader("0123456789"), 4)
+	if !errors.Is(err, ErrPayloadTooBig) {
+		t.Fatalf("err=%v want %v", err, ErrPayloadTooBig)
+	}
+	for _, sub := range []string{maildropTmp, maildropNew} {
+		if names := dirNames(t, filepath.Join(dir, sub)); len(names) != 0 {
+			t.Fatalf("%s not empty: %v", sub, names)
+		}
+	}
+}
+
+func TestMaildropPickupDropsInvalidFiles(t *testing.T) {
+	dir, stateDir := testMaildrop(t), t.TempDir()
+	newDir := filepath.Join(dir, maildropNew)
+	for name, content := range map[string]string{
+		"1.bad-envelope": "telegram-sendmail-envelope/1\nno separator",
+		"2.too-big":      "Subject: s\n\n0123456789",
+		"3.empty":        "",
+	} {
+		if err := os.WriteFile(filepath.Join(newDir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// In progress: not picked up until renamed into new.
+	if err := os.WriteFile(filepath.Join(dir, maildropTmp, "4.partial"), []byte("Subject: s\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := pickupMaildrop(dir, stateDir, 8); err != nil || n != 0 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+	if names := dirNames(t, newDir); len(names) != 0 {
+		t.Fatalf("invalid files left in new: %v", names)
+	}
+	if names := dirNames(t, stateDir); len(names) != 0 {
+		t.Fatalf("invalid files queued: %v", names)
+	}
+	if names := dirNames(t, filepath.Join(dir, maildropTmp)); len(names) != 1 {
+		t.Fatalf("tmp=%v, want the partial file untouched", names)
+	}
+}
+
+func TestMaildropPickupRemovesSpecialEntries(t *testing.T) {
+	dir, stateDir := testMaildrop(t), t.TempDir()
+	newDir := filepath.Join(dir, maildropNew)
+	secret := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(secret, []byte("Subject: secret\n\nroot:hash"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(newDir, "1.link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(newDir, "2.dir", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(newDir, ".hidden"), []byte("Subject: s\n\nbody"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := pickupMaildrop(dir, stateDir, 1024); err != nil || n != 0 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+	if names := dirNames(t, newDir); len(names) != 0 {
+		t.Fatalf("entries left in new: %v", names)
+	}
+	if names := dirNames(t, stateDir); len(names) != 0 {
+		t.Fatalf("entries queued: %v", names)
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Fatalf("symlink target: %v", err)
+	}
+}
+
+func TestServePickupDisablesMissingMaildrop(t *testing.T) {
+	if got := servePickup(filepath.Join(t.TempDir(), "missing"), t.TempDir(), 1024); got != "" {
+		t.Fatalf("servePickup kept polling a missing maildrop: %q", got)
+	}
+	dir := testMaildrop(t)
+	if got := servePickup(dir, t.TempDir(), 1024); got != dir {
+		t.Fatalf("servePickup=%q want %q", got, dir)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner is the submitter of a spooled message: whoever created the
+// file. The pid is unknown; the client has exited by now.
+func fileOwner(info fs.FileInfo) *peerCred {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	p := &peerCred{uid: int(st.Uid), gid: int(st.Gid)}
+	if u, err := user.LookupId(strconv.Itoa(p.uid)); err == nil {
+		p.user = u.Username
+	}
+	return p
+}
+
+// hardLinked reports whether the file has other names besides its maildrop
+// entry.
+func hardLinked(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
+
+// maildropWritable reports whether the caller can spool into dir.
+func maildropWritable(dir string) bool {
+	return unix.Access(filepath.Join(dir, maildropNew), unix.W_OK|unix.X_OK) == nil
+}
+
+// chownToDir gives path to the owner of dir. `queue pickup`, `queue flush`
+// and the other queue commands run as root, while serve runs as a
+// DynamicUser that must be able to read, replace and remove what they write
+// to its state directory.
+func chownToDir(path, dir string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Chown(path, int(st.Uid), int(st.Gid))
+}
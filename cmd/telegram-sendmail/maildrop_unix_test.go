@@ -0,0 +1,82 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMaildropPickupRemovesFIFO(t *testing.T) {
+	dir, stateDir := testMaildrop(t), t.TempDir()
+	newDir := filepath.Join(dir, maildropNew)
+	if err := unix.Mkfifo(filepath.Join(newDir, "1.fifo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pickupMaildrop(dir, stateDir, 1024)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pickup blocked on a FIFO")
+	}
+	if names := dirNames(t, newDir); len(names) != 0 {
+		t.Fatalf("entries left in new: %v", names)
+	}
+}
+
+func TestMaildropPickupDropsHardLinks(t *testing.T) {
+	dir, stateDir := testMaildrop(t), t.TempDir()
+	newDir := filepath.Join(dir, maildropNew)
+	// Same filesystem as the maildrop, so the link can be made.
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("Subject: secret\n\nroot:hash"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(secret, filepath.Join(newDir, "1.link")); err != nil {
+		t.Skipf("hard links unavailable: %v", err)
+	}
+
+	if n, err := pickupMaildrop(dir, stateDir, 1024); err != nil || n != 0 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+	if names := dirNames(t, newDir); len(names) != 0 {
+		t.Fatalf("entries left in new: %v", names)
+	}
+	if names := dirNames(t, stateDir); len(names) != 0 {
+		t.Fatalf("entries queued: %v", names)
+	}
+}
+
+func TestLockQueueFileRejectsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{fifo, link, dir} {
+		if _, err := lockQueueFile(path); !errors.Is(err, ErrNotRegularFile) {
+			t.Errorf("lockQueueFile(%s) err=%v, want %v", filepath.Base(path), err, ErrNotRegularFile)
+		}
+	}
+}
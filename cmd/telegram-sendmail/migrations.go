@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/lucasew/telegram-sendmail/internal/utils"
+)
+
+// chatMigrationsFile maps chat IDs of groups that Telegram upgraded to
+// supergroups to their new IDs, so mail keeps flowing until the admin
+// updates the configuration.
+const chatMigrationsFile = ".chatmigrations.json"
+
+// ErrChatMigrated is reported when Telegram moves a configured chat to a new
+// ID; the configuration should be updated to the new one.
+var ErrChatMigrated = errors.New("telegram chat was upgraded to a supergroup, update MAIL_TELEGRAM_CHAT / MAIL_TELEGRAM_ROUTES")
+
+func loadChatMigrations(stateDir string) (map[string]string, error) {
+	migrations := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(stateDir, chatMigrationsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return migrations, nil
+	}
+	if err != nil {
+		return migrations, fmt.Errorf("read chat migrations: %w", err)
+	}
+	if err := json.Unmarshal(data, &migrations); err != nil {
+		return map[string]string{}, fmt.Errorf("parse chat migrations: %w", err)
+	}
+	return migrations, nil
+}
+
+// recordChatMigration adds from -> to to the state directory's overrides.
+func recordChatMigration(stateDir, from, to string) error {
+	migrations, loadErr := loadChatMigrations(stateDir)
+	migrations[from] = to
+	if err := writeStateFile(stateDir, chatMigrationsFile, migrations); err != nil {
+		return errors.Join(loadErr, fmt.Errorf("write chat migrations: %w", err))
+	}
+	return loadErr
+}
+
+// applyChatMigrations restores the recorded overrides on client and records
+// new ones as Telegram reports them. New migrations are reported as errors
+// (and to Sentry) so the admin updates the stale chat ID.
+func applyChatMigrations(client *telegram.Client, stateDir string) error {
+	migrations, err := loadChatMigrations(stateDir)
+	for from, to := range migrations {
+		slog.Warn("Sending to migrated Telegram chat; update the configured chat ID", "old_chat", from, "new_chat", to)
+		client.MigrateChat(from, to)
+	}
+	client.OnChatMigrated = func(from, to string) {
+		utils.ReportError(ErrChatMigrated, "Telegram chat migrated", "old_chat", from, "new_chat", to)
+		if err := recordChatMigration(stateDir, from, to); err != nil {
+			utils.ReportError(err, "Failed to record chat migration", "old_chat", from, "new_chat", to)
+		}
+	}
+	return err
+}
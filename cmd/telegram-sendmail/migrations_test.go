@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+)
+
+func TestChatMigrationPersists(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, "001"), []byte("Subject: s\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var chats []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		chats = append(chats, r.FormValue("chat_id"))
+		if r.FormValue("chat_id") == "-123" {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-100123}}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+			return
+		}
+		if _, err := w.Write([]byte(`{"ok":true}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	newClient := func() *telegram.Client {
+		client := telegram.NewClient("TOKEN", ts.Client())
+		client.APIBaseURL = ts.URL + "/bot%s"
+		if err := applyChatMigrations(client, stateDir); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	empty, sent, errs := processQueue(newClient(), stateDir, chatRouter{defaultChat: "-123"}, false)
+	if !empty || sent != 1 || errs != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d", empty, sent, errs)
+	}
+	migrations, err := loadChatMigrations(stateDir)
+	if err != nil || migrations["-123"] != "-100123" {
+		t.Fatalf("migrations=%v err=%v", migrations, err)
+	}
+
+	// A later run goes straight to the new chat.
+	if err := os.WriteFile(filepath.Join(stateDir, "002"), []byte("Subject: s\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	chats = nil
+	if _, sent, _ := processQueue(newClient(), stateDir, chatRouter{defaultChat: "-123"}, false); sent != 1 || len(chats) != 1 || chats[0] != "-100123" {
+		t.Fatalf("sent=%d chats=%v, want one send to -100123", sent, chats)
+	}
+}
+
+func TestLoadChatMigrationsCorrupt(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, chatMigrationsFile), []byte("not json"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadChatMigrations(stateDir); err == nil {
+		t.Fatal("expected parse error")
+	}
+	// Recording replaces the corrupt file rather than failing silently.
+	if err := recordChatMigration(stateDir, "-1", "-1001"); err == nil {
+		t.Fatal("expected the load error to be reported")
+	}
+	if migrations, err := loadChatMigrations(stateDir); err != nil || migrations["-1"] != "-1001" {
+		t.Fatalf("migrations=%v err=%v", migrations, err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	// maxMIMEDepth bounds multipart nesting so a hostile message cannot
+	// recurse without limit.
+	maxMIMEDepth = 16
+	// defaultMediaType applies when Content-Type is missing or unparsable
+	// (RFC 2045 section 5.2).
+	defaultMediaType = "text/plain"
+	// maxMIMEHeaderSize bounds the header block of a message or part.
+	maxMIMEHeaderSize = 64 << 10
+	// maxInlineBody bounds the plain text body read into memory. Only the
+	// start of a longer body is read, for duplicate detection, digests and
+	// `queue show`; delivery streams it whole from the queue file as a
+	// document. HTML bodies are read whole: they are converted as a whole.
+	maxInlineBody = 256 << 10
+)
+
+// headerGetter is satisfied by both mail.Header and textproto.MIMEHeader.
+type headerGetter interface {
+	Get(key string) string
+}
+
+// mimeLeaf is one non-multipart entity of a message. content is still in
+// the declared charset; use decodeCharset or text before treating it as
+// text.
+type mimeLeaf struct {
+	mediaType string
+	charset   string
+	filename  string
+	// attachment is true for Content-Disposition: attachment. Inline parts
+	// with a filename are also candidates for attachment extraction.
+	attachment bool
+	content    mimeContent
+}
+
+// text returns the leaf's content converted to UTF-8 as it is read.
+// Unknown charsets are passed through.
+func (l mimeLeaf) text() io.Reader {
+	switch strings.ToLower(strings.TrimSpace(l.charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return l.content.open()
+	}
+	enc, err := htmlindex.Get(l.charset)
+	if err != nil {
+		return l.content.open()
+	}
+	return enc.NewDecoder().Reader(l.content.open())
+}
+
+// mimeContent is the body of a MIME entity within the message it was read
+// from. It is decoded as it is read, so even a large attachment is never
+// held in memory whole.
+type mimeContent struct {
+	raw *io.SectionReader
+	// encoding is the Content-Transfer-Encoding still applied to raw:
+	// "base64", "quoted-printable" or "".
+	encoding string
+	// size is the decoded length.
+	size int64
+}
+
+// newMIMEContent measures raw's decoded length. Content that does not
+// decode is used undecoded rather than dropped.
+func newMIMEContent(raw *io.SectionReader, encoding string) mimeContent {
+	c := mimeContent{raw: raw, encoding: strings.ToLower(strings.TrimSpace(encoding)), size: raw.Size()}
+	if c.encoding != "base64" && c.encoding != "quoted-printable" {
+		c.encoding = ""
+		return c
+	}
+	n, err := io.Copy(io.Discard, c.open())
+	if err != nil {
+		c.encoding = ""
+		return c
+	}
+	c.size = n
+	return c
+}
+
+// open returns a reader for the decoded content, from the start.
+func (c mimeContent) open() io.Reader {
+	r := io.NewSectionReader(c.raw, 0, c.raw.Size())
+	switch c.encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// file is the content as an upload.
+func (c mimeContent) file(name, contentType string) telegram.File {
+	return telegram.File{Name: name, ContentType: contentType, Size: c.size, Open: c.open}
+}
+
+// walkMIME flattens a (possibly nested) MIME entity into its leaves in
+// document order. Malformed multipart bodies keep whatever leaves were read
+// before the error so delivery still shows something useful.
+func walkMIME(header headerGetter, body *io.SectionReader) ([]mimeLeaf, error) {
+	var leaves []mimeLeaf
+	err := walkMIMEEntity(header, body, 0, &leaves)
+	return leaves, err
+}
+
+func walkMIMEEntity(header headerGetter, body *io.SectionReader, depth int, leaves *[]mimeLeaf) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = defaultMediaType, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		parts, err := splitMultipart(body, params["boundary"])
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			partHeader, partBody, err := readMIMEHeader(part)
+			if err != nil {
+				return err
+			}
+			if err := walkMIMEEntity(partHeader, partBody, depth+1, leaves); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	leaf := mimeLeaf{
+		mediaType: mediaType,
+		charset:   params["charset"],
+		content:   newMIMEContent(body, header.Get("Content-Transfer-Encoding")),
+	}
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		leaf.attachment = disposition == "attachment"
+		leaf.filename = dparams["filename"]
+	}
+	if leaf.filename == "" {
+		// Older mailers only put the name on Content-Type.
+		leaf.filename = params["name"]
+	}
+	*leaves = append(*leaves, leaf)
+	return nil
+}
+
+// splitMultipart returns the parts of a multipart body (RFC 2046 section
+// 5.1.1) as sections of it, header included, without reading them into
+// memory. The preamble and epilogue are dropped. A body whose closing
+// delimiter is missing keeps its last part up to the end.
+func splitMultipart(body *io.SectionReader, boundary string) ([]*io.SectionReader, error) {
+	delimiter := []byte("--" + boundary)
+	r := bufio.NewReader(io.NewSectionReader(body, 0, body.Size()))
+	var parts []*io.SectionReader
+	start := int64(-1)
+	var off int64
+	// lineBreak is the length of the line break ending the previous line:
+	// it belongs to the delimiter that follows, not to the part.
+	var lineBreak int64
+	lineStart := true
+	for {
+		line, err := r.ReadSlice('\n')
+		lineOff := off
+		off += int64(len(line))
+		if lineStart && bytes.HasPrefix(line, delimiter) {
+			rest := bytes.TrimRight(line[len(delimiter):], " \t\r\n")
+			closing := bytes.Equal(rest, []byte("--"))
+			if closing || len(rest) == 0 {
+				if start >= 0 {
+					end := max(lineOff-lineBreak, start)
+					parts = append(parts, io.NewSectionReader(body, start, end-start))
+				}
+				if closing {
+					return parts, nil
+				}
+				start = off
+			}
+		}
+		lineStart = err == nil
+		switch {
+		case bytes.HasSuffix(line, []byte("\r\n")):
+			lineBreak = 2
+		case bytes.HasSuffix(line, []byte("\n")):
+			lineBreak = 1
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return parts, err
+		}
+	}
+	if start >= 0 && start < body.Size() {
+		parts = append(parts, io.NewSectionReader(body, start, body.Size()-start))
+	}
+	return parts, nil
+}
+
+// readMIMEHeader parses the header block at the start of entity and returns
+// it with the body that follows. Only the header is read.
+func readMIMEHeader(entity *io.SectionReader) (textproto.MIMEHeader, *io.SectionReader, error) {
+	r := bufio.NewReader(io.NewSectionReader(entity, 0, entity.Size()))
+	var block []byte
+	lineStart := true
+	for {
+		line, err := r.ReadSlice('\n')
+		block = append(block, line...)
+		if len(block) > maxMIMEHeaderSize {
+			return nil, nil, fmt.Errorf("MIME header is over %d bytes", maxMIMEHeaderSize)
+		}
+		blank := lineStart && (string(line) == "\n" || string(line) == "\r\n")
+		lineStart = err == nil
+		if blank {
+			break
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			// Header only, without the blank line.
+			block = append(block, "\r\n\r\n"...)
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	n := min(int64(len(block)), entity.Size())
+	return header, io.NewSectionReader(entity, n, entity.Size()-n), nil
+}
+
+// decodeCharset converts content in the named charset to UTF-8. Unknown
+// charsets and invalid sequences degrade to U+FFFD instead of failing.
+func decodeCharset(content []byte, charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return strings.ToValidUTF8(string(content), string(utf8.RuneError))
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return strings.ToValidUTF8(string(content), string(utf8.RuneError))
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return strings.ToValidUTF8(string(content), string(utf8.RuneError))
+	}
+	return string(decoded)
+}
+
+// charsetReader lets mime.WordDecoder handle encoded-words in any charset
+// htmlindex knows, not only UTF-8/ISO-8859-1/US-ASCII.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// selectBodyLeaf picks the leaf shown as the Telegram message: the first
+// inline text/plain part, else the first inline text/html part. It returns
+// the index into leaves, or -1 when the message has no textual body
+// (attachments only).
+func selectBodyLeaf(leaves []mimeLeaf) int {
+	for _, mediaType := range []string{"text/plain", "text/html"} {
+		for i, l := range leaves {
+			if l.mediaType == mediaType && !l.attachment {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// mailAttachment is a MIME part uploaded to Telegram as its own file.
+type mailAttachment struct {
+	filename    string
+	contentType string
+	content     mimeContent
+}
+
+// collectAttachments returns every leaf except the body (index bodyIdx)
+// that should travel as a file: explicit attachments, named parts, and
+// non-text inline parts such as embedded images. Unnamed inline text parts
+// are alternatives of the body and are skipped.
+func collectAttachments(leaves []mimeLeaf, bodyIdx int) []mailAttachment {
+	var attachments []mailAttachment
+	for i, l := range leaves {
+		if i == bodyIdx {
+			continue
+		}
+		if !l.attachment && l.filename == "" && strings.HasPrefix(l.mediaType, "text/") {
+			continue
+		}
+		if l.content.size == 0 {
+			continue
+		}
+		attachments = append(attachments, mailAttachment{
+			filename:    attachmentFilename(l, len(attachments)+1),
+			contentType: l.mediaType,
+			content:     l.content,
+		})
+	}
+	return attachments
+}
+
+// attachmentFilename decodes RFC 2047 names and strips any directory part;
+// unnamed parts get "attachment-N" plus an extension for their media type.
+func attachmentFilename(l mimeLeaf, n int) string {
+	if l.filename != "" {
+		// Windows clients sometimes send full paths; keep only the base name.
+		name := path.Base(strings.ReplaceAll(decodeMIMEHeader(l.filename), "\\", "/"))
+		if name != "." && name != "/" {
+			return name
+		}
+	}
+	name := fmt.Sprintf("attachment-%d", n)
+	if l.mediaType == "message/rfc822" {
+		return name + ".eml"
+	}
+	if exts, err := mime.ExtensionsByType(l.mediaType); err == nil && len(exts) > 0 {
+		return name + exts[0]
+	}
+	return name + ".bin"
+}
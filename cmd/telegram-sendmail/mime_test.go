@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseMailMessageMIME(t *testing.T) {
+	const defaultSubject = "Message"
+
+	tests := []struct {
+		name     string
+		data     string
+		wantBody string
+	}{
+		{
+			name: "multipart/alternative prefers text/plain",
+			data: "Subject: alt\n" +
+				"MIME-Version: 1.0\n" +
+				"Content-Type: multipart/alternative; boundary=\"XX\"\n" +
+				"\n" +
+				"--XX\n" +
+				"Content-Type: text/html; charset=utf-8\n" +
+				"\n" +
+				"<p>html version</p>\n" +
+				"--XX\n" +
+				"Content-Type: text/plain; charset=utf-8\n" +
+				"\n" +
+				"plain version\n" +
+				"--XX--\n",
+			wantBody: "plain version",
+		},
+		{
+			name: "html only is converted to telegram html",
+			data: "Subject: html\n" +
+				"Content-Type: text/html; charset=utf-8\n" +
+				"\n" +
+				"<html><head><style>p{}</style></head><body><p>Disk &amp; CPU</p><p>ok<br>done</p></body></html>",
+			wantBody: "Disk &amp; CPU\n\nok\ndone",
+		},
+		{
+			name: "quoted-printable latin1",
+			data: "Subject: qp\n" +
+				"Content-Type: text/plain; charset=iso-8859-1\n" +
+				"Content-Transfer-Encoding: quoted-printable\n" +
+				"\n" +
+				"caf=E9 =\nsoft break",
+			wantBody: "café soft break",
+		},
+		{
+			name: "base64 utf-8",
+			data: "Subject: b64\n" +
+				"Content-Type: text/plain; charset=utf-8\n" +
+				"Content-Transfer-Encoding: base64\n" +
+				"\n" +
+				"T2zDoSBtdW5k\nbyE=\n",
+			wantBody: "Olá mundo!",
+		},
+		{
+			name: "nested mixed with alternative and attachment",
+			data: "Subject: nested\n" +
+				"Content-Type: multipart/mixed; boundary=outer\n" +
+				"\n" +
+				"--outer\n" +
+				"Content-Type: multipart/alternative; boundary=inner\n" +
+				"\n" +
+				"--inner\n" +
+				"Content-Type: text/plain; charset=windows-1252\n" +
+				"Content-Transfer-Encoding: quoted-printable\n" +
+				"\n" +
+				"price =80 5\n" +
+				"--inner--\n" +
+				"--outer\n" +
+				"Content-Type: text/plain; name=log.txt\n" +
+				"Content-Disposition: attachment; filename=log.txt\n" +
+				"\n" +
+				"attached log\n" +
+				"--outer--\n",
+			wantBody: "price € 5",
+		},
+		{
+			name: "attachments only yields empty body",
+			data: "Subject: att\n" +
+				"Content-Type: multipart/mixed; boundary=b\n" +
+				"\n" +
+				"--b\n" +
+				"Content-Type: application/pdf\n" +
+				"Content-Disposition: attachment; filename=r.pdf\n" +
+				"Content-Transfer-Encoding: base64\n" +
+				"\n" +
+				"JVBERg==\n" +
+				"--b--\n",
+			wantBody: "",
+		},
+		{
+			name: "broken multipart framing falls back to raw body",
+			data: "Subject: broken\n" +
+				"Content-Type: multipart/mixed; boundary=b\n" +
+				"\n" +
+				"no boundary here\n",
+			wantBody: "no boundary here\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMailMessage(byteSection([]byte(tt.data)), defaultSubject)
+			if strings.TrimRight(got.body, "\n") != strings.TrimRight(tt.wantBody, "\n") {
+				t.Errorf("body: got %q, want %q", got.body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestParseMailMessageLatin1EncodedWordSubject(t *testing.T) {
+	got := parseMailMessage(byteSection([]byte("Subject: =?windows-1252?Q?=80_report?=\n\nbody")), "Message")
+	if got.subject != "€ report" {
+		t.Fatalf("subject: got %q", got.subject)
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		charset string
+		want    string
+	}{
+		{name: "utf-8 passthrough", in: []byte("olá"), charset: "UTF-8", want: "olá"},
+		{name: "empty charset", in: []byte("plain"), charset: "", want: "plain"},
+		{name: "iso-8859-1", in: []byte{'c', 'a', 'f', 0xe9}, charset: "ISO-8859-1", want: "café"},
+		{name: "unknown charset keeps valid utf-8", in: []byte("abc"), charset: "x-made-up", want: "abc"},
+		{name: "invalid utf-8 replaced", in: []byte{'a', 0xff, 'b'}, charset: "utf-8", want: "a�b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeCharset(tt.in, tt.charset); got != tt.want {
+				t.Fatalf("decodeCharset: got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMailMessageAttachments(t *testing.T) {
+	data := "Subject: backup\n" +
+		"Content-Type: multipart/mixed; boundary=b\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: multipart/alternative; boundary=a\n" +
+		"\n" +
+		"--a\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"see attached\n" +
+		"--a\n" +
+		"Content-Type: text/html\n" +
+		"\n" +
+		"<p>see attached</p>\n" +
+		"--a--\n" +
+		"--b\n" +
+		"Content-Type: text/csv\n" +
+		"Content-Disposition: attachment; filename=\"=?UTF-8?Q?relat=C3=B3rio.csv?=\"\n" +
+		"\n" +
+		"a,b\n" +
+		"--b\n" +
+		"Content-Type: image/png\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"iVBORw==\n" +
+		"--b\n" +
+		"Content-Type: application/octet-stream; name=\"C:\\\\logs\\\\run.log\"\n" +
+		"\n" +
+		"log\n" +
+		"--b--\n"
+
+	got := parseMailMessage(byteSection([]byte(data)), "Message")
+	if got.body != "see attached" {
+		t.Fatalf("body: got %q", got.body)
+	}
+	want := []struct {
+		filename, contentType, content string
+	}{
+		{"relatório.csv", "text/csv", "a,b"},
+		{"attachment-2.png", "image/png", "\x89PNG"},
+		{"run.log", "application/octet-stream", "log"},
+	}
+	if len(got.attachments) != len(want) {
+		t.Fatalf("attachments: got %d want %d: %+v", len(got.attachments), len(want), got.attachments)
+	}
+	for i, w := range want {
+		a := got.attachments[i]
+		content, err := io.ReadAll(a.content.open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.filename != w.filename || a.contentType != w.contentType || string(content) != w.content || a.content.size != int64(len(w.content)) {
+			t.Errorf("attachment %d: got %q %q %q (%d bytes), want %q %q %q", i, a.filename, a.contentType, content, a.content.size, w.filename, w.contentType, w.content)
+		}
+	}
+}
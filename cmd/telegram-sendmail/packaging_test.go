@@ -32,6 +32,7 @@ func TestPackagedSystemdUnits(t *testing.T) {
 		"EnvironmentFile=/etc/telegram-sendmail.env",
 		"Requires=telegram-sendmail.socket",
 		"After=network.target telegram-sendmail.socket",
+		"ExecStartPre=+/usr/bin/telegram-sendmail queue pickup",
 	} {
 		if !strings.Contains(service, want) {
 			t.Errorf("service missing %q", want)
@@ -60,6 +61,33 @@ func TestPackagedSystemdUnits(t *testing.T) {
 	}
 }
 
+func TestPackagedMaildrop(t *testing.T) {
+	root := repoRoot(t)
+	path := readRepoFile(t, filepath.Join(root, "packaging/systemd/telegram-sendmail.path"))
+	tmpfiles := readRepoFile(t, filepath.Join(root, "packaging/tmpfiles/telegram-sendmail.conf"))
+
+	for _, want := range []string{
+		"DirectoryNotEmpty=" + defaultMaildropDir + "/" + maildropNew,
+		"Unit=telegram-sendmail.service",
+		"WantedBy=paths.target",
+	} {
+		if !strings.Contains(path, want) {
+			t.Errorf("path unit missing %q", want)
+		}
+	}
+	// Sticky and not listable by others: users must not read or remove each
+	// other's spooled mail.
+	for _, want := range []string{
+		"d " + defaultMaildropDir + " 0755 root root",
+		"d " + defaultMaildropDir + "/" + maildropTmp + " 1733 root root",
+		"d " + defaultMaildropDir + "/" + maildropNew + " 1733 root root",
+	} {
+		if !strings.Contains(tmpfiles, want) {
+			t.Errorf("tmpfiles.d missing %q", want)
+		}
+	}
+}
+
 func TestSendmailShim(t *testing.T) {
 	root := repoRoot(t)
 	shim := readRepoFile(t, filepath.Join(root, "packaging/sendmail"))
@@ -90,7 +118,8 @@ func TestPostinstallScript(t *testing.T) {
 		"telegram-sendmail.env.example",
 		"chmod 0600",
 		"daemon-reload",
-		"enable telegram-sendmail.socket",
+		"enable telegram-sendmail.socket telegram-sendmail.path",
+		"systemd-tmpfiles --create telegram-sendmail.conf",
 	} {
 		if !strings.Contains(body, want) {
 			t.Errorf("postinstall missing %q", want)
@@ -113,6 +142,7 @@ func TestPreremoveScript(t *testing.T) {
 	body := readRepoFile(t, filepath.Join(root, "packaging/scripts/preremove.sh"))
 	for _, want := range []string{
 		"disable --now telegram-sendmail.socket",
+		"disable --now telegram-sendmail.path",
 		"daemon-reload",
 		// deb prerm "upgrade" / "failed-upgrade" and rpm %preun $1>0 must no-op.
 		"upgrade|failed-upgrade",
@@ -169,6 +199,8 @@ func TestGoreleaserNFPM(t *testing.T) {
 		"smtpdaemon",
 		"MTA",
 		"/usr/sbin/sendmail",
+		"packaging/systemd/telegram-sendmail.path",
+		"/usr/lib/tmpfiles.d/telegram-sendmail.conf",
 	} {
 		if want == "dependencies:" && strings.Contains(body, "\ndepends:") {
 			t.Errorf("goreleaser must use dependencies: (not depends:); nFPM key differs")
@@ -199,6 +231,10 @@ func TestNixOSModule(t *testing.T) {
 		`after = [ "network.target" "telegram-sendmail.socket" ]`,
 		`telegram-sendmail sendmail`,
 		`/run/telegram-sendmail/socket.sock`,
+		`maildropDir = "` + defaultMaildropDir + `"`,
+		`DirectoryNotEmpty = "${maildropDir}/new"`,
+		`"d ${maildropDir}/new 1733 root root -"`,
+		`ExecStartPre = "+${telegram-sendmail-pkg}/bin/telegram-sendmail queue pickup"`,
 	} {
 		if !strings.Contains(body, want) {
 			t.Errorf("nixos-module missing %q", want)
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ErrPeerCredUnsupported is returned for connections that carry no peer
+// credentials (TCP, or Unix sockets on platforms without SO_PEERCRED).
+var ErrPeerCredUnsupported = errors.New("peer credentials not supported")
+
+// sendmailClientCommands are /proc comm names of sendmail clients. When the
+// peer is one of them, the heading names its parent (cron, mailx, ...)
+// instead, since that is what actually produced the mail. comm is cut to 15
+// bytes by the kernel, hence the truncated name.
+var sendmailClientCommands = map[string]bool{
+	"telegram-sendma": true,
+	"sendmail":        true,
+}
+
+// peerCred identifies the local process on the other end of a submission
+// socket. uid/gid/pid come from the kernel (SO_PEERCRED) and cannot be
+// forged; the names are resolved best-effort when the message is received.
+type peerCred struct {
+	uid, gid, pid int
+	// user is the login name for uid, empty when it has none (DynamicUser).
+	user string
+	// command is /proc/<pid>/comm and parent the comm of its parent process.
+	command string
+	parent  string
+	// exe is the /proc/<pid>/exe target; usually only readable when serve
+	// runs as the same user or as root.
+	exe string
+}
+
+// resolvePeer fills the name fields of a kernel-reported credential. The
+// process may already be gone by the time this runs; missing values are
+// left empty.
+func resolvePeer(uid, gid, pid int) *peerCred {
+	p := &peerCred{uid: uid, gid: gid, pid: pid}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		p.user = u.Username
+	}
+	p.command = procComm(pid)
+	if ppid := procParentPID(pid); ppid > 0 {
+		p.parent = procComm(ppid)
+	}
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		p.exe = exe
+	}
+	return p
+}
+
+func procComm(pid int) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// procParentPID reads the ppid field of /proc/<pid>/stat. comm (field 2)
+// may contain spaces and parentheses, so parsing starts after the last ")".
+func procParentPID(pid int) int {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	idx := bytes.LastIndexByte(b, ')')
+	if idx < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(b[idx+1:]))
+	// fields[0] is state, fields[1] is ppid.
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+	return ppid
+}
+
+// userLabel is the login name, or "uid N" when the UID has no passwd entry.
+func (p *peerCred) userLabel() string {
+	if p.user != "" {
+		return p.user
+	}
+	return fmt.Sprintf("uid %d", p.uid)
+}
+
+// origin describes the submitter for Telegram headings, e.g. "cron as
+// backup". The sendmail client itself is skipped in favour of its parent.
+func (p *peerCred) origin() string {
+	command := p.command
+	if sendmailClientCommands[command] && p.parent != "" {
+		command = p.parent
+	}
+	if command == "" {
+		return p.userLabel()
+	}
+	return command + " as " + p.userLabel()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredentialsUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	p, err := peerCredentials(conn)
+	if err != nil {
+		t.Fatalf("peerCredentials: %v", err)
+	}
+	if p.uid != os.Getuid() || p.gid != os.Getgid() || p.pid != os.Getpid() {
+		t.Fatalf("peer=%+v want uid=%d gid=%d pid=%d", p, os.Getuid(), os.Getgid(), os.Getpid())
+	}
+}
+
+func TestPeerCredentialsTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := peerCredentials(conn); !errors.Is(err, ErrPeerCredUnsupported) {
+		t.Fatalf("expected ErrPeerCredUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials is only implemented on Linux (SO_PEERCRED).
+func peerCredentials(conn net.Conn) (*peerCred, error) {
+	return nil, fmt.Errorf("%T: %w", conn, ErrPeerCredUnsupported)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPeerCredOrigin(t *testing.T) {
+	tests := []struct {
+		name string
+		peer peerCred
+		want string
+	}{
+		{name: "command and user", peer: peerCred{uid: 34, user: "backup", command: "restic"}, want: "restic as backup"},
+		{name: "sendmail client shows parent", peer: peerCred{uid: 34, user: "backup", command: "telegram-sendma", parent: "cron"}, want: "cron as backup"},
+		{name: "sendmail shim shows parent", peer: peerCred{uid: 0, user: "root", command: "sendmail", parent: "smartd"}, want: "smartd as root"},
+		{name: "sendmail client without parent", peer: peerCred{uid: 0, user: "root", command: "sendmail"}, want: "sendmail as root"},
+		{name: "unknown user", peer: peerCred{uid: 61234, command: "job"}, want: "job as uid 61234"},
+		{name: "process gone", peer: peerCred{uid: 1000, user: "alice"}, want: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.peer.origin(); got != tt.want {
+				t.Fatalf("origin()=%q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePeerSelf(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	p := resolvePeer(os.Getuid(), os.Getgid(), os.Getpid())
+	if p.command == "" {
+		t.Fatalf("command not resolved: %+v", p)
+	}
+	if got := procParentPID(os.Getpid()); got != os.Getppid() {
+		t.Fatalf("procParentPID=%d want %d", got, os.Getppid())
+	}
+}
+
+func TestResolvePeerMissingProcess(t *testing.T) {
+	// PIDs are capped well below this on Linux, so the process cannot exist.
+	p := resolvePeer(os.Getuid(), os.Getgid(), 1<<30)
+	if p.command != "" || p.parent != "" || p.exe != "" {
+		t.Fatalf("expected empty process fields, got %+v", p)
+	}
+	if p.uid != os.Getuid() || p.pid != 1<<30 {
+		t.Fatalf("ids not kept: %+v", p)
+	}
+}
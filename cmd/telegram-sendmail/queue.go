@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	queueListJSON   bool
+	queuePurgeOlder time.Duration
+	queueDead       bool
+	queueRequeueAll bool
+)
+
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Inspect and manage the on-disk message queue",
+	Long: `Inspect and manage the messages waiting in the state directory
+(--state-dir / STATE_DIRECTORY). Run as the service user or root.`,
+}
+
+var queueListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List queued messages",
+	Args:  cobra.NoArgs,
+	RunE:  runQueueList,
+}
+
+var queueShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Print a queued message and its delivery history",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runQueueShow,
+}
+
+var queueDeleteCmd = &cobra.Command{
+	Use:   "delete <id>...",
+	Short: "Remove queued messages without delivering them",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runQueueDelete,
+}
+
+var queueRetryCmd = &cobra.Command{
+	Use:   "retry <id>...",
+	Short: "Retry failed messages on serve's next pass instead of after their backoff",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runQueueRetry,
+}
+
+var queuePurgeCmd = &cobra.Command{
+	Use:   "purge --older-than <duration>",
+	Short: "Remove queued messages older than a duration",
+	Args:  cobra.NoArgs,
+	RunE:  runQueuePurge,
+}
+
+var queueFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Attempt delivery of every queued message now",
+	Long: `Attempt delivery of every queued message now, in this process. Needs the
+same Telegram configuration as serve (e.g. source /etc/telegram-sendmail.env).
+Safe while serve is running: messages are locked while being delivered.`,
+	Args: cobra.NoArgs,
+	RunE: runQueueFlush,
+}
+
+var queuePickupCmd = &cobra.Command{
+	Use:   "pickup",
+	Short: "Queue the messages sendmail spooled while the socket was unavailable",
+	Long: `Move the messages sendmail spooled to --maildrop-dir into the queue. They
+belong to the users who sent them, so this runs as root: the packaged units
+run it before serve starts, and a .path unit starts serve when messages are
+spooled.`,
+	Args: cobra.NoArgs,
+	RunE: runQueuePickup,
+}
+
+var queueRequeueCmd = &cobra.Command{
+	Use:   "requeue <id>... | --all",
+	Short: "Move dead letters back into the queue for delivery",
+	RunE:  runQueueRequeue,
+}
+
+func init() {
+	queueListCmd.Flags().BoolVar(&queueListJSON, "json", false, "Print a JSON array instead of a table")
+	queuePurgeCmd.Flags().DurationVar(&queuePurgeOlder, "older-than", 0, "Remove messages enqueued longer ago than this (e.g. 72h)")
+	mustBind(queuePurgeCmd.MarkFlagRequired("older-than"))
+	for _, c := range []*cobra.Command{queueListCmd, queueShowCmd, queueDeleteCmd, queuePurgeCmd} {
+		c.Flags().BoolVar(&queueDead, "dead", false, "Act on the dead-letter directory instead of the queue")
+	}
+	queueRequeueCmd.Flags().BoolVar(&queueRequeueAll, "all", false, "Requeue every dead letter")
+	queueCmd.AddCommand(queueListCmd, queueShowCmd, queueDeleteCmd, queueRetryCmd, queuePurgeCmd, queueFlushCmd, queueRequeueCmd, queuePickupCmd)
+	rootCmd.AddCommand(queueCmd)
+}
+
+// queueDir is the directory queue subcommands act on: the queue itself, or
+// its dead-letter directory with --dead.
+func queueDir() string {
+	stateDir := viper.GetString("state_dir")
+	if queueDead {
+		return filepath.Join(stateDir, deadLetterDir)
+	}
+	return stateDir
+}
+
+// queueEntry describes one queued message for `queue list`.
+type queueEntry struct {
+	ID         string    `json:"id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Size       int64     `json:"size"`
+	Subject    string    `json:"subject"`
+	AgeSeconds int64     `json:"age_seconds"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	DeadReason string    `json:"dead_reason,omitempty"`
+}
+
+func runQueueList(cmd *cobra.Command, args []string) error {
+	entries, err := listQueue(queueDir(), time.Now())
+	if queueDead && errors.Is(err, fs.ErrNotExist) {
+		// Nothing was ever dead-lettered.
+		entries, err = []queueEntry{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if queueListJSON {
+		return writeQueueJSON(cmd.OutOrStdout(), entries)
+	}
+	if until, err := queuePausedUntil(viper.GetString("state_dir")); err == nil && !queueDead && time.Now().Before(until) {
+		fmt.Fprintf(cmd.OutOrStdout(), "Paused by Telegram flood control until %s\n", until.Local().Format(time.DateTime))
+	}
+	return writeQueueTable(cmd.OutOrStdout(), entries)
+}
+
+// listQueue reads every queued message in stateDir, oldest first. Files that
+// vanish mid-scan (delivered by serve) are skipped.
+func listQueue(stateDir string, now time.Time) ([]queueEntry, error) {
+	dirEntries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("read state directory: %w", err)
+	}
+	entries := []queueEntry{}
+	for _, de := range dirEntries {
+		if !isQueueEntry(de) {
+			continue
+		}
+		entry, err := readQueueEntry(filepath.Join(stateDir, de.Name()), now)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	// Names sort by enqueue time already; this keeps legacy files in line.
+	slices.SortStableFunc(entries, func(a, b queueEntry) int {
+		return a.EnqueuedAt.Compare(b.EnqueuedAt)
+	})
+	return entries, nil
+}
+
+func readQueueEntry(path string, now time.Time) (queueEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return queueEntry{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return queueEntry{}, err
+	}
+	entry := queueEntry{
+		ID:   filepath.Base(path),
+		Size: info.Size(),
+	}
+	env, payload, _, err := splitEnvelope(content)
+	if err != nil {
+		// Still list it: the operator needs to see what serve cannot read.
+		entry.Subject = fmt.Sprintf("(unreadable envelope: %v)", err)
+	} else {
+		entry.Subject = parseMailMessage(byteSection(payload), viper.GetString("default_subject")).subject
+	}
+	entry.EnqueuedAt = enqueueTime(entry.ID, env, info.ModTime())
+	entry.AgeSeconds = int64(now.Sub(entry.EnqueuedAt) / time.Second)
+	status, err := loadQueueStatus(filepath.Dir(path), entry.ID)
+	if err != nil {
+		entry.LastError = fmt.Sprintf("(unreadable status: %v)", err)
+		return entry, nil
+	}
+	entry.Attempts = status.Attempts
+	entry.LastError = status.LastError
+	entry.DeadReason = status.DeadReason
+	return entry, nil
+}
+
+// enqueueTime prefers the envelope's Received field, then the nanosecond
+// timestamp older builds used as the file name, then the file mtime.
+func enqueueTime(id string, env envelope, modTime time.Time) time.Time {
+	if !env.received.IsZero() {
+		return env.received
+	}
+	if ns, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return time.Unix(0, ns)
+	}
+	return modTime
+}
+
+func writeQueueJSON(w io.Writer, entries []queueEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func writeQueueTable(w io.Writer, entries []queueEntry) error {
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "Queue is empty")
+		return err
+	}
+	dead := slices.ContainsFunc(entries, func(e queueEntry) bool { return e.DeadReason != "" })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "ID\tENQUEUED\tSIZE\tAGE\tATTEMPTS\tSUBJECT"
+	if dead {
+		header += "\tREASON"
+	}
+	fmt.Fprintln(tw, header)
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s",
+			e.ID,
+			e.EnqueuedAt.Local().Format(time.DateTime),
+			e.Size,
+			time.Duration(e.AgeSeconds)*time.Second,
+			e.Attempts,
+			singleLine(e.Subject),
+		)
+		if dead {
+			fmt.Fprintf(tw, "\t%s", singleLine(e.DeadReason))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// singleLine keeps a subject from breaking the table layout.
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func runQueueShow(cmd *cobra.Command, args []string) error {
+	stateDir := queueDir()
+	path, err := queueFilePath(stateDir, args[0])
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	status, err := loadQueueStatus(stateDir, args[0])
+	if err != nil {
+		return err
+	}
+	return writeQueueMessage(cmd.OutOrStdout(), args[0], content, status)
+}
+
+// writeQueueMessage prints the envelope, delivery history and decoded
+// message the way serve would send it.
+func writeQueueMessage(w io.Writer, id string, content []byte, status queueStatus) error {
+	env, payload, _, err := splitEnvelope(content)
+	if err != nil {
+		return fmt.Errorf("read envelope of %s: %w", id, err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", id)
+	if !env.received.IsZero() {
+		fmt.Fprintf(tw, "Received:\t%s\n", env.received.Local().Format(time.DateTime))
+	}
+	if env.sender != "" {
+		fmt.Fprintf(tw, "Sender:\t%s\n", env.sender)
+	}
+	if env.senderName != "" {
+		fmt.Fprintf(tw, "Sender name:\t%s\n", env.senderName)
+	}
+	if len(env.recipients) > 0 {
+		fmt.Fprintf(tw, "Recipients:\t%s\n", strings.Join(env.recipients, ", "))
+	}
+	if p := env.peer; p != nil {
+		fmt.Fprintf(tw, "Submitted by:\t%s (uid %d, gid %d, pid %d)\n", p.origin(), p.uid, p.gid, p.pid)
+	}
+	if env.authUser != "" {
+		fmt.Fprintf(tw, "SMTP user:\t%s\n", env.authUser)
+	}
+	if env.chat != "" {
+		fmt.Fprintf(tw, "Chat:\t%s\n", env.chat)
+	}
+	if status.DeadReason != "" {
+		fmt.Fprintf(tw, "Dead since:\t%s\n", status.DeadAt.Local().Format(time.DateTime))
+		fmt.Fprintf(tw, "Reason:\t%s\n", singleLine(status.DeadReason))
+	}
+	fmt.Fprintf(tw, "Attempts:\t%d\n", status.Attempts)
+	if status.DeadReason == "" && !status.NextAttempt.IsZero() {
+		fmt.Fprintf(tw, "Next attempt:\t%s\n", status.NextAttempt.Local().Format(time.DateTime))
+	}
+	for _, a := range status.RecentHistory {
+		fmt.Fprintf(tw, "\t%s  %s\n", a.At.Local().Format(time.DateTime), singleLine(a.Error))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	parsed := parseMailMessage(byteSection(payload), viper.GetString("default_subject"))
+	fmt.Fprintf(w, "\nSubject: %s\n\n", parsed.subject)
+	fmt.Fprintln(w, strings.TrimRight(plainBody(parsed), "\n"))
+	for _, a := range parsed.attachments {
+		fmt.Fprintf(w, "\n[attachment %s, %s, %d bytes]", a.filename, a.contentType, a.content.size)
+	}
+	if len(parsed.attachments) > 0 {
+		_, err = fmt.Fprintln(w)
+	}
+	return err
+}
+
+func runQueueDelete(cmd *cobra.Command, args []string) error {
+	stateDir := queueDir()
+	var errs []error
+	for _, id := range args {
+		if err := deleteQueued(stateDir, id); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Deleted %s\n", id)
+	}
+	return errors.Join(errs...)
+}
+
+// deleteQueued removes a message under its lock so serve cannot be sending
+// it at the same time.
+func deleteQueued(stateDir, id string) error {
+	path, err := queueFilePath(stateDir, id)
+	if err != nil {
+		return err
+	}
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		return err
+	}
+	removeErr := removeQueueFile(stateDir, id)
+	return errors.Join(removeErr, lock.Close())
+}
+
+func runQueueRetry(cmd *cobra.Command, args []string) error {
+	stateDir := viper.GetString("state_dir")
+	var errs []error
+	for _, id := range args {
+		if err := retryQueued(stateDir, id); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Retrying %s on the next pass\n", id)
+	}
+	return errors.Join(errs...)
+}
+
+// retryQueued clears a message's next_attempt under its lock, so serve
+// cannot be recording a failed attempt at the same time. The attempt count
+// and history are kept.
+func retryQueued(stateDir, id string) error {
+	path, err := queueFilePath(stateDir, id)
+	if err != nil {
+		return err
+	}
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		return err
+	}
+	status, err := loadQueueStatus(stateDir, id)
+	if err == nil && !status.NextAttempt.IsZero() {
+		status.NextAttempt = time.Time{}
+		err = saveQueueStatus(stateDir, id, status)
+	}
+	return errors.Join(err, lock.Close())
+}
+
+func runQueuePurge(cmd *cobra.Command, args []string) error {
+	if queuePurgeOlder <= 0 {
+		return fmt.Errorf("--older-than must be positive, got %s", queuePurgeOlder)
+	}
+	removed, busy, err := purgeQueue(queueDir(), queuePurgeOlder, time.Now())
+	fmt.Fprintf(cmd.OutOrStdout(), "Removed %d message(s)\n", removed)
+	if busy > 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "Skipped %d message(s) being delivered\n", busy)
+	}
+	return err
+}
+
+// purgeQueue deletes messages enqueued more than olderThan before now.
+// Messages locked by serve are skipped and counted in busy.
+func purgeQueue(stateDir string, olderThan time.Duration, now time.Time) (removed, busy int, err error) {
+	entries, err := listQueue(stateDir, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	var errs []error
+	for _, e := range entries {
+		if now.Sub(e.EnqueuedAt) <= olderThan {
+			continue
+		}
+		err := deleteQueued(stateDir, e.ID)
+		switch {
+		case err == nil:
+			removed++
+		case errors.Is(err, ErrQueueFileBusy):
+			busy++
+		case errors.Is(err, fs.ErrNotExist):
+			// Delivered since listing.
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", e.ID, err))
+		}
+	}
+	return removed, busy, errors.Join(errs...)
+}
+
+func runQueueFlush(cmd *cobra.Command, args []string) error {
+	client, router, err := deliveryConfig()
+	if err != nil {
+		return err
+	}
+	_, sent, failed := processQueue(client, viper.GetString("state_dir"), router, true)
+	fmt.Fprintf(cmd.OutOrStdout(), "Sent %d message(s), %d failed\n", sent, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d message(s) could not be delivered; see queue show", failed)
+	}
+	return nil
+}
+
+func runQueueRequeue(cmd *cobra.Command, args []string) error {
+	stateDir := viper.GetString("state_dir")
+	ids := args
+	switch {
+	case queueRequeueAll && len(args) > 0:
+		return errors.New("pass either message IDs or --all, not both")
+	case queueRequeueAll:
+		entries, err := listQueue(filepath.Join(stateDir, deadLetterDir), time.Now())
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing was ever dead-lettered.
+			entries, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		ids = nil
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+	case len(args) == 0:
+		return errors.New("pass message IDs (see queue list --dead) or --all")
+	}
+
+	var errs []error
+	for _, id := range ids {
+		if err := requeueDeadLetter(stateDir, id); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Requeued %s\n", id)
+	}
+	return errors.Join(errs...)
+}
+
+func runQueuePickup(cmd *cobra.Command, args []string) error {
+	dir := viper.GetString("maildrop_dir")
+	if dir == "" {
+		return ErrNoMaildrop
+	}
+	n, err := pickupMaildrop(dir, viper.GetString("state_dir"), viper.GetInt64("max_payload_size"))
+	if errors.Is(err, fs.ErrNotExist) {
+		// No maildrop on this host: nothing was ever spooled.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Queued %d spooled message(s)\n", n)
+	return nil
+}
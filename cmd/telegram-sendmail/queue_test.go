@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListQueue(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	received := now.Add(-90 * time.Second)
+	legacy := now.Add(-time.Hour)
+
+	env := envelope{recipients: []string{"root"}, received: received}
+	files := map[string][]byte{
+		"2000": env.encode([]byte("Subject: =?UTF-8?Q?Disk_=C3=A9?=\n\nbody")),
+		// Legacy file: no envelope, the name is the enqueue time.
+		strconv.FormatInt(legacy.UnixNano(), 10): []byte("Subject: old\n\nbody"),
+		rateLimitStateFile:                       []byte("{}"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := listQueue(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries=%+v, want 2", entries)
+	}
+	if entries[0].Subject != "old" || !entries[0].EnqueuedAt.Equal(legacy) || entries[0].AgeSeconds != 3600 {
+		t.Fatalf("legacy entry=%+v", entries[0])
+	}
+	if entries[1].ID != "2000" || entries[1].Subject != "Disk é" || !entries[1].EnqueuedAt.Equal(received) || entries[1].AgeSeconds != 90 {
+		t.Fatalf("envelope entry=%+v", entries[1])
+	}
+	if entries[1].Size != int64(len(files["2000"])) {
+		t.Fatalf("size=%d want %d", entries[1].Size, len(files["2000"]))
+	}
+}
+
+func TestListQueueUnreadableEnvelope(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1"), []byte("telegram-sendmail-envelope/99\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := listQueue(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].Subject, "unreadable envelope") {
+		t.Fatalf("entries=%+v", entries)
+	}
+}
+
+func TestWriteQueueOutput(t *testing.T) {
+	entries := []queueEntry{{
+		ID:         "1767268800000000000",
+		EnqueuedAt: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		Size:       42,
+		Subject:    "multi\nline",
+		AgeSeconds: 125,
+	}}
+
+	var table bytes.Buffer
+	if err := writeQueueTable(&table, entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ID", "SUBJECT", "1767268800000000000", "42", "2m5s", "multi line"} {
+		if !strings.Contains(table.String(), want) {
+			t.Fatalf("table missing %q:\n%s", want, table.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writeQueueJSON(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]any
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out.String(), err)
+	}
+	if decoded[0]["id"] != "1767268800000000000" || decoded[0]["age_seconds"] != float64(125) || decoded[0]["enqueued_at"] != "2026-01-01T12:00:00Z" {
+		t.Fatalf("decoded=%v", decoded)
+	}
+
+	var empty bytes.Buffer
+	if err := writeQueueJSON(&empty, []queueEntry{}); err != nil || strings.TrimSpace(empty.String()) != "[]" {
+		t.Fatalf("empty JSON=%q err=%v", empty.String(), err)
+	}
+}
+
+func TestWriteQueueMessage(t *testing.T) {
+	env := envelope{
+		recipients: []string{"root"},
+		sender:     "cron",
+		received:   time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		peer:       &peerCred{uid: 34, gid: 34, pid: 99, user: "backup", command: "sendmail", parent: "cron"},
+	}
+	content := env.encode([]byte("Subject: nightly\nContent-Type: text/html\n\n<p>done &amp; dusted</p>"))
+	status := queueStatus{Attempts: 2, RecentHistory: []deliveryAttempt{{At: env.received, Error: "status 500:\nboom"}}}
+
+	var out bytes.Buffer
+	if err := writeQueueMessage(&out, "1", content, status); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ID:", "Sender:", "cron", "Recipients:", "root", "cron as backup (uid 34, gid 34, pid 99)", "Attempts:", "status 500: boom", "Subject: nightly", "done & dusted"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDeleteQueued(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1")
+	if err := os.WriteFile(path, []byte("Subject: x\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteQueued(dir, "1"); !errors.Is(err, ErrQueueFileBusy) {
+		t.Fatalf("delete while locked: got %v, want ErrQueueFileBusy", err)
+	}
+	if err := lock.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteQueued(dir, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("file still present: %v", err)
+	}
+	if err := deleteQueued(dir, "1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("delete missing: got %v", err)
+	}
+	if err := deleteQueued(dir, "../1"); !errors.Is(err, ErrInvalidQueueID) {
+		t.Fatalf("delete traversal: got %v", err)
+	}
+}
+
+func TestRetryQueued(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1")
+	if err := os.WriteFile(path, []byte("Subject: x\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := recordFailedAttempt(dir, "1", now, errors.New("502 Bad Gateway")); err != nil {
+		t.Fatal(err)
+	}
+	if retryDue(dir, "1", now) {
+		t.Fatal("failed message due before its backoff")
+	}
+
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retryQueued(dir, "1"); !errors.Is(err, ErrQueueFileBusy) {
+		t.Fatalf("retry while locked: got %v, want ErrQueueFileBusy", err)
+	}
+	if err := lock.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := retryQueued(dir, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if !retryDue(dir, "1", now) {
+		t.Fatal("retried message still waiting for its backoff")
+	}
+	if status, err := loadQueueStatus(dir, "1"); err != nil || status.Attempts != 1 || len(status.RecentHistory) != 1 {
+		t.Fatalf("status=%+v err=%v, want the history kept", status, err)
+	}
+	if err := retryQueued(dir, "2"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("retry missing: got %v", err)
+	}
+	if err := retryQueued(dir, "../1"); !errors.Is(err, ErrInvalidQueueID) {
+		t.Fatalf("retry traversal: got %v", err)
+	}
+}
+
+func TestPurgeQueue(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ages := map[string]time.Duration{"old": 3 * time.Hour, "busy": 4 * time.Hour, "new": time.Minute}
+	for id, age := range ages {
+		env := envelope{received: now.Add(-age)}
+		if err := os.WriteFile(filepath.Join(dir, id), env.encode([]byte("Subject: s\n\nb")), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lock, err := lockQueueFile(filepath.Join(dir, "busy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	removed, busy, err := purgeQueue(dir, 2*time.Hour, now)
+	if err != nil || removed != 1 || busy != 1 {
+		t.Fatalf("purgeQueue removed=%d busy=%d err=%v", removed, busy, err)
+	}
+	entries, err := listQueue(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	if strings.Join(ids, ",") != "busy,new" {
+		t.Fatalf("remaining=%v", ids)
+	}
+}
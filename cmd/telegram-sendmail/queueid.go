@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// queueIDAlphabet is Crockford's base32, as used by ULIDs.
+const queueIDAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// queueIDs keeps the last ID handed out, so IDs from one process are
+// strictly increasing even within a millisecond or when the clock steps back.
+var queueIDs struct {
+	sync.Mutex
+	ms   uint64
+	rand [10]byte
+}
+
+// newQueueID returns a ULID (https://github.com/ulid/spec) for a message
+// received at t: 48 bits of Unix milliseconds and 80 random bits, as 26
+// characters that sort by receive time. Two processes would need the same
+// millisecond and the same 80 random bits to collide.
+//
+// Queue files from older builds are named after their UnixNano receive
+// time; those digits sort after every ULID, so they are sent last.
+func newQueueID(t time.Time) string {
+	queueIDs.Lock()
+	defer queueIDs.Unlock()
+
+	ms := uint64(t.UnixMilli())
+	switch {
+	case ms > queueIDs.ms:
+		randomizeQueueID()
+	case incrementQueueIDRand():
+		ms = queueIDs.ms
+	default:
+		ms = queueIDs.ms + 1
+		randomizeQueueID()
+	}
+	queueIDs.ms = ms
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	copy(id[6:], queueIDs.rand[:])
+	return encodeQueueID(id)
+}
+
+func randomizeQueueID() {
+	binary.BigEndian.PutUint64(queueIDs.rand[:8], rand.Uint64())
+	binary.BigEndian.PutUint16(queueIDs.rand[8:], uint16(rand.Uint32()))
+}
+
+// incrementQueueIDRand adds one to the random part of the last ID. It
+// reports false when that overflowed.
+func incrementQueueIDRand() bool {
+	for i := len(queueIDs.rand) - 1; i >= 0; i-- {
+		queueIDs.rand[i]++
+		if queueIDs.rand[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeQueueID writes the 128 bits of id as 26 base32 characters, most
+// significant first; the first character carries the top 3 bits.
+func encodeQueueID(id [16]byte) string {
+	var out [26]byte
+	var acc uint16
+	var bits uint
+	i := len(out) - 1
+	for j := len(id) - 1; j >= 0; j-- {
+		acc |= uint16(id[j]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[i] = queueIDAlphabet[acc&31]
+			acc >>= 5
+			bits -= 5
+			i--
+		}
+	}
+	out[0] = queueIDAlphabet[acc&31]
+	return string(out[:])
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeQueueID(t *testing.T) {
+	var id [16]byte
+	if got := encodeQueueID(id); got != strings.Repeat("0", 26) {
+		t.Fatalf("zero=%q", got)
+	}
+	for i := range id {
+		id[i] = 0xff
+	}
+	if got := encodeQueueID(id); got != "7"+strings.Repeat("Z", 25) {
+		t.Fatalf("max=%q", got)
+	}
+}
+
+func TestNewQueueIDSortsByTime(t *testing.T) {
+	// The ULID spec's example timestamp, long before any ID other tests made.
+	queueIDs.Lock()
+	queueIDs.ms = 0
+	queueIDs.Unlock()
+	at := time.UnixMilli(1469918176385)
+	first := newQueueID(at)
+	if len(first) != 26 || !strings.HasPrefix(first, "01ARYZ6S41") {
+		t.Fatalf("id=%q", first)
+	}
+
+	// Same millisecond, a clock stepping back, then later: still increasing.
+	prev := first
+	for i, ts := range []time.Time{at, at, at.Add(-time.Hour), at.Add(time.Second)} {
+		id := newQueueID(ts)
+		if id <= prev {
+			t.Fatalf("id %d %q does not sort after %q", i, id, prev)
+		}
+		prev = id
+	}
+	if prev[:10] <= first[:10] {
+		t.Fatalf("a second later the time part should move on, got %q after %q", prev, first)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitStateFile holds per-UID submission history. serve exits when
+	// idle, so limits must survive restarts. Dotfiles are never queue items.
+	rateLimitStateFile = ".ratelimit.json"
+	// rateLimitMessageWindow and rateLimitByteWindow are the sliding windows
+	// for the messages and bytes limits.
+	rateLimitMessageWindow = time.Minute
+	rateLimitByteWindow    = time.Hour
+	// unknownPeerKey buckets submissions without peer credentials (TCP,
+	// non-Linux) together so they cannot bypass the limits.
+	unknownPeerKey = "unknown"
+)
+
+// submissionLimits bound what local accounts can enqueue. Zero disables a
+// limit.
+type submissionLimits struct {
+	// messagesPerMinute and bytesPerHour apply per submitting UID.
+	messagesPerMinute int
+	bytesPerHour      int64
+	// maxQueueFiles and maxQueueBytes cap the whole queue directory.
+	maxQueueFiles int
+	maxQueueBytes int64
+}
+
+// rateLimited reports whether any per-UID limit is enabled.
+func (l submissionLimits) rateLimited() bool {
+	return l.messagesPerMinute > 0 || l.bytesPerHour > 0
+}
+
+// rateLimitEvent is one accepted submission.
+type rateLimitEvent struct {
+	At    time.Time `json:"at"`
+	Bytes int64     `json:"bytes"`
+}
+
+// rateLimitMu serialises read-modify-write cycles of rateLimitStateFile.
+var rateLimitMu sync.Mutex
+
+// peerKey is the rate limit bucket for a submission.
+func peerKey(peer *peerCred) string {
+	if peer == nil {
+		return unknownPeerKey
+	}
+	return strconv.Itoa(peer.uid)
+}
+
+// submitterKey is peerKey, except that SMTP accounts get buckets of their own
+// (prefixed so a user name never collides with a UID).
+func submitterKey(peer *peerCred, authUser string) string {
+	if authUser != "" {
+		return "smtp:" + authUser
+	}
+	return peerKey(peer)
+}
+
+// allowSubmission checks key against the per-UID limits and, when allowed,
+// records the submission. A missing or corrupt state file starts empty: the
+// limits protect the disk, they must not block mail on their own failure.
+func allowSubmission(stateDir, key string, size int64, limits submissionLimits, now time.Time) (bool, error) {
+	if !limits.rateLimited() {
+		return true, nil
+	}
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	path := filepath.Join(stateDir, rateLimitStateFile)
+	state, loadErr := loadRateLimitState(path)
+	pruneRateLimitState(state, now)
+
+	var messages int
+	var sent int64
+	for _, ev := range state[key] {
+		if now.Sub(ev.At) < rateLimitMessageWindow {
+			messages++
+		}
+		sent += ev.Bytes
+	}
+	if limits.messagesPerMinute > 0 && messages+1 > limits.messagesPerMinute {
+		return false, loadErr
+	}
+	if limits.bytesPerHour > 0 && sent+size > limits.bytesPerHour {
+		return false, loadErr
+	}
+
+	state[key] = append(state[key], rateLimitEvent{At: now, Bytes: size})
+	if err := saveRateLimitState(stateDir, state); err != nil {
+		return true, errors.Join(loadErr, err)
+	}
+	return true, loadErr
+}
+
+func loadRateLimitState(path string) (map[string][]rateLimitEvent, error) {
+	state := map[string][]rateLimitEvent{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read rate limit state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return map[string][]rateLimitEvent{}, fmt.Errorf("parse rate limit state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// pruneRateLimitState drops events outside the longest window so the file
+// stays small.
+func pruneRateLimitState(state map[string][]rateLimitEvent, now time.Time) {
+	for key, events := range state {
+		kept := events[:0]
+		for _, ev := range events {
+			if now.Sub(ev.At) < rateLimitByteWindow {
+				kept = append(kept, ev)
+			}
+		}
+		if len(kept) == 0 {
+			delete(state, key)
+		} else {
+			state[key] = kept
+		}
+	}
+}
+
+// saveRateLimitState replaces the state file in stateDir.
+func saveRateLimitState(stateDir string, state map[string][]rateLimitEvent) error {
+	if err := writeStateFile(stateDir, rateLimitStateFile, state); err != nil {
+		return fmt.Errorf("write rate limit state: %w", err)
+	}
+	return nil
+}
+
+// isQueueEntry reports whether a state_dir entry is a queued message. Serve's
+// own bookkeeping files start with a dot.
+func isQueueEntry(entry fs.DirEntry) bool {
+	return !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".")
+}
+
+// queueUsage returns the number and total size of queued messages.
+func queueUsage(stateDir string) (files int, used int64, err error) {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		if !isQueueEntry(entry) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Delivered and removed while we were scanning.
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		files++
+		used += info.Size()
+	}
+	return files, used, nil
+}
+
+// queueHasRoom reports whether a message of size bytes fits under the queue
+// caps.
+func queueHasRoom(stateDir string, size int64, limits submissionLimits) (bool, error) {
+	if limits.maxQueueFiles <= 0 && limits.maxQueueBytes <= 0 {
+		return true, nil
+	}
+	files, used, err := queueUsage(stateDir)
+	if err != nil {
+		return false, err
+	}
+	if limits.maxQueueFiles > 0 && files+1 > limits.maxQueueFiles {
+		return false, nil
+	}
+	if limits.maxQueueBytes > 0 && used+size > limits.maxQueueBytes {
+		return false, nil
+	}
+	return true, nil
+}
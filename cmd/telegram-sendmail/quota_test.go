@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllowSubmissionMessagesPerMinute(t *testing.T) {
+	dir := t.TempDir()
+	limits := submissionLimits{messagesPerMinute: 2}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, want := range []bool{true, true, false} {
+		ok, err := allowSubmission(dir, "1000", 10, limits, now)
+		if err != nil || ok != want {
+			t.Fatalf("submission %d: ok=%v err=%v want %v", i, ok, err, want)
+		}
+	}
+	// Other UIDs have their own budget.
+	if ok, err := allowSubmission(dir, "0", 10, limits, now); err != nil || !ok {
+		t.Fatalf("other uid: ok=%v err=%v", ok, err)
+	}
+	// The window slides.
+	if ok, err := allowSubmission(dir, "1000", 10, limits, now.Add(rateLimitMessageWindow)); err != nil || !ok {
+		t.Fatalf("after window: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestAllowSubmissionBytesPerHour(t *testing.T) {
+	dir := t.TempDir()
+	limits := submissionLimits{bytesPerHour: 100}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if ok, _ := allowSubmission(dir, "1000", 60, limits, now); !ok {
+		t.Fatal("first 60 bytes rejected")
+	}
+	if ok, _ := allowSubmission(dir, "1000", 60, limits, now.Add(30*time.Minute)); ok {
+		t.Fatal("120 bytes within an hour allowed")
+	}
+	if ok, _ := allowSubmission(dir, "1000", 60, limits, now.Add(rateLimitByteWindow)); !ok {
+		t.Fatal("bytes not released after the window")
+	}
+}
+
+func TestAllowSubmissionCorruptStateStartsOver(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, rateLimitStateFile)
+	if err := os.WriteFile(path, []byte("not json"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := allowSubmission(dir, "1000", 1, submissionLimits{messagesPerMinute: 1}, time.Now())
+	if !ok || err == nil {
+		t.Fatalf("corrupt state: ok=%v err=%v, want allowed with error", ok, err)
+	}
+	if _, err := loadRateLimitState(path); err != nil {
+		t.Fatalf("state not rewritten: %v", err)
+	}
+}
+
+func TestAllowSubmissionDisabled(t *testing.T) {
+	dir := t.TempDir()
+	if ok, err := allowSubmission(dir, "1000", 1<<40, submissionLimits{}, time.Now()); !ok || err != nil {
+		t.Fatalf("disabled limits: ok=%v err=%v", ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, rateLimitStateFile)); !os.IsNotExist(err) {
+		t.Fatalf("state file written with limits disabled: %v", err)
+	}
+}
+
+func TestQueueHasRoom(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"1": "12345", "2": "12345", rateLimitStateFile: "ignored bookkeeping"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), stateDirPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	files, used, err := queueUsage(dir)
+	if err != nil || files != 2 || used != 10 {
+		t.Fatalf("queueUsage=%d,%d,%v want 2,10", files, used, err)
+	}
+	tests := []struct {
+		name   string
+		limits submissionLimits
+		size   int64
+		want   bool
+	}{
+		{name: "unlimited", limits: submissionLimits{}, size: 1 << 30, want: true},
+		{name: "files fit", limits: submissionLimits{maxQueueFiles: 3}, size: 1, want: true},
+		{name: "files full", limits: submissionLimits{maxQueueFiles: 2}, size: 1, want: false},
+		{name: "bytes fit", limits: submissionLimits{maxQueueBytes: 15}, size: 5, want: true},
+		{name: "bytes full", limits: submissionLimits{maxQueueBytes: 15}, size: 6, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queueHasRoom(dir, tt.size, tt.limits)
+			if err != nil || got != tt.want {
+				t.Fatalf("queueHasRoom=%v,%v want %v", got, err, tt.want)
+			}
+		})
+	}
+}
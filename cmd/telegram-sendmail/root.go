@@ -15,6 +15,18 @@ const (
 	defaultMaxPayloadSize = 20 * 1024 * 1024
 	// defaultSocketTimeoutSeconds is the per-connection read/write deadline.
 	defaultSocketTimeoutSeconds = 10.0
+	// defaultMaxAttachmentSize caps each forwarded attachment; it matches the
+	// Bot API multipart upload limit (telegram.MaxUploadSize).
+	defaultMaxAttachmentSize = 50 * 1024 * 1024
+	// defaultMaxQueueFiles and defaultMaxQueueBytes keep a runaway submitter
+	// from filling the disk while Telegram is unreachable.
+	defaultMaxQueueFiles = 10000
+	defaultMaxQueueBytes = 1024 * 1024 * 1024
+	// defaultTelegramChatRate (per minute) and defaultTelegramGlobalRate (per
+	// second) follow Telegram's documented bot limits for groups and for
+	// the whole bot.
+	defaultTelegramChatRate   = 20
+	defaultTelegramGlobalRate = 30
 )
 
 var rootCmd = &cobra.Command{
@@ -31,7 +43,10 @@ func Execute() {
 
 	if err := rootCmd.Execute(); err != nil {
 		utils.ReportError(err, "Execution failed")
-		os.Exit(1)
+		// os.Exit skips the deferred flush.
+		utils.FlushSentry()
+		// The sendmail subcommand exits with sysexits codes; everything else 1.
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -53,21 +68,53 @@ func init() {
 	// onto this key as-is. The relative default is only for non-systemd runs.
 	pFlags.StringP("state-dir", "d", "", "Queue directory (default: $STATE_DIRECTORY when set, else ./telegram_sendmail_state)")
 	pFlags.StringP("telegram-token", "t", "", "Telegram Bot Token")
-	pFlags.StringP("telegram-chat", "c", "", "Telegram Chat ID")
+	pFlags.StringP("telegram-chat", "c", "", "Telegram Chat ID (chat_id, or chat_id:thread_id for a forum topic)")
+	pFlags.StringSlice("route", nil, "Route recipients to a chat as pattern=chat (repeatable), e.g. root@=-100123 or *@db*=-100456; unmatched recipients use --telegram-chat")
 	pFlags.StringP("hostname", "n", "", "Hostname to identify the sender")
 	pFlags.StringP("subject", "s", "Message", "Default subject")
 	pFlags.Int("max-payload-size", defaultMaxPayloadSize, "Maximum allowed payload size in bytes")
 	pFlags.Float64("socket-timeout", defaultSocketTimeoutSeconds, "Per-connection read/write deadline (seconds)")
+	pFlags.Int64("max-attachment-size", defaultMaxAttachmentSize, "Maximum size in bytes of each attachment forwarded to Telegram")
+	pFlags.Int("rate-limit-messages", 0, "Maximum messages each local user may submit per minute (0 = unlimited)")
+	pFlags.Int64("rate-limit-bytes", 0, "Maximum payload bytes each local user may submit per hour (0 = unlimited)")
+	pFlags.Int("max-queue-files", defaultMaxQueueFiles, "Reject new messages once this many are queued (0 = unlimited)")
+	pFlags.Int64("max-queue-bytes", defaultMaxQueueBytes, "Reject new messages once the queue holds this many bytes (0 = unlimited)")
+	pFlags.Int("max-attempts", 0, "Move a message to the dead-letter directory after this many failed deliveries (0 = retry forever)")
+	pFlags.Duration("max-age", 0, "Move a message to the dead-letter directory once it has been queued this long, e.g. 72h (0 = no limit)")
+	pFlags.Int("telegram-chat-rate", defaultTelegramChatRate, "Maximum Telegram requests per minute to each chat (0 = unlimited)")
+	pFlags.Int("telegram-global-rate", defaultTelegramGlobalRate, "Maximum Telegram requests per second across all chats (0 = unlimited)")
+	pFlags.Duration("digest-window", 0, "Hold new messages this long and send bursts with the same subject (or sender) as one digest, e.g. 5m (0 = off)")
+	pFlags.String("digest-by", digestBySubject, "Group digests by subject or sender")
+	pFlags.Duration("dedup-window", 0, "Suppress messages identical to one sent this recently and report the repeat count when the window ends, e.g. 1h (0 = off)")
+	pFlags.StringArray("dedup-ignore", defaultDedupIgnore, "Regular expressions removed from subject and body before comparing messages for --dedup-window")
+	pFlags.String("maildrop-dir", defaultMaildropDir, "Spool directory sendmail writes to when the socket is unavailable, picked up by serve (empty = no fallback)")
+	pFlags.Bool("show-sender", false, "Show the submitting process and user in the Telegram heading, e.g. #host (cron as backup)")
 	pFlags.String("sentry-dsn", "", "Sentry DSN")
 
 	// Bind flags to viper
 	mustBind(viper.BindPFlag("state_dir", pFlags.Lookup("state-dir")))
 	mustBind(viper.BindPFlag("telegram_token", pFlags.Lookup("telegram-token")))
 	mustBind(viper.BindPFlag("telegram_chat", pFlags.Lookup("telegram-chat")))
+	mustBind(viper.BindPFlag("telegram_routes", pFlags.Lookup("route")))
 	mustBind(viper.BindPFlag("hostname", pFlags.Lookup("hostname")))
 	mustBind(viper.BindPFlag("default_subject", pFlags.Lookup("subject")))
 	mustBind(viper.BindPFlag("max_payload_size", pFlags.Lookup("max-payload-size")))
 	mustBind(viper.BindPFlag("socket_timeout", pFlags.Lookup("socket-timeout")))
+	mustBind(viper.BindPFlag("max_attachment_size", pFlags.Lookup("max-attachment-size")))
+	mustBind(viper.BindPFlag("rate_limit_messages", pFlags.Lookup("rate-limit-messages")))
+	mustBind(viper.BindPFlag("rate_limit_bytes", pFlags.Lookup("rate-limit-bytes")))
+	mustBind(viper.BindPFlag("max_queue_files", pFlags.Lookup("max-queue-files")))
+	mustBind(viper.BindPFlag("max_queue_bytes", pFlags.Lookup("max-queue-bytes")))
+	mustBind(viper.BindPFlag("max_attempts", pFlags.Lookup("max-attempts")))
+	mustBind(viper.BindPFlag("max_age", pFlags.Lookup("max-age")))
+	mustBind(viper.BindPFlag("telegram_chat_rate", pFlags.Lookup("telegram-chat-rate")))
+	mustBind(viper.BindPFlag("telegram_global_rate", pFlags.Lookup("telegram-global-rate")))
+	mustBind(viper.BindPFlag("digest_window", pFlags.Lookup("digest-window")))
+	mustBind(viper.BindPFlag("digest_by", pFlags.Lookup("digest-by")))
+	mustBind(viper.BindPFlag("dedup_window", pFlags.Lookup("dedup-window")))
+	mustBind(viper.BindPFlag("dedup_ignore", pFlags.Lookup("dedup-ignore")))
+	mustBind(viper.BindPFlag("maildrop_dir", pFlags.Lookup("maildrop-dir")))
+	mustBind(viper.BindPFlag("show_sender", pFlags.Lookup("show-sender")))
 	mustBind(viper.BindPFlag("sentry_dsn", pFlags.Lookup("sentry-dsn")))
 }
 
@@ -76,15 +123,44 @@ func initConfig() {
 	// Flags alone are not enough: packaged/Nix systemd units only load
 	// EnvironmentFile, so every operational knob needs a BindEnv.
 	// MAIL_TELEGRAM_TOKEN, MAIL_TELEGRAM_CHAT, STATE_DIRECTORY, HOSTNAME,
-	// MAIL_SENTRY_DSN, MAIL_DEFAULT_SUBJECT, MAIL_MAX_PAYLOAD_SIZE, MAIL_SOCKET_TIMEOUT
+	// MAIL_SENTRY_DSN, MAIL_DEFAULT_SUBJECT, MAIL_MAX_PAYLOAD_SIZE, MAIL_SOCKET_TIMEOUT,
+	// MAIL_MAX_ATTACHMENT_SIZE, MAIL_TELEGRAM_ROUTES, MAIL_SHOW_SENDER,
+	// MAIL_RATE_LIMIT_MESSAGES, MAIL_RATE_LIMIT_BYTES, MAIL_MAX_QUEUE_FILES,
+	// MAIL_MAX_QUEUE_BYTES, MAIL_MAX_ATTEMPTS, MAIL_MAX_AGE,
+	// MAIL_TELEGRAM_CHAT_RATE, MAIL_TELEGRAM_GLOBAL_RATE, MAIL_DIGEST_WINDOW,
+	// MAIL_DIGEST_BY, MAIL_DEDUP_WINDOW, MAIL_DEDUP_IGNORE, MAIL_LISTEN,
+	// MAIL_SOCKET_MODE, MAIL_SMTP_LISTEN, MAIL_SMTP_CREDENTIALS,
+	// MAIL_SMTP_TLS_CERT, MAIL_SMTP_TLS_KEY, MAIL_MAILDROP_DIR
 	mustBind(viper.BindEnv("telegram_token", "MAIL_TELEGRAM_TOKEN"))
 	mustBind(viper.BindEnv("telegram_chat", "MAIL_TELEGRAM_CHAT"))
+	mustBind(viper.BindEnv("telegram_routes", "MAIL_TELEGRAM_ROUTES"))
 	mustBind(viper.BindEnv("state_dir", "STATE_DIRECTORY"))
 	mustBind(viper.BindEnv("hostname", "HOSTNAME"))
 	mustBind(viper.BindEnv("sentry_dsn", "MAIL_SENTRY_DSN"))
 	mustBind(viper.BindEnv("default_subject", "MAIL_DEFAULT_SUBJECT"))
 	mustBind(viper.BindEnv("max_payload_size", "MAIL_MAX_PAYLOAD_SIZE"))
 	mustBind(viper.BindEnv("socket_timeout", "MAIL_SOCKET_TIMEOUT"))
+	mustBind(viper.BindEnv("max_attachment_size", "MAIL_MAX_ATTACHMENT_SIZE"))
+	mustBind(viper.BindEnv("show_sender", "MAIL_SHOW_SENDER"))
+	mustBind(viper.BindEnv("rate_limit_messages", "MAIL_RATE_LIMIT_MESSAGES"))
+	mustBind(viper.BindEnv("rate_limit_bytes", "MAIL_RATE_LIMIT_BYTES"))
+	mustBind(viper.BindEnv("max_queue_files", "MAIL_MAX_QUEUE_FILES"))
+	mustBind(viper.BindEnv("max_queue_bytes", "MAIL_MAX_QUEUE_BYTES"))
+	mustBind(viper.BindEnv("max_attempts", "MAIL_MAX_ATTEMPTS"))
+	mustBind(viper.BindEnv("max_age", "MAIL_MAX_AGE"))
+	mustBind(viper.BindEnv("telegram_chat_rate", "MAIL_TELEGRAM_CHAT_RATE"))
+	mustBind(viper.BindEnv("telegram_global_rate", "MAIL_TELEGRAM_GLOBAL_RATE"))
+	mustBind(viper.BindEnv("digest_window", "MAIL_DIGEST_WINDOW"))
+	mustBind(viper.BindEnv("digest_by", "MAIL_DIGEST_BY"))
+	mustBind(viper.BindEnv("dedup_window", "MAIL_DEDUP_WINDOW"))
+	mustBind(viper.BindEnv("dedup_ignore", "MAIL_DEDUP_IGNORE"))
+	mustBind(viper.BindEnv("listen", "MAIL_LISTEN"))
+	mustBind(viper.BindEnv("socket_mode", "MAIL_SOCKET_MODE"))
+	mustBind(viper.BindEnv("smtp_listen", "MAIL_SMTP_LISTEN"))
+	mustBind(viper.BindEnv("smtp_credentials", "MAIL_SMTP_CREDENTIALS"))
+	mustBind(viper.BindEnv("smtp_tls_cert", "MAIL_SMTP_TLS_CERT"))
+	mustBind(viper.BindEnv("smtp_tls_key", "MAIL_SMTP_TLS_KEY"))
+	mustBind(viper.BindEnv("maildrop_dir", "MAIL_MAILDROP_DIR"))
 
 	// Set defaults that depend on file reads or other envs
 	viper.SetDefault("hostname", getDefaultHostname())
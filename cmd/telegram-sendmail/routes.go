@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"path"
+	"strings"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+)
+
+// chatRoute sends mail for recipients matching pattern to chat.
+type chatRoute struct {
+	pattern string
+	chat    string
+}
+
+// chatRouter maps recipient addresses to Telegram chats. Routes are tried in
+// order and the first match wins; unmatched recipients use defaultChat.
+type chatRouter struct {
+	defaultChat string
+	routes      []chatRoute
+}
+
+// parseRoutes parses "pattern=chat" specs. Each spec may itself hold several
+// comma-separated entries so a single MAIL_TELEGRAM_ROUTES value works.
+//
+// Patterns are case-insensitive globs (path.Match syntax) over the full
+// address. A pattern ending in "@" matches that local part at any domain,
+// so "root@" is shorthand for "root@*".
+func parseRoutes(specs []string) ([]chatRoute, error) {
+	var routes []chatRoute
+	for _, spec := range specs {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			pattern, chat, ok := strings.Cut(entry, "=")
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			chat = strings.TrimSpace(chat)
+			if !ok || pattern == "" || chat == "" {
+				return nil, fmt.Errorf("route %q: want pattern=chat", entry)
+			}
+			if strings.HasSuffix(pattern, "@") {
+				pattern += "*"
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %q: %w", entry, err)
+			}
+			routes = append(routes, chatRoute{pattern: pattern, chat: chat})
+		}
+	}
+	return routes, nil
+}
+
+// validate checks that the default chat and every route target parse as
+// "chat_id[:thread_id]" so typos fail at startup instead of on every send.
+func (r chatRouter) validate() error {
+	if _, _, err := telegram.ParseChatID(r.defaultChat); err != nil {
+		return err
+	}
+	for _, route := range r.routes {
+		if _, _, err := telegram.ParseChatID(route.chat); err != nil {
+			return fmt.Errorf("route %s: %w", route.pattern, err)
+		}
+	}
+	return nil
+}
+
+// chatsFor returns the distinct chats the recipients route to, in first-seen
+// order. No recipients, or only unmatched ones, yields the default chat.
+func (r chatRouter) chatsFor(recipients []string) []string {
+	var chats []string
+	seen := map[string]bool{}
+	add := func(chat string) {
+		if !seen[chat] {
+			seen[chat] = true
+			chats = append(chats, chat)
+		}
+	}
+	for _, rcpt := range recipients {
+		add(r.chatFor(rcpt))
+	}
+	if len(chats) == 0 {
+		add(r.defaultChat)
+	}
+	return chats
+}
+
+func (r chatRouter) chatFor(recipient string) string {
+	addr := normalizeAddress(recipient)
+	for _, route := range r.routes {
+		// Patterns were validated by parseRoutes, so Match cannot fail here.
+		if ok, _ := path.Match(route.pattern, addr); ok {
+			return route.chat
+		}
+	}
+	return r.defaultChat
+}
+
+// normalizeAddress lower-cases an address and gives bare local names
+// ("root", as cron passes them) a trailing "@" so "root@" routes match.
+func normalizeAddress(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if !strings.Contains(addr, "@") {
+		addr += "@"
+	}
+	return addr
+}
+
+// headerRecipients returns the addresses in the To, Cc and Bcc headers of an
+// RFC 822 message. Unparsable lists fall back to comma splitting so a
+// sloppy "To: root, Ops <admin@x>" from a shell script still routes.
+func headerRecipients(message io.Reader) []string {
+	msg, err := mail.ReadMessage(message)
+	if err != nil {
+		return nil
+	}
+	var recipients []string
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		value := msg.Header.Get(key)
+		if value == "" {
+			continue
+		}
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			for _, addr := range strings.Split(value, ",") {
+				addr = strings.TrimSpace(addr)
+				if parsed, err := mail.ParseAddress(addr); err == nil {
+					addr = parsed.Address
+				}
+				if addr != "" {
+					recipients = append(recipients, addr)
+				}
+			}
+			continue
+		}
+		for _, addr := range list {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes([]string{"root@=-1001, backup@=-1002", "*@DB*=-1003"})
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	want := []chatRoute{
+		{pattern: "root@*", chat: "-1001"},
+		{pattern: "backup@*", chat: "-1002"},
+		{pattern: "*@db*", chat: "-1003"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("routes=%+v want %+v", routes, want)
+	}
+
+	for _, bad := range []string{"nochat", "=123", "root@=", "[@=1"} {
+		if _, err := parseRoutes([]string{bad}); err == nil {
+			t.Errorf("parseRoutes(%q): expected error", bad)
+		}
+	}
+}
+
+func TestChatRouterChatsFor(t *testing.T) {
+	routes, err := parseRoutes([]string{"root@=ops,backup@=backups,*@db*=dba"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chatRouter{defaultChat: "default", routes: routes}
+
+	tests := []struct {
+		name       string
+		recipients []string
+		want       []string
+	}{
+		{name: "no recipients", recipients: nil, want: []string{"default"}},
+		{name: "bare local name", recipients: []string{"root"}, want: []string{"ops"}},
+		{name: "case insensitive", recipients: []string{"Root@Example.com"}, want: []string{"ops"}},
+		{name: "glob", recipients: []string{"postgres@db1.internal"}, want: []string{"dba"}},
+		{name: "first match wins", recipients: []string{"root@db1"}, want: []string{"ops"}},
+		{name: "unmatched uses default", recipients: []string{"alice@example.com"}, want: []string{"default"}},
+		{name: "fan out deduplicated", recipients: []string{"root", "backup@x", "root@y", "bob"}, want: []string{"ops", "backups", "default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := router.chatsFor(tt.recipients); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("chatsFor(%v)=%v want %v", tt.recipients, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderRecipients(t *testing.T) {
+	data := "To: Ops <root@example.com>, backup\nCc: dba@db1\nBcc: hidden@x\nSubject: s\n\nbody"
+	got := headerRecipients(strings.NewReader(data))
+	want := []string{"root@example.com", "backup", "dba@db1", "hidden@x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("headerRecipients=%v want %v", got, want)
+	}
+}
+
+func TestChatRouterValidate(t *testing.T) {
+	ok := chatRouter{defaultChat: "-100:1", routes: []chatRoute{{pattern: "root@*", chat: "@ops:7"}}}
+	if err := ok.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	for _, bad := range []chatRouter{
+		{defaultChat: "-100:x"},
+		{defaultChat: "-100", routes: []chatRoute{{pattern: "root@*", chat: "-200:0"}}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("validate(%+v): expected error", bad)
+		}
+	}
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
+	"os/user"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 const (
 	// defaultSendmailSocket is the systemd socket path (packaging + NixOS).
 	defaultSendmailSocket = "/run/telegram-sendmail/socket.sock"
-	// sendmailWaitAttempts matches the historical Nix nc wrapper (30s).
+	// defaultSendmailStateDir is the packaged StateDirectory, the queue -bp
+	// prints unless --state-dir or STATE_DIRECTORY says otherwise.
+	defaultSendmailStateDir = "/var/lib/telegram-sendmail"
+	// sendmailWaitAttempts matches the historical Nix nc wrapper (30s). It
+	// only applies without a maildrop: with one, a missing socket means
+	// spooling at once.
 	sendmailWaitAttempts = 30
 	// sendmailWaitInterval is the sleep between socket existence checks.
 	sendmailWaitInterval = 1 * time.Second
@@ -23,45 +34,195 @@ const (
 	sendmailIOTimeout = 30 * time.Second
 )
 
-var sendmailSocketPath string
+var (
+	sendmailSocketPath string
+	sendmailSender     string
+)
 
 var sendmailCmd = &cobra.Command{
-	Use:   "sendmail",
+	Use:   "sendmail [options] [recipient...]",
 	Short: "sendmail client: pipe stdin to the local telegram-sendmail socket",
-	Long: `Drop-in sendmail client. Classic sendmail flags are accepted and ignored;
-the message is read from stdin and written to the Unix socket served by
-"telegram-sendmail serve" (systemd socket activation). Exit 0 only after the
-daemon acks that the message was queued; Telegram delivery is asynchronous.`,
+	Long: `Drop-in sendmail client. The message is read from stdin and written to
+the Unix socket served by "telegram-sendmail serve". Exit 0 only after the
+daemon acks that the message was queued; Telegram delivery is asynchronous.
+When the socket is unavailable the message is spooled to --maildrop-dir
+instead, and serve queues it when it next starts.
+Failures exit with sysexits codes: 75 (EX_TEMPFAIL) when the message may
+be accepted later, 65 (EX_DATAERR) when it is too big, 64 (EX_USAGE) for a
+bad command line and 69 (EX_UNAVAILABLE) for other rejections.
+
+Classic sendmail options:
+  -t          also send to the To/Cc/Bcc addresses, and drop the Bcc header
+  -f addr     envelope sender (default: invoking user); -r is the same
+  -F name     sender full name, shown with --show-sender
+  -i, -oi     a line with a single "." does not end the message
+  -bm         read a message from stdin (default)
+  -bs         speak SMTP on stdin/stdout
+  -bp         print the queue, like mailq
+  -bi         rebuild aliases (no-op)
+  -v          report progress on stderr
+
+Recipients and the sender are sent to serve in an envelope, so they pick the
+destination chat; other sendmail options are accepted and ignored.`,
 	// Silence usage on dial/copy errors — cron/mail callers treat this as sendmail.
 	SilenceUsage: true,
-	RunE:         runSendmail,
+	// sendmail options clash with the global shorthands (-t, -d, -c, ...), so
+	// runSendmail parses them itself and only hands --options to cobra.
+	DisableFlagParsing: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := runSendmail(cmd, args)
+		return withExitCode(err, sendmailExitCode(err))
+	},
 }
 
 func init() {
 	sendmailCmd.Flags().StringVar(&sendmailSocketPath, "socket", defaultSendmailSocket, "Unix socket path for the telegram-sendmail service")
-	// Accept and ignore unknown flags so invocations like `sendmail -t -i` work.
-	sendmailCmd.FParseErrWhitelist = cobra.FParseErrWhitelist{UnknownFlags: true}
+	sendmailCmd.Flags().StringVar(&sendmailSender, "sender", "", "Envelope sender address, like -f (default: invoking user)")
+	// Accept and ignore unknown --options, like unknown sendmail options.
+	sendmailCmd.Flags().ParseErrorsWhitelist.UnknownFlags = true
 	rootCmd.AddCommand(sendmailCmd)
 }
 
 func runSendmail(cmd *cobra.Command, args []string) error {
-	if err := waitForSocket(sendmailSocketPath, sendmailWaitAttempts, sendmailWaitInterval); err != nil {
+	opts, err := parseSendmailArgs(args, func(name string) bool { return longFlagTakesValue(cmd, name) })
+	if err != nil {
 		return err
 	}
+	if cmd != nil {
+		// cmd.ParseFlags is a no-op under DisableFlagParsing.
+		flags := cmd.Flags()
+		flags.AddFlagSet(cmd.InheritedFlags())
+		if err := flags.Parse(opts.long); err != nil {
+			return fmt.Errorf("%w: %w", ErrSendmailUsage, err)
+		}
+		if help, _ := flags.GetBool("help"); help {
+			return cmd.Help()
+		}
+	}
+	if opts.sender == "" {
+		opts.sender = sendmailSender
+	}
+
+	switch opts.mode {
+	case sendmailModePrintQueue:
+		return printSendmailQueue(cmd)
+	case sendmailModeAliases:
+		// No alias database; succeed so newaliases-style callers carry on.
+		return nil
+	case sendmailModeSMTP:
+		return runSendmailSMTP(opts, os.Stdin, os.Stdout)
+	}
+
+	var message io.Reader = os.Stdin
+	if !opts.ignoreDots {
+		message = newDotTerminatedReader(message)
+	}
+	recipients := opts.recipients
+	if opts.fromHeaders {
+		var headerRcpts []string
+		if headerRcpts, message, err = extractHeaderRecipients(message); err != nil {
+			return fmt.Errorf("read message header: %w", err)
+		}
+		recipients = append(recipients, headerRcpts...)
+	}
+
+	env := sendmailEnvelope(recipients, opts.sender)
+	env.senderName = opts.fullName
+	if opts.verbose {
+		fmt.Fprintf(os.Stderr, "Submitting to %s: sender %s, recipients %s\n", sendmailSocketPath, env.sender, strings.Join(env.recipients, ", "))
+	}
+	resp, err := submitToServe(sendmailSocketPath, env, message)
+	if submitNeverStarted(err) {
+		// Nothing was read from stdin yet: spool the message for serve.
+		path, spoolErr := spoolMessage(env, message)
+		if spoolErr != nil {
+			return fmt.Errorf("%w; spool to maildrop: %w", err, spoolErr)
+		}
+		if opts.verbose {
+			fmt.Fprintf(os.Stderr, "%v; spooled to %s\n", err, path)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if opts.verbose {
+		fmt.Fprintf(os.Stderr, "Server replied %q\n", resp)
+	}
+	// "OK" = message reached the daemon and was queued (not Telegram delivery).
+	if resp != wireResponseOK {
+		msg := strings.TrimSpace(resp)
+		if msg == "" {
+			msg = emptyServerResponse
+		}
+		return &serverRejectedError{detail: msg}
+	}
+	return nil
+}
+
+// longFlagTakesValue reports whether --name consumes the next argument.
+// Unknown names do not: cobra ignores them.
+func longFlagTakesValue(cmd *cobra.Command, name string) bool {
+	if cmd == nil {
+		return false
+	}
+	f := cmd.Flags().Lookup(name)
+	if f == nil {
+		f = cmd.InheritedFlags().Lookup(name)
+	}
+	return f != nil && f.NoOptDefVal == ""
+}
+
+// submitNeverStarted reports whether submitToServe failed before sending
+// anything: the socket is missing, or nothing accepts connections on it
+// (serve stopped or masked). The message can then go to the maildrop
+// without risking a duplicate.
+func submitNeverStarted(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, ErrSocketUnavailable) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// spoolMessage writes the message to the configured maildrop, for serve to
+// pick up when it next starts.
+func spoolMessage(env envelope, message io.Reader) (string, error) {
+	dir := viper.GetString("maildrop_dir")
+	if dir == "" {
+		return "", ErrNoMaildrop
+	}
+	return spoolToMaildrop(dir, env, message, viper.GetInt64("max_payload_size"))
+}
+
+// socketWaitAttempts is how often submitToServe checks for the socket: once
+// when a maildrop can take the message instead. maildrop_dir has a default,
+// so the maildrop must actually exist: hosts without it keep waiting for a
+// restarting serve.
+func socketWaitAttempts() int {
+	if dir := viper.GetString("maildrop_dir"); dir != "" && maildropWritable(dir) {
+		return 1
+	}
+	return sendmailWaitAttempts
+}
+
+// submitToServe sends env and the message to serve over the wire protocol
+// and returns serve's status line.
+func submitToServe(socketPath string, env envelope, message io.Reader) (string, error) {
+	if err := waitForSocket(socketPath, socketWaitAttempts(), sendmailWaitInterval); err != nil {
+		return "", err
+	}
 
-	conn, err := net.Dial("unix", sendmailSocketPath)
+	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
-		return fmt.Errorf("dial %s: %w", sendmailSocketPath, err)
+		return "", fmt.Errorf("dial %s: %w", socketPath, err)
 	}
 	defer conn.Close()
 
 	// Bound the whole exchange (write body + read queue ack).
 	if err := conn.SetDeadline(time.Now().Add(sendmailIOTimeout)); err != nil {
-		return fmt.Errorf("set deadline: %w", err)
+		return "", fmt.Errorf("set deadline: %w", err)
 	}
 
-	if _, err := io.Copy(conn, os.Stdin); err != nil {
-		return fmt.Errorf("copy stdin to socket: %w", err)
+	if _, err := io.Copy(conn, io.MultiReader(bytes.NewReader(env.header()), message)); err != nil {
+		return "", fmt.Errorf("copy stdin to socket: %w", err)
 	}
 
 	// serve.handleConnection reads with ReadAll until EOF, then writes "OK"
@@ -69,24 +230,86 @@ func runSendmail(cmd *cobra.Command, args []string) error {
 	// the write side so the server finishes the read without the client
 	// dropping the reply via a full Close.
 	if err := closeWrite(conn); err != nil {
-		return fmt.Errorf("close write half: %w", err)
+		return "", fmt.Errorf("close write half: %w", err)
 	}
 
 	resp, err := io.ReadAll(conn)
 	if err != nil {
-		return fmt.Errorf("read server response: %w", err)
+		return "", fmt.Errorf("read server response: %w", err)
 	}
-	// "OK" = message reached the daemon and was queued (not Telegram delivery).
-	if string(resp) != "OK" {
-		msg := strings.TrimSpace(string(resp))
-		if msg == "" {
-			msg = "empty response"
-		}
-		return &serverRejectedError{detail: msg}
+	return string(resp), nil
+}
+
+// runSendmailSMTP implements -bs: an SMTP session on stdin/stdout whose
+// messages are forwarded to serve like piped ones.
+func runSendmailSMTP(opts sendmailOptions, in io.Reader, out io.Writer) error {
+	cfg := smtpConfig{
+		hostname: viper.GetString("hostname"),
+		timeout:  sendmailIOTimeout,
+		maxSize:  viper.GetInt64("max_payload_size"),
+		submit: func(env envelope, payload []byte) string {
+			client := sendmailEnvelope(env.recipients, env.sender)
+			client.senderName = opts.fullName
+			resp, err := submitToServe(sendmailSocketPath, client, bytes.NewReader(payload))
+			if submitNeverStarted(err) {
+				_, spoolErr := spoolMessage(client, bytes.NewReader(payload))
+				if spoolErr == nil {
+					return wireResponseOK
+				}
+				err = fmt.Errorf("%w; spool to maildrop: %w", err, spoolErr)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+				return wireResponseSaveFailed
+			}
+			return resp
+		},
 	}
+	handleSMTPConnection(stdioConn{Reader: in, Writer: out}, cfg)
 	return nil
 }
 
+// stdioConn adapts stdin/stdout to the net.Conn an SMTP session runs on.
+// Deadlines are not supported; the caller's pipes close the session.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error                     { return nil }
+func (stdioConn) LocalAddr() net.Addr              { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr             { return stdioAddr{} }
+func (stdioConn) SetDeadline(time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// sendmailEnvelope describes this invocation for serve: positional
+// recipients, the envelope sender and who submitted the message when.
+func sendmailEnvelope(recipients []string, sender string) envelope {
+	if sender == "" {
+		sender = invokingUser()
+	}
+	return envelope{
+		recipients: recipients,
+		sender:     sender,
+		clientUID:  strconv.Itoa(os.Getuid()),
+		submitted:  time.Now(),
+	}
+}
+
+// invokingUser is the default envelope sender, like sendmail's own default.
+func invokingUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
 // closeWrite shuts down the write half of a duplex connection (Unix/TCP).
 func closeWrite(conn net.Conn) error {
 	type closeWriter interface {
@@ -116,8 +339,67 @@ const (
 	ErrServerRejected sendmailError = "server rejected message"
 	// ErrSocketUnavailable: waitForSocket exhausted its attempt budget.
 	ErrSocketUnavailable sendmailError = "socket not available"
+	// ErrRateLimited: serve rejected the message under the per-UID limits.
+	ErrRateLimited sendmailError = "rate limit exceeded, try again later"
+	// ErrQueueFull: serve's queue is at its file or byte cap.
+	ErrQueueFull sendmailError = "queue full, try again later"
+	// ErrUnsupportedSendmailMode: a -b mode this client does not implement.
+	ErrUnsupportedSendmailMode sendmailError = "unsupported sendmail mode"
+	// ErrSendmailUsage: the command line could not be parsed.
+	ErrSendmailUsage sendmailError = "invalid sendmail arguments"
+	// ErrPayloadTooBig: serve's max_payload_size is smaller than the message.
+	ErrPayloadTooBig sendmailError = "message too big"
+	// ErrBadEnvelope: serve could not parse the envelope this client sent.
+	ErrBadEnvelope sendmailError = "malformed envelope"
+	// ErrServerSaveFailed: serve could not write the message to its queue.
+	ErrServerSaveFailed sendmailError = "server could not queue the message, try again later"
+	// ErrNoServerAck: serve closed the connection without a status line.
+	ErrNoServerAck sendmailError = "no reply from server, try again later"
+	// ErrNoMaildrop: the socket is unavailable and maildrop_dir is empty.
+	ErrNoMaildrop sendmailError = "no maildrop configured"
+	// ErrQueueNotReadable: -bp could not read the queue directory.
+	ErrQueueNotReadable sendmailError = "queue not readable"
 )
 
+// printSendmailQueue is -bp. mailq callers pass none of our flags, so the
+// queue defaults to the packaged state directory rather than the relative
+// one the other commands fall back to.
+func printSendmailQueue(cmd *cobra.Command) error {
+	if !stateDirConfigured(cmd) {
+		viper.Set("state_dir", defaultSendmailStateDir)
+	}
+	return queueNotReadable(runQueueList(cmd, nil))
+}
+
+// stateDirConfigured reports whether state_dir comes from --state-dir or
+// STATE_DIRECTORY rather than its default.
+func stateDirConfigured(cmd *cobra.Command) bool {
+	if os.Getenv("STATE_DIRECTORY") != "" {
+		return true
+	}
+	f := cmd.Flags().Lookup("state-dir")
+	return f != nil && f.Changed
+}
+
+// queueNotReadable turns a failure to open the queue into ErrQueueNotReadable.
+// The state directory belongs to serve's DynamicUser, so for anyone but root
+// that is usually a permission error.
+func queueNotReadable(err error) error {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		return err
+	}
+	err = fmt.Errorf("%w: %s: %w", ErrQueueNotReadable, pathErr.Path, pathErr.Err)
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%w (the queue belongs to the telegram-sendmail service; run as root)", err)
+	}
+	return err
+}
+
+// emptyServerResponse is the serverRejectedError detail when serve closed
+// the connection without replying.
+const emptyServerResponse = "empty response"
+
 // socketUnavailableError is returned when waitForSocket exhausts its attempts.
 // Waited is the total budget (attempts * interval) for callers/tests that need
 // the duration without parsing Error().
@@ -137,17 +419,47 @@ func (e *socketUnavailableError) Is(target error) bool {
 }
 
 // serverRejectedError carries the server's non-OK status line detail while
-// remaining matchable via errors.Is(..., ErrServerRejected).
+// remaining matchable via errors.Is(..., ErrServerRejected). Status lines
+// with a dedicated sentinel (rate limit, queue full, too big, ...) also
+// match that one.
 type serverRejectedError struct {
 	detail string
 }
 
 func (e *serverRejectedError) Error() string {
+	if reason := e.reason(); reason != nil {
+		return fmt.Sprintf("%s: %s", ErrServerRejected, reason)
+	}
 	return fmt.Sprintf("%s: %s", ErrServerRejected, e.detail)
 }
 
 func (e *serverRejectedError) Unwrap() error { return ErrServerRejected }
 
+func (e *serverRejectedError) Is(target error) bool {
+	reason := e.reason()
+	return reason != nil && target == reason
+}
+
+// reason maps well-known status lines to their sentinel, or nil.
+func (e *serverRejectedError) reason() error {
+	switch e.detail {
+	case wireResponseRateLimited:
+		return ErrRateLimited
+	case wireResponseQueueFull:
+		return ErrQueueFull
+	case wireResponsePayloadTooBig:
+		return ErrPayloadTooBig
+	case wireResponseBadEnvelope:
+		return ErrBadEnvelope
+	case wireResponseSaveFailed:
+		return ErrServerSaveFailed
+	case emptyServerResponse:
+		return ErrNoServerAck
+	default:
+		return nil
+	}
+}
+
 func waitForSocket(path string, attempts int, interval time.Duration) error {
 	if attempts < 1 {
 		return ErrInvalidSocketWaitAttempts
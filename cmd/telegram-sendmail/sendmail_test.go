@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/spf13/viper"
 )
 
 // writeAndClose writes body to w then closes it (always closes, even on write error).
@@ -126,14 +134,24 @@ func TestRunSendmail_copiesStdinAndRequiresOK(t *testing.T) {
 	msg := "Subject: hi\n\nbody\n"
 	startStdinWriter(w, msg, errCh)
 
-	if err := runSendmail(nil, nil); err != nil {
+	if err := runSendmail(nil, []string{"root", "backup@example.com"}); err != nil {
 		t.Fatalf("runSendmail: %v", err)
 	}
 
 	select {
 	case got := <-gotCh:
-		if got != msg {
-			t.Fatalf("server got %q want %q", got, msg)
+		env, payload, ok, err := splitEnvelope([]byte(got))
+		if err != nil || !ok {
+			t.Fatalf("server got no envelope (ok=%v err=%v): %q", ok, err, got)
+		}
+		if string(payload) != msg {
+			t.Fatalf("server got payload %q want %q", payload, msg)
+		}
+		if strings.Join(env.recipients, ",") != "root,backup@example.com" {
+			t.Fatalf("envelope recipients=%v", env.recipients)
+		}
+		if env.clientUID != strconv.Itoa(os.Getuid()) || env.submitted.IsZero() {
+			t.Fatalf("envelope missing client metadata: %+v", env)
 		}
 	case err := <-errCh:
 		t.Fatalf("server: %v", err)
@@ -245,3 +263,258 @@ func TestRunSendmail_emptyResponse(t *testing.T) {
 		t.Fatalf("detail=%q want %q", rej.detail, "empty response")
 	}
 }
+
+func TestServerRejectedErrorReasons(t *testing.T) {
+	tests := []struct {
+		detail string
+		want   error
+	}{
+		{detail: wireResponseRateLimited, want: ErrRateLimited},
+		{detail: wireResponseQueueFull, want: ErrQueueFull},
+		{detail: wireResponsePayloadTooBig, want: ErrPayloadTooBig},
+		{detail: wireResponseBadEnvelope, want: ErrBadEnvelope},
+		{detail: wireResponseSaveFailed, want: ErrServerSaveFailed},
+		{detail: emptyServerResponse, want: ErrNoServerAck},
+	}
+	for _, tt := range tests {
+		err := error(&serverRejectedError{detail: tt.detail})
+		if !errors.Is(err, tt.want) || !errors.Is(err, ErrServerRejected) {
+			t.Fatalf("%q: expected %v and ErrServerRejected, got %v", tt.detail, tt.want, err)
+		}
+		if !strings.Contains(err.Error(), tt.want.Error()) {
+			t.Fatalf("%q: message %q should explain %q", tt.detail, err.Error(), tt.want)
+		}
+	}
+	other := error(&serverRejectedError{detail: wireResponsePayloadTooBig})
+	if errors.Is(other, ErrRateLimited) || errors.Is(other, ErrQueueFull) {
+		t.Fatalf("payload too big matched a limit sentinel: %v", other)
+	}
+}
+
+// fakeServe accepts count wire submissions on a new socket, replying OK to
+// each, and returns the socket path and the received data.
+func fakeServe(t *testing.T, count int) (string, <-chan string) {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan string, count)
+	go func() {
+		for range count {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(conn)
+			got <- string(b)
+			_, _ = conn.Write([]byte(wireResponseOK))
+			conn.Close()
+		}
+	}()
+	return sock, got
+}
+
+func TestRunSendmail_classicFlags(t *testing.T) {
+	sock, got := fakeServe(t, 1)
+	sendmailSocketPath = sock
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+
+	errCh := make(chan error, 1)
+	// Without -i the lone dot ends the message.
+	startStdinWriter(w, "To: ops@example.com\nBcc: audit@example.com\nSubject: s\n\nbody\n.\ntrailing\n", errCh)
+
+	if err := runSendmail(nil, []string{"-t", "-f", "cron@host", "-FNightly backup", "root"}); err != nil {
+		t.Fatalf("runSendmail: %v", err)
+	}
+	env, payload, ok, err := splitEnvelope([]byte(<-got))
+	if err != nil || !ok {
+		t.Fatalf("no envelope: ok=%v err=%v", ok, err)
+	}
+	if strings.Join(env.recipients, ",") != "root,ops@example.com,audit@example.com" {
+		t.Fatalf("recipients=%v", env.recipients)
+	}
+	if env.sender != "cron@host" || env.senderName != "Nightly backup" {
+		t.Fatalf("sender=%q name=%q", env.sender, env.senderName)
+	}
+	if string(payload) != "To: ops@example.com\nSubject: s\n\nbody\n" {
+		t.Fatalf("payload=%q", payload)
+	}
+}
+
+func TestRunSendmail_spoolsWhenServeIsDown(t *testing.T) {
+	// A socket file nobody listens on, as left by a stopped serve: dialing it
+	// fails at once instead of waiting for the socket to appear.
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	sendmailSocketPath = sock
+
+	dir := testMaildrop(t)
+	viper.Set("maildrop_dir", dir)
+	defer viper.Set("maildrop_dir", "")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+	errCh := make(chan error, 1)
+	startStdinWriter(w, "Subject: s\n\nbody\n", errCh)
+
+	if err := runSendmail(nil, []string{"-i", "root"}); err != nil {
+		t.Fatalf("runSendmail: %v", err)
+	}
+	stateDir := t.TempDir()
+	if n, err := pickupMaildrop(dir, stateDir, 1024); err != nil || n != 1 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+	envs, payloads := readQueuedEnvelopes(t, stateDir)
+	if envs[0].recipients[0] != "root" || payloads[0] != "Subject: s\n\nbody\n" {
+		t.Fatalf("spooled %+v %q", envs[0], payloads[0])
+	}
+
+	// A missing socket spools at once rather than after the socket wait.
+	sendmailSocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	if r, w, err = os.Pipe(); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin = r
+	startStdinWriter(w, "body", errCh)
+	start := time.Now()
+	if err := runSendmail(nil, []string{"root"}); err != nil {
+		t.Fatalf("runSendmail without socket: %v", err)
+	}
+	if waited := time.Since(start); waited >= sendmailWaitInterval {
+		t.Fatalf("spooling took %v", waited)
+	}
+	if n, err := pickupMaildrop(dir, stateDir, 1024); err != nil || n != 1 {
+		t.Fatalf("pickup moved %d, err=%v", n, err)
+	}
+
+	// Without a maildrop the client still fails, and callers retry.
+	sendmailSocketPath = sock
+	viper.Set("maildrop_dir", "")
+	if r, w, err = os.Pipe(); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin = r
+	startStdinWriter(w, "body", errCh)
+	err = runSendmail(nil, []string{"root"})
+	if !errors.Is(err, ErrNoMaildrop) || sendmailExitCode(err) != exTempFail {
+		t.Fatalf("err=%v (exit %d), want %v and EX_TEMPFAIL", err, sendmailExitCode(err), ErrNoMaildrop)
+	}
+}
+
+func TestRunSendmailSMTP(t *testing.T) {
+	sock, got := fakeServe(t, 1)
+	sendmailSocketPath = sock
+
+	in := strings.NewReader(strings.Join([]string{
+		"EHLO client",
+		"MAIL FROM:<app@host>",
+		"RCPT TO:<root>",
+		"DATA",
+		"Subject: s",
+		"",
+		"..dotted",
+		".",
+		"QUIT",
+		"",
+	}, "\r\n"))
+	var out strings.Builder
+	if err := runSendmailSMTP(sendmailOptions{fullName: "App"}, in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "250 2.0.0 Queued") || !strings.HasSuffix(out.String(), "221 2.0.0 Bye\r\n") {
+		t.Fatalf("SMTP transcript:\n%s", out.String())
+	}
+	env, payload, _, err := splitEnvelope([]byte(<-got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.sender != "app@host" || strings.Join(env.recipients, ",") != "root" || env.senderName != "App" || env.clientUID == "" {
+		t.Fatalf("envelope=%+v", env)
+	}
+	if string(payload) != "Subject: s\n\n.dotted\n" {
+		t.Fatalf("payload=%q", payload)
+	}
+}
+
+func TestSocketWaitAttempts(t *testing.T) {
+	defer viper.Set("maildrop_dir", "")
+	for name, tc := range map[string]struct {
+		dir  string
+		want int
+	}{
+		"disabled":         {"", sendmailWaitAttempts},
+		"missing maildrop": {filepath.Join(t.TempDir(), "missing"), sendmailWaitAttempts},
+		"maildrop":         {testMaildrop(t), 1},
+	} {
+		viper.Set("maildrop_dir", tc.dir)
+		if got := socketWaitAttempts(); got != tc.want {
+			t.Errorf("%s: socketWaitAttempts()=%d want %d", name, got, tc.want)
+		}
+	}
+}
+
+func TestRunSendmail_printQueue(t *testing.T) {
+	defer viper.Set("state_dir", nil)
+	var out bytes.Buffer
+	sendmailCmd.SetOut(&out)
+	defer sendmailCmd.SetOut(nil)
+
+	dir := t.TempDir()
+	writeQueued(t, dir, 0, 0, "Subject: stuck in the queue\n\nbody")
+	// As bound by initConfig.
+	t.Setenv("STATE_DIRECTORY", dir)
+	viper.Set("state_dir", dir)
+	if err := runSendmail(sendmailCmd, []string{"-bp"}); err != nil {
+		t.Fatalf("-bp: %v", err)
+	}
+	if !strings.Contains(out.String(), "stuck in the queue") {
+		t.Fatalf("-bp output misses the queued message:\n%s", out.String())
+	}
+
+	// mailq passes no flags: the packaged queue, not ./telegram_sendmail_state.
+	t.Setenv("STATE_DIRECTORY", "")
+	err := runSendmail(sendmailCmd, []string{"-bp"})
+	if got := viper.GetString("state_dir"); got != defaultSendmailStateDir {
+		t.Fatalf("state_dir=%q want %q", got, defaultSendmailStateDir)
+	}
+	if err != nil && !errors.Is(err, ErrQueueNotReadable) {
+		t.Fatalf("-bp on the packaged queue: %v", err)
+	}
+}
+
+func TestQueueNotReadable(t *testing.T) {
+	err := queueNotReadable(fmt.Errorf("read state directory: %w", &fs.PathError{Op: "open", Path: "/var/lib/telegram-sendmail", Err: syscall.EACCES}))
+	if !errors.Is(err, ErrQueueNotReadable) || !strings.Contains(err.Error(), "run as root") {
+		t.Fatalf("permission denied: %v", err)
+	}
+	if got := sendmailExitCode(err); got != exNoPerm {
+		t.Fatalf("permission denied exits %d, want %d", got, exNoPerm)
+	}
+
+	err = queueNotReadable(fmt.Errorf("read state directory: %w", &fs.PathError{Op: "open", Path: "/nonexistent", Err: syscall.ENOENT}))
+	if !errors.Is(err, ErrQueueNotReadable) || strings.Contains(err.Error(), "run as root") {
+		t.Fatalf("missing directory: %v", err)
+	}
+	if got := sendmailExitCode(err); got != exIOErr {
+		t.Fatalf("missing directory exits %d, want %d", got, exIOErr)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Sendmail -b modes this client implements.
+const (
+	sendmailModeMessage    = "m" // read a message from stdin (default)
+	sendmailModeSMTP       = "s" // speak SMTP on stdin/stdout
+	sendmailModePrintQueue = "p" // print the queue, like mailq
+	sendmailModeAliases    = "i" // rebuild aliases: there are none, no-op
+)
+
+// sendmailValueFlags are the classic single-letter options that take a
+// value, attached (-fuser) or as the next argument (-f user). Other letters
+// are switches, so they can be grouped (-ti).
+const sendmailValueFlags = "BbCdeFfhLMNOopRrVX"
+
+// sendmailOptions is a parsed sendmail command line.
+type sendmailOptions struct {
+	recipients []string
+	// sender is -f (or the obsolete -r), fullName is -F.
+	sender   string
+	fullName string
+	// fromHeaders is -t: add the To/Cc/Bcc addresses to the recipients and
+	// drop the Bcc header.
+	fromHeaders bool
+	// ignoreDots is -i / -oi: a line with a single "." does not end the
+	// message.
+	ignoreDots bool
+	verbose    bool
+	mode       string
+	// long holds --options for cobra (--socket, --state-dir, ...).
+	long []string
+}
+
+// parseSendmailArgs parses a sendmail command line the way sendmail's getopt
+// does: single-letter options (grouped switches, values attached or in the
+// next argument), then recipients. Options sendmail has but this client has
+// no use for are accepted and ignored, as callers pass them routinely.
+// Arguments starting with "--" are collected for cobra; longTakesValue
+// reports whether one consumes the next argument.
+func parseSendmailArgs(args []string, longTakesValue func(name string) bool) (sendmailOptions, error) {
+	opts := sendmailOptions{mode: sendmailModeMessage}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			opts.recipients = append(opts.recipients, args[i+1:]...)
+			return opts, nil
+		case strings.HasPrefix(arg, "--"):
+			opts.long = append(opts.long, arg)
+			if name := arg[2:]; !strings.Contains(name, "=") && longTakesValue(name) && i+1 < len(args) {
+				i++
+				opts.long = append(opts.long, args[i])
+			}
+			continue
+		case len(arg) < 2 || arg[0] != '-':
+			opts.recipients = append(opts.recipients, arg)
+			continue
+		}
+
+		for j := 1; j < len(arg); j++ {
+			flag := arg[j]
+			if !strings.ContainsRune(sendmailValueFlags, rune(flag)) {
+				opts.setSwitch(flag)
+				continue
+			}
+			value := arg[j+1:]
+			if value == "" {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("%w: option -%c requires a value", ErrSendmailUsage, flag)
+				}
+				i++
+				value = args[i]
+			}
+			if err := opts.setValue(flag, value); err != nil {
+				return opts, err
+			}
+			break
+		}
+	}
+	return opts, nil
+}
+
+func (o *sendmailOptions) setSwitch(flag byte) {
+	switch flag {
+	case 't':
+		o.fromHeaders = true
+	case 'i':
+		o.ignoreDots = true
+	case 'v':
+		o.verbose = true
+	}
+}
+
+func (o *sendmailOptions) setValue(flag byte, value string) error {
+	switch flag {
+	case 'f', 'r':
+		o.sender = value
+	case 'F':
+		o.fullName = value
+	case 'o':
+		if value == "i" {
+			o.ignoreDots = true
+		}
+	case 'b':
+		switch value {
+		case sendmailModeMessage, sendmailModeSMTP, sendmailModePrintQueue, sendmailModeAliases:
+			o.mode = value
+		default:
+			return fmt.Errorf("%w -b%s", ErrUnsupportedSendmailMode, value)
+		}
+	}
+	return nil
+}
+
+// dotTerminatedReader ends its input at a line holding a single ".", which
+// is how sendmail reads a message without -i.
+type dotTerminatedReader struct {
+	r    *bufio.Reader
+	line []byte
+	done bool
+}
+
+func newDotTerminatedReader(r io.Reader) *dotTerminatedReader {
+	return &dotTerminatedReader{r: bufio.NewReader(r)}
+}
+
+func (d *dotTerminatedReader) Read(p []byte) (int, error) {
+	for len(d.line) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		line, err := d.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if err == io.EOF {
+			d.done = true
+		}
+		if s := string(line); s == ".\n" || s == ".\r\n" || (d.done && s == ".") {
+			d.done = true
+			return 0, io.EOF
+		}
+		d.line = line
+	}
+	n := copy(p, d.line)
+	d.line = d.line[n:]
+	return n, nil
+}
+
+// extractHeaderRecipients implements -t: it reads the message header from r
+// and returns the To/Cc/Bcc addresses, and a reader of the message with the
+// Bcc header removed.
+func extractHeaderRecipients(r io.Reader) (recipients []string, message io.Reader, err error) {
+	br := bufio.NewReader(r)
+	var header, kept bytes.Buffer
+	inBcc := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of header (or of input): the separator stays with the body.
+			kept.Write(line)
+			break
+		}
+		header.Write(line)
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(string(line), ":")
+			inBcc = strings.EqualFold(strings.TrimSpace(name), "Bcc")
+		}
+		if !inBcc {
+			kept.Write(line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	header.WriteString("\n")
+	return headerRecipients(bytes.NewReader(header.Bytes())), io.MultiReader(&kept, br), nil
+}
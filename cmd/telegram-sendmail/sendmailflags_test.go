@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSendmailArgs(t *testing.T) {
+	takesValue := func(name string) bool { return name == "socket" }
+	for _, tc := range []struct {
+		args []string
+		want sendmailOptions
+	}{
+		{
+			args: []string{"root"},
+			want: sendmailOptions{mode: "m", recipients: []string{"root"}},
+		},
+		{
+			args: []string{"-t", "-i", "-fcron@host", "-F", "Nightly backup", "root"},
+			want: sendmailOptions{mode: "m", fromHeaders: true, ignoreDots: true, sender: "cron@host", fullName: "Nightly backup", recipients: []string{"root"}},
+		},
+		{
+			// Grouped switches, -oi, and options that are accepted but unused.
+			args: []string{"-tv", "-oi", "-oem", "-odb", "-N", "never", "-B8BITMIME", "-U", "ops"},
+			want: sendmailOptions{mode: "m", fromHeaders: true, verbose: true, ignoreDots: true, recipients: []string{"ops"}},
+		},
+		{
+			args: []string{"-r", "old@host", "-bs"},
+			want: sendmailOptions{mode: "s", sender: "old@host"},
+		},
+		{
+			args: []string{"--socket", "/tmp/s.sock", "--state-dir=/var/q", "-bp"},
+			want: sendmailOptions{mode: "p", long: []string{"--socket", "/tmp/s.sock", "--state-dir=/var/q"}},
+		},
+		{
+			args: []string{"-i", "--", "-weird-recipient"},
+			want: sendmailOptions{mode: "m", ignoreDots: true, recipients: []string{"-weird-recipient"}},
+		},
+	} {
+		got, err := parseSendmailArgs(tc.args, takesValue)
+		if err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q:\n got %+v\nwant %+v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestParseSendmailArgsErrors(t *testing.T) {
+	noLong := func(string) bool { return false }
+	if _, err := parseSendmailArgs([]string{"-bd"}, noLong); !errors.Is(err, ErrUnsupportedSendmailMode) {
+		t.Fatalf("-bd: err=%v want %v", err, ErrUnsupportedSendmailMode)
+	}
+	if _, err := parseSendmailArgs([]string{"-f"}, noLong); !errors.Is(err, ErrSendmailUsage) {
+		t.Fatalf("-f without a value: err=%v want %v", err, ErrSendmailUsage)
+	}
+}
+
+func TestDotTerminatedReader(t *testing.T) {
+	for in, want := range map[string]string{
+		"Subject: s\n\nbody\n.\nignored\n": "Subject: s\n\nbody\n",
+		"body\r\n.\r\nignored":             "body\r\n",
+		"body\n..\n.x\n":                   "body\n..\n.x\n",
+		"body\n.":                          "body\n",
+		"no newline":                       "no newline",
+	} {
+		got, err := io.ReadAll(newDotTerminatedReader(strings.NewReader(in)))
+		if err != nil || string(got) != want {
+			t.Errorf("%q: got %q (%v) want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestExtractHeaderRecipients(t *testing.T) {
+	in := "To: root, Ops <ops@example.com>\nBcc: audit@example.com,\n secret@example.com\nSubject: s\n\nBcc: not a header\n"
+	rcpts, message, err := extractHeaderRecipients(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"root", "ops@example.com", "audit@example.com", "secret@example.com"}
+	if !reflect.DeepEqual(rcpts, want) {
+		t.Fatalf("recipients=%q want %q", rcpts, want)
+	}
+	got, err := io.ReadAll(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "To: root, Ops <ops@example.com>\nSubject: s\n\nBcc: not a header\n" {
+		t.Fatalf("message=%q", got)
+	}
+}
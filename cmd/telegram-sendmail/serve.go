@@ -1,18 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"mime"
 	"net"
 	"net/http"
-	"net/mail"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/activation"
@@ -23,8 +32,8 @@ import (
 )
 
 // rfc2047Decoder decodes MIME encoded-words in mail headers (RFC 2047).
-// Safe for concurrent use with the default CharsetReader.
-var rfc2047Decoder = new(mime.WordDecoder)
+// charsetReader is stateless, so the decoder is safe for concurrent use.
+var rfc2047Decoder = &mime.WordDecoder{CharsetReader: charsetReader}
 
 const (
 	// acceptPollInterval is how long Accept waits before yielding so the serve
@@ -32,12 +41,27 @@ const (
 	acceptPollInterval = 1 * time.Second
 	// telegramHTTPTimeout bounds all Telegram Bot API HTTP calls.
 	telegramHTTPTimeout = 30 * time.Second
-	// queueRetryDelay backs off when every queued message fails to send.
+	// queueRetryDelay is the base delay before a failed message is retried.
+	// It doubles with every failed attempt, up to maxQueueRetryDelay.
 	queueRetryDelay = 5 * time.Second
+	// maxQueueRetryDelay caps the per-message backoff.
+	maxQueueRetryDelay = 1 * time.Hour
+	// maxQueuePassDuration ends a queue pass early so a rate-limited burst
+	// does not keep serve from accepting new submissions.
+	maxQueuePassDuration = 5 * time.Second
+	// telegramChatBurst is how many requests a quiet chat may get back to
+	// back before --telegram-chat-rate spacing applies.
+	telegramChatBurst = 3
 	// stateDirPerm is the permission for the on-disk queue directory.
 	stateDirPerm = 0o755
 	// queueFilePerm is the permission for individual queued message files.
 	queueFilePerm = 0o600
+	// queueTempPrefix starts the names of messages still being written to
+	// the state directory. Being dotfiles, they are never queue items.
+	queueTempPrefix = ".incoming."
+	// staleQueueTempAge is how old an incoming file must be for serve to
+	// treat it as left behind by a crash.
+	staleQueueTempAge = 1 * time.Hour
 
 	// Wire replies after the daemon has handled the payload. "OK" means the
 	// message reached the daemon and was written to the on-disk queue (not
@@ -46,80 +70,166 @@ const (
 	wireResponseOK            = "OK"
 	wireResponsePayloadTooBig = "Error: payload too big"
 	wireResponseSaveFailed    = "Error: internal error saving message"
+	wireResponseBadEnvelope   = "Error: malformed envelope"
+	wireResponseRateLimited   = "Error: rate limit exceeded"
+	wireResponseQueueFull     = "Error: queue full"
 )
 
 var httpClient = &http.Client{Timeout: telegramHTTPTimeout}
 
+// ErrNoListener is returned when serve was neither socket activated nor
+// given --listen or --smtp-listen.
+var ErrNoListener = errors.New("no systemd socket listeners found; use systemd socket activation, --listen or --smtp-listen")
+
+// ErrOpenRelay is returned for an SMTP listener other hosts can reach while
+// smtp_credentials is unset: anyone there could post to the chats.
+var ErrOpenRelay = errors.New("SMTP listener is reachable from other hosts without smtp_credentials")
+
+// ErrMissingCredentials is returned when the bot token or default chat is
+// not configured.
+var ErrMissingCredentials = errors.New("telegram token or chat ID not set")
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
-	Short: "Run the sendmail server (systemd activated)",
-	Run:   runServe,
+	Short: "Run the sendmail server (systemd activated, or a daemon with --listen)",
+	Long: `Run the sendmail server.
+
+Under systemd socket activation serve uses the passed socket and exits once
+the queue is empty. With --listen it opens the socket itself and stays
+resident, for containers and init systems without socket activation.
+
+With --smtp-listen (or a systemd socket with FileDescriptorName=smtp) serve
+also accepts mail over SMTP, for software that cannot run sendmail.`,
+	Run: runServe,
 }
 
 func init() {
+	flags := serveCmd.Flags()
+	flags.String("listen", "", "Listen on unix:/path or tcp:host:port and stay resident instead of using systemd socket activation")
+	flags.String("socket-mode", defaultListenSocketMode, "Octal permissions of the --listen Unix socket (e.g. 0660 to limit it to a group)")
+	flags.String("smtp-listen", "", "Also accept SMTP on tcp:host:port or unix:/path, e.g. tcp:127.0.0.1:2525 (implies staying resident)")
+	flags.String("smtp-credentials", "", "File of user:bcrypt-hash[:chat] lines (htpasswd -B); when set, SMTP clients must AUTH")
+	flags.String("smtp-tls-cert", "", "PEM certificate offered via STARTTLS; AUTH then requires TLS")
+	flags.String("smtp-tls-key", "", "PEM private key for --smtp-tls-cert")
+	mustBind(viper.BindPFlag("listen", flags.Lookup("listen")))
+	mustBind(viper.BindPFlag("smtp_listen", flags.Lookup("smtp-listen")))
+	mustBind(viper.BindPFlag("smtp_credentials", flags.Lookup("smtp-credentials")))
+	mustBind(viper.BindPFlag("smtp_tls_cert", flags.Lookup("smtp-tls-cert")))
+	mustBind(viper.BindPFlag("smtp_tls_key", flags.Lookup("smtp-tls-key")))
+	mustBind(viper.BindPFlag("socket_mode", flags.Lookup("socket-mode")))
 	rootCmd.AddCommand(serveCmd)
 }
 
 func runServe(cmd *cobra.Command, args []string) {
-	token := viper.GetString("telegram_token")
-	chat := viper.GetString("telegram_chat")
 	stateDir := viper.GetString("state_dir")
 	socketTimeout := viper.GetFloat64("socket_timeout")
 	maxPayloadSize := viper.GetInt64("max_payload_size")
+	limits := submissionLimits{
+		messagesPerMinute: viper.GetInt("rate_limit_messages"),
+		bytesPerHour:      viper.GetInt64("rate_limit_bytes"),
+		maxQueueFiles:     viper.GetInt("max_queue_files"),
+		maxQueueBytes:     viper.GetInt64("max_queue_bytes"),
+	}
 
-	if token == "" || chat == "" {
-		slog.Error("Telegram token or chat ID not set")
+	client, router, err := deliveryConfig()
+	if err == nil {
+		_, err = digestPolicyFromConfig()
+	}
+	if err == nil {
+		_, err = dedupPolicyFromConfig()
+	}
+	var smtpCreds *smtpCredentials
+	var smtpTLS *tls.Config
+	if err == nil {
+		smtpCreds, smtpTLS, err = smtpSecurityFromConfig()
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
 		os.Exit(1)
 	}
+	if smtpCreds != nil && smtpTLS == nil {
+		slog.Warn("SMTP AUTH without STARTTLS sends passwords in clear text; set smtp_tls_cert and smtp_tls_key unless the listener is local")
+	}
 
 	if err := os.MkdirAll(stateDir, stateDirPerm); err != nil {
 		utils.ReportError(err, "Failed to create state directory", "dir", stateDir)
 		os.Exit(1)
 	}
+	if err := removeStaleQueueTemps(stateDir, time.Now()); err != nil {
+		utils.ReportError(err, "Failed to clean up incomplete queue files", "dir", stateDir)
+	}
 
-	listeners, err := activation.Listeners()
+	listeners, resident, err := serveListeners()
 	if err != nil {
-		utils.ReportError(err, "Failed to get systemd listeners")
+		utils.ReportError(err, "Failed to open listener")
 		os.Exit(1)
 	}
-
-	if len(listeners) == 0 {
-		utils.ReportError(nil, "No systemd socket listeners found. This service requires systemd socket activation.")
+	defer closeListeners(listeners)
+	if err := checkSMTPExposure(listeners, smtpCreds); err != nil {
+		slog.Error("Refusing to start; listen on loopback or a Unix socket, or require AUTH", "error", err)
+		closeListeners(listeners)
 		os.Exit(1)
 	}
+	smtpCfg := smtpConfig{
+		hostname: viper.GetString("hostname"),
+		stateDir: stateDir,
+		timeout:  time.Duration(socketTimeout * float64(time.Second)),
+		session:  maxSMTPSessionDuration,
+		maxSize:  maxPayloadSize,
+		limits:   limits,
+		creds:    smtpCreds,
+		tls:      smtpTLS,
+	}
 
-	l := listeners[0]
-	defer l.Close()
-
-	slog.Info("Service started", "state_dir", stateDir)
+	// SIGTERM lets the current connection and queue pass finish, then
+	// returns so the listeners (and --listen socket files) are closed.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	client := telegram.NewClient(token, httpClient)
+	for _, l := range listeners {
+		slog.Info("Listening", "addr", l.Addr(), "smtp", l.smtp)
+	}
+	slog.Info("Service started", "state_dir", stateDir, "resident", resident)
 
-	for {
-		// Short Accept deadline so we can drain the queue and exit when idle.
-		if err := setListenerDeadline(l, time.Now().Add(acceptPollInterval)); err != nil {
-			utils.ReportError(err, "Failed to set accept deadline")
-		}
+	// Messages sendmail spooled while the socket was unavailable.
+	maildrop := viper.GetString("maildrop_dir")
 
-		conn, err := l.Accept()
-		if err != nil {
-			var opErr *net.OpError
-			if errors.As(err, &opErr) && opErr.Timeout() {
-				// Timeout, just proceed to queue processing
-			} else {
-				utils.ReportError(err, "Accept error")
+	// Listeners are polled in turn, each for a share of acceptPollInterval.
+	// Wire connections are short and handled inline; SMTP sessions may last
+	// minutes and run in the background, and serve neither goes idle nor
+	// exits while one is running.
+	var sessions smtpSessions
+	pollInterval := acceptPollInterval / time.Duration(len(listeners))
+	for ctx.Err() == nil {
+		for _, l := range listeners {
+			conn, err := l.acceptWithin(pollInterval)
+			if err != nil {
+				utils.ReportError(err, "Accept error", "addr", l.Addr())
 				// Transient accept failures: back off, then keep serving.
-				time.Sleep(acceptPollInterval)
+				time.Sleep(pollInterval)
+				continue
+			}
+			if conn == nil {
+				continue
+			}
+			if l.smtp {
+				sessions.start(conn, smtpCfg)
+			} else {
+				handleConnection(conn, stateDir, socketTimeout, maxPayloadSize, limits)
 			}
-		} else {
-			// Handle connection
-			handleConnection(conn, stateDir, socketTimeout, maxPayloadSize)
 		}
 
-		// Process Queue
-		empty, sentCount, errCount := processQueue(client, stateDir, chat)
+		maildrop = servePickup(maildrop, stateDir, maxPayloadSize)
 
-		if empty {
+		// Checked before the pass: a session that ends later may have queued
+		// a message the pass did not see.
+		idle := !sessions.busy()
+
+		// Process Queue. Failed messages wait out their own backoff, so new
+		// messages still go out on the next pass.
+		empty, _, errCount := processQueue(client, stateDir, router, false)
+
+		if empty && idle && !resident {
 			// Queue is empty. If we didn't just handle a connection (which we might have), we are idle.
 			// But wait, if we just handled a connection, we added to the queue, so processQueue should have seen it.
 			// So if processQueue says empty, it means we really have nothing to do.
@@ -127,13 +237,133 @@ func runServe(cmd *cobra.Command, args []string) {
 			os.Exit(0)
 		}
 
-		if errCount > 0 && sentCount == 0 {
-			// We failed to send anything, probably network issue.
-			// Sleep a bit to avoid busy loop; delay tracks queueRetryDelay.
-			slog.Warn("Failed to process queue, will retry", "delay", queueRetryDelay)
-			time.Sleep(queueRetryDelay)
+		if errCount > 0 {
+			slog.Warn("Some messages failed to send, will retry with backoff", "failed", errCount)
+		}
+	}
+	slog.Info("Shutting down", "reason", context.Cause(ctx))
+	if sessions.busy() {
+		slog.Info("Waiting for SMTP sessions to end")
+	}
+	sessions.wait()
+}
+
+// serveListener is a socket serve accepts submissions on. smtp is set for
+// sockets speaking SMTP instead of the sendmail wire protocol.
+type serveListener struct {
+	net.Listener
+	smtp bool
+}
+
+// serveListeners returns the sockets passed by systemd plus those opened for
+// --listen and --smtp-listen. A systemd socket named "smtp"
+// (FileDescriptorName=smtp) speaks SMTP. resident is true when serve opened
+// a socket itself: nothing would start serve again, so it must not exit
+// when the queue is empty.
+func serveListeners() (listeners []serveListener, resident bool, err error) {
+	named, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, false, fmt.Errorf("get systemd listeners: %w", err)
+	}
+	names := slices.Sorted(maps.Keys(named))
+	for _, name := range names {
+		for _, l := range named[name] {
+			listeners = append(listeners, serveListener{Listener: l, smtp: name == smtpSocketName})
+		}
+	}
+
+	mode, err := parseSocketMode(viper.GetString("socket_mode"))
+	for _, opt := range []struct {
+		key  string
+		smtp bool
+	}{{"listen", false}, {"smtp_listen", true}} {
+		spec := viper.GetString(opt.key)
+		if spec == "" {
+			continue
+		}
+		resident = true
+		var l net.Listener
+		if err == nil {
+			l, err = listenAddress(spec, mode)
+		}
+		if err != nil {
+			closeListeners(listeners)
+			return nil, true, err
+		}
+		listeners = append(listeners, serveListener{Listener: l, smtp: opt.smtp})
+	}
+	if len(listeners) == 0 {
+		return nil, false, ErrNoListener
+	}
+	return listeners, resident, nil
+}
+
+// checkSMTPExposure refuses SMTP listeners on anything but loopback TCP or a
+// Unix socket unless clients must AUTH.
+func checkSMTPExposure(listeners []serveListener, creds *smtpCredentials) error {
+	if creds != nil {
+		return nil
+	}
+	for _, l := range listeners {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if l.smtp && ok && !addr.IP.IsLoopback() {
+			return fmt.Errorf("%w: %s", ErrOpenRelay, addr)
 		}
 	}
+	return nil
+}
+
+func closeListeners(listeners []serveListener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// acceptWithin waits up to d for a connection. It returns a nil conn and
+// error when none arrived in time.
+func (l serveListener) acceptWithin(d time.Duration) (net.Conn, error) {
+	// The deadline goes on the embedded listener: setListenerDeadline does
+	// not see through the wrapper.
+	if err := setListenerDeadline(l.Listener, time.Now().Add(d)); err != nil {
+		utils.ReportError(err, "Failed to set accept deadline")
+	}
+	conn, err := l.Accept()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		return nil, nil
+	}
+	return conn, err
+}
+
+// deliveryConfig builds the Telegram client and chat router from the
+// configuration shared by serve and `queue flush`, with the chat migrations
+// recorded in state_dir applied.
+func deliveryConfig() (*telegram.Client, chatRouter, error) {
+	token := viper.GetString("telegram_token")
+	chat := viper.GetString("telegram_chat")
+	if token == "" || chat == "" {
+		return nil, chatRouter{}, ErrMissingCredentials
+	}
+
+	routes, err := parseRoutes(viper.GetStringSlice("telegram_routes"))
+	if err != nil {
+		return nil, chatRouter{}, fmt.Errorf("invalid Telegram route: %w", err)
+	}
+	router := chatRouter{defaultChat: chat, routes: routes}
+	if err := router.validate(); err != nil {
+		return nil, chatRouter{}, fmt.Errorf("invalid Telegram chat: %w", err)
+	}
+	client := telegram.NewClient(token, httpClient)
+	client.Limiter = telegram.NewRateLimiter(
+		telegram.Rate{Events: viper.GetInt("telegram_chat_rate"), Per: time.Minute, Burst: telegramChatBurst},
+		telegram.Rate{Events: viper.GetInt("telegram_global_rate"), Per: time.Second, Burst: viper.GetInt("telegram_global_rate")},
+		nil,
+	)
+	stateDir := viper.GetString("state_dir")
+	if err := applyChatMigrations(client, stateDir); err != nil {
+		utils.ReportError(err, "Failed to load chat migrations", "dir", stateDir)
+	}
+	return client, router, nil
 }
 
 // setListenerDeadline sets a deadline on TCP or Unix listeners used for Accept.
@@ -150,122 +380,547 @@ func setListenerDeadline(l net.Listener, deadline time.Time) error {
 }
 
 // writeWireResponse sends a single wire status line to the client and reports
-// write failures. handleConnection has three status exits that share this path.
+// write failures. handleConnection has several status exits that share this path.
 func writeWireResponse(conn net.Conn, response string) {
 	if _, err := conn.Write([]byte(response)); err != nil {
 		utils.ReportError(err, "Failed to write wire response", "response", response)
 	}
 }
 
-func handleConnection(conn net.Conn, stateDir string, timeout float64, maxSize int64) {
+func handleConnection(conn net.Conn, stateDir string, timeout float64, maxSize int64, limits submissionLimits) {
 	defer conn.Close()
 	if err := conn.SetDeadline(time.Now().Add(time.Duration(timeout * float64(time.Second)))); err != nil {
 		utils.ReportError(err, "Failed to set connection deadline")
 		return
 	}
 
-	// Read all data
-	// We use a limited reader to prevent DoS
-	data, err := io.ReadAll(io.LimitReader(conn, maxSize+1))
+	// Capture the submitter before reading: the socket is world-writable, so
+	// this is the only trustworthy record of who queued the message. The
+	// client may exit as soon as it gets its reply, so resolve names now.
+	peer, err := peerCredentials(conn)
 	if err != nil {
-		utils.ReportError(err, "Failed to read from connection")
+		slog.Debug("No peer credentials for connection", "error", err)
+	}
+
+	// The sendmail client sends an envelope ahead of the message; netcat-style
+	// clients send a bare message. Only client-settable fields are kept.
+	r := bufio.NewReader(conn)
+	env, ok, err := readEnvelope(r)
+	if err != nil {
+		slog.Warn("Rejecting malformed envelope", "error", err)
+		writeWireResponse(conn, wireResponseBadEnvelope)
 		return
 	}
+	if ok {
+		env = env.clientFields()
+	}
 
-	if int64(len(data)) > maxSize {
-		slog.Warn("Payload too big", "size", len(data))
-		writeWireResponse(conn, wireResponsePayloadTooBig)
+	if _, err := r.Peek(1); errors.Is(err, io.EOF) {
 		return
 	}
 
-	if len(data) == 0 {
+	env.peer = peer
+	response, err := receiveMessage(stateDir, env, r, maxSize, limits)
+	if err != nil {
+		utils.ReportError(err, "Failed to read from connection")
 		return
 	}
+	writeWireResponse(conn, response)
+}
 
-	// Save to file
-	timestamp := time.Now().UnixNano()
-	fname := filepath.Join(stateDir, fmt.Sprintf("%d", timestamp))
-	if err := os.WriteFile(fname, data, queueFilePerm); err != nil {
+// receiveMessage streams a submitted payload into the state directory and
+// queues it through enqueueMessage. It returns the wire response for the
+// submitter, or an error when reading the payload failed and there is
+// nobody left to answer.
+func receiveMessage(stateDir string, env envelope, payload io.Reader, maxSize int64, limits submissionLimits) (string, error) {
+	msg, err := stageMessage(stateDir, env, payload, maxSize)
+	switch {
+	case errors.Is(err, ErrPayloadTooBig):
+		slog.Warn("Payload too big", "max_size", maxSize, "peer", submitterKey(env.peer, env.authUser))
+		return wireResponsePayloadTooBig, nil
+	case errors.Is(err, errReadPayload):
+		return "", err
+	case err != nil:
+		utils.ReportError(err, "Failed to write to queue", "dir", stateDir)
+		return wireResponseSaveFailed, nil
+	}
+	return enqueueMessage(stateDir, msg, limits), nil
+}
+
+// enqueueMu makes checking the queue caps and rate limits and committing
+// one step: SMTP sessions submit concurrently.
+var enqueueMu sync.Mutex
+
+// enqueueMessage applies the queue caps and per-submitter limits to a
+// staged message and commits it to the queue, or discards it. It returns
+// the wire response for the submitter; SMTP sessions map it to a reply code.
+func enqueueMessage(stateDir string, msg *stagedMessage, limits submissionLimits) string {
+	enqueueMu.Lock()
+	defer enqueueMu.Unlock()
+	key := submitterKey(msg.env.peer, msg.env.authUser)
+	// Queue caps first: a rejected message must not use up rate limit budget.
+	room, err := queueHasRoom(stateDir, msg.size, limits)
+	if err != nil {
+		msg.discard()
+		utils.ReportError(err, "Failed to measure queue size", "dir", stateDir)
+		return wireResponseSaveFailed
+	}
+	if !room {
+		msg.discard()
+		slog.Warn("Queue full, rejecting message", "size", msg.size, "peer", key)
+		return wireResponseQueueFull
+	}
+	allowed, err := allowSubmission(stateDir, key, msg.size, limits, time.Now())
+	if err != nil {
+		utils.ReportError(err, "Failed to update rate limit state", "dir", stateDir)
+	}
+	if !allowed {
+		msg.discard()
+		slog.Warn("Rate limit exceeded, rejecting message", "size", msg.size, "peer", key)
+		return wireResponseRateLimited
+	}
+
+	if fname, err := msg.commit(); err != nil {
 		utils.ReportError(err, "Failed to write to queue", "file", fname)
-		writeWireResponse(conn, wireResponseSaveFailed)
-		return
+		return wireResponseSaveFailed
 	}
+	return wireResponseOK
+}
 
-	writeWireResponse(conn, wireResponseOK)
+// errReadPayload marks a stageMessage failure on the submitter's side of
+// the copy (a dropped or timed out connection), not the disk's.
+var errReadPayload = errors.New("read payload")
+
+// stagedMessage is a message written to a temporary file in the state
+// directory. The name starts with a dot, so the queue and its size caps
+// ignore it until commit renames it into place.
+type stagedMessage struct {
+	env  envelope
+	tmp  string
+	name string
+	// size is the payload size, without the envelope.
+	size int64
 }
 
-func processQueue(client *telegram.Client, stateDir, chat string) (empty bool, sentCount int, errCount int) {
+// stageMessage stamps env as received now and streams it with payload into
+// a temporary file in stateDir, synced to disk. A payload over maxSize is
+// refused with ErrPayloadTooBig once maxSize bytes were read, so a message
+// is never held in memory whatever its size.
+func stageMessage(stateDir string, env envelope, payload io.Reader, maxSize int64) (msg *stagedMessage, err error) {
+	env.received = time.Now()
+	// The file is created 0600, which is queueFilePerm.
+	name := newQueueID(env.received)
+	f, err := os.CreateTemp(stateDir, queueTempPrefix+name+".")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(env.header()); err != nil {
+		return nil, err
+	}
+	src := &payloadReader{r: io.LimitReader(payload, maxSize+1)}
+	n, err := io.Copy(f, src)
+	if src.err != nil {
+		return nil, fmt.Errorf("%w: %w", errReadPayload, src.err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, ErrPayloadTooBig
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &stagedMessage{env: env, tmp: f.Name(), name: filepath.Join(stateDir, name), size: n}, nil
+}
+
+// commit renames the staged file into the queue and returns its path. The
+// rename is synced too: "OK" on the wire promises the message survives a
+// crash, so a commit that cannot promise it takes the file back out.
+func (m *stagedMessage) commit() (string, error) {
+	if err := os.Rename(m.tmp, m.name); err != nil {
+		m.discard()
+		return m.name, err
+	}
+	if err := syncDir(filepath.Dir(m.name)); err != nil {
+		if rmErr := os.Remove(m.name); rmErr != nil {
+			utils.ReportError(rmErr, "Failed to remove unsynced queue file", "file", m.name)
+		}
+		return m.name, err
+	}
+	return m.name, nil
+}
+
+// discard removes the staged file.
+func (m *stagedMessage) discard() {
+	if err := os.Remove(m.tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		utils.ReportError(err, "Failed to remove staged message", "file", m.tmp)
+	}
+}
+
+// syncDir flushes dir's entries, making a rename into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// removeStaleQueueTemps removes staged messages left behind by a crash. A
+// file younger than staleQueueTempAge may still be written by another
+// process (a concurrent `queue pickup`) and is kept.
+func removeStaleQueueTemps(stateDir string, now time.Time) error {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), queueTempPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) < staleQueueTempAge {
+			continue
+		}
+		path := filepath.Join(stateDir, entry.Name())
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		slog.Info("Removed incomplete queue file", "file", path)
+	}
+	return nil
+}
+
+// payloadReader remembers the error its reader failed with, so stageMessage
+// can tell a failed read from a failed write after io.Copy.
+type payloadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && !errors.Is(err, io.EOF) {
+		p.err = err
+	}
+	return n, err
+}
+
+// writeQueueFile stages env with payload and commits it to the queue right
+// away, for messages that were accepted elsewhere. It returns the file's
+// path.
+func writeQueueFile(stateDir string, env envelope, payload io.Reader, maxSize int64) (string, error) {
+	msg, err := stageMessage(stateDir, env, payload, maxSize)
+	if err != nil {
+		return "", err
+	}
+	return msg.commit()
+}
+
+// processQueue tries every queued message once, oldest first. Messages whose
+// backoff has not elapsed are skipped (but keep the queue non-empty), and a
+// pass stops after maxQueuePassDuration, unless force is set, as for `queue
+// flush`. Telegram flood control pauses the whole queue, forced or not.
+func processQueue(client *telegram.Client, stateDir string, router chatRouter, force bool) (empty bool, sentCount int, errCount int) {
 	entries, err := os.ReadDir(stateDir)
 	if err != nil {
 		utils.ReportError(err, "Failed to read state directory")
 		return false, 0, 1
 	}
 
+	entries = slices.DeleteFunc(entries, func(e fs.DirEntry) bool { return !isQueueEntry(e) })
+
+	now := time.Now()
+	paused, err := queuePausedUntil(stateDir)
+	if err != nil {
+		utils.ReportError(err, "Failed to read flood control state", "dir", stateDir)
+	}
+	if now.Before(paused) {
+		slog.Debug("Queue paused by Telegram flood control", "until", paused)
+		return len(entries) == 0, 0, 0
+	}
+
+	// Follow-ups for ended repeat windows. Pending ones do not keep serve up.
+	dedup, err := dedupPolicyFromConfig()
+	dedupOn := err == nil && dedup.window > 0
+	if dedupOn {
+		err := dedup.reportRepeats(client, stateDir, now)
+		if wait, ok := telegram.RetryAfter(err); ok {
+			pauseForFloodControl(stateDir, wait)
+			return false, 0, 1
+		}
+		if err != nil {
+			utils.ReportError(err, "Failed to report repeated messages", "dir", stateDir)
+			errCount++
+		}
+	}
 	if len(entries) == 0 {
-		return true, 0, 0
+		return errCount == 0, 0, errCount
 	}
 
-	// Sort by name (timestamp)
+	// Sort by name (ULIDs and legacy timestamps sort by receive time)
 	sort.Slice(entries, func(i, j int) bool {
 		return entries[i].Name() < entries[j].Name()
 	})
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	busy, waiting := 0, 0
+	digest, err := digestPolicyFromConfig()
+	if err != nil {
+		utils.ReportError(err, "Invalid digest configuration, sending messages one by one")
+	}
+	var held map[string]bool
+	if digest.window > 0 {
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.Name()
+		}
+		res := processDigests(client, stateDir, router, digest, ids, now, force)
+		if res.floodRetryWait > 0 {
+			pauseForFloodControl(stateDir, res.floodRetryWait)
+			return false, res.sent, res.failed
 		}
+		held, sentCount, errCount, waiting = res.handled, res.sent, res.failed, res.waiting
+	}
 
+	for i, entry := range entries {
+		if held[entry.Name()] {
+			continue
+		}
+		if !force && time.Since(now) > maxQueuePassDuration {
+			// The rest waits for the next pass, after serve polls for submissions.
+			waiting += len(entries) - i
+			break
+		}
 		fpath := filepath.Join(stateDir, entry.Name())
-		content, err := os.ReadFile(fpath)
+		if !force && !retryDue(stateDir, entry.Name(), now) {
+			waiting++
+			continue
+		}
+		lock, err := lockQueueFile(fpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed by a queue command (or delivered by `queue flush`) since ReadDir.
+			continue
+		}
+		if errors.Is(err, ErrQueueFileBusy) {
+			// A queue command is working on it; look again next pass.
+			busy++
+			continue
+		}
 		if err != nil {
-			utils.ReportError(err, "Failed to read message file", "file", fpath)
-			if err := os.Remove(fpath); err != nil {
-				utils.ReportError(err, "Failed to remove corrupted file", "file", fpath)
-			}
+			utils.ReportError(err, "Failed to lock message file", "file", fpath)
+			errCount++
 			continue
 		}
 
-		if err := sendTelegram(client, chat, content); err != nil {
+		sent, err := deliverQueueFile(client, stateDir, entry.Name(), router, lock)
+		if closeErr := lock.Close(); closeErr != nil {
+			utils.ReportError(closeErr, "Failed to unlock message file", "file", fpath)
+		}
+		if wait, ok := telegram.RetryAfter(err); ok {
+			// Every further request would be refused too; stop the pass.
+			pauseForFloodControl(stateDir, wait)
+			return false, sentCount, errCount + 1
+		}
+		if err != nil {
 			utils.ReportError(err, "Failed to send message", "file", fpath)
 			errCount++
 			// Keep the failed item in the queue and continue with the next one.
 			// This preserves retry behavior while preventing one bad delivery from blocking later items.
 			continue
 		}
+		if sent {
+			slog.Info("Message sent", "file", fpath)
+			sentCount++
+		}
+	}
+
+	if errCount > 0 || busy > 0 || waiting > 0 {
+		return false, sentCount, errCount
+	}
+	return true, sentCount, errCount
+}
+
+// pauseForFloodControl holds the whole queue for the wait Telegram asked for.
+func pauseForFloodControl(stateDir string, wait time.Duration) {
+	slog.Warn("Telegram flood control, pausing queue", "retry_after", wait)
+	if err := pauseQueue(stateDir, time.Now().Add(wait)); err != nil {
+		utils.ReportError(err, "Failed to record flood control pause", "dir", stateDir)
+	}
+}
+
+// retryDue reports whether id's backoff has elapsed. The status is read
+// without the lock: it is replaced atomically, and a stale read only shifts
+// the attempt by one pass. An unreadable status does not hold a message back.
+func retryDue(stateDir, id string, now time.Time) bool {
+	status, err := loadQueueStatus(stateDir, id)
+	return err != nil || !now.Before(status.NextAttempt)
+}
+
+// deliverQueueFile sends one locked queue file and removes it on success.
+// Failures are recorded in the message's status file for `queue show`, and
+// messages the retry policy gives up on move to the dead-letter directory.
+// Repeats of a recently sent message are counted and removed unsent. sent is
+// false without an error when the file was dropped, suppressed or
+// dead-lettered.
+func deliverQueueFile(client *telegram.Client, stateDir, id string, router chatRouter, lock *queueLock) (sent bool, err error) {
+	fpath := filepath.Join(stateDir, id)
+	// Files without an envelope predate it and are delivered as-is. The
+	// payload is streamed from the locked file, never loaded whole.
+	env, payload, err := lock.message()
+	if err != nil {
+		// Likely written by a newer build; keep it for that build to send.
+		return false, fmt.Errorf("read message envelope: %w", err)
+	}
+
+	dedup, err := dedupPolicyFromConfig()
+	if err != nil {
+		utils.ReportError(err, "Invalid duplicate suppression configuration, delivering every message")
+	}
+	var dedupMsg dedupMessage
+	if dedup.window > 0 {
+		var suppressed bool
+		if dedupMsg, suppressed = dedup.check(stateDir, router, env, payload, time.Now()); suppressed {
+			slog.Info("Suppressed repeated message", "file", fpath, "subject", dedupMsg.subject)
+			if err := removeQueueFile(stateDir, id); err != nil {
+				utils.ReportError(err, "Failed to remove suppressed file", "file", fpath)
+			}
+			return false, nil
+		}
+	}
 
-		// Success
-		slog.Info("Message sent", "file", fpath)
-		if err := os.Remove(fpath); err != nil {
-			utils.ReportError(err, "Failed to remove sent file", "file", fpath)
+	if err := deliverMessage(client, router, env, payload); err != nil {
+		if _, ok := telegram.RetryAfter(err); ok {
+			// Flood control is not the message's fault: no attempt or backoff
+			// is charged; processQueue pauses the whole queue instead.
+			return false, err
+		}
+		now := time.Now()
+		status, statusErr := recordFailedAttempt(stateDir, id, now, err)
+		if statusErr != nil {
+			utils.ReportError(statusErr, "Failed to record delivery attempt", "file", fpath)
+		}
+		enqueued := now
+		if info, statErr := lock.f.Stat(); statErr == nil {
+			enqueued = enqueueTime(id, env, info.ModTime())
 		}
-		sentCount++
+		reason := retryPolicyFromConfig().deadLetterReason(err, status, enqueued, now)
+		if reason == "" {
+			return false, err
+		}
+		if moveErr := moveToDeadLetter(stateDir, id, status, reason, now); moveErr != nil {
+			utils.ReportError(moveErr, "Failed to move message to dead-letter directory", "file", fpath)
+			return false, err
+		}
+		// Not counted as a failure: the message is out of the queue, so serve
+		// can go idle. Still reported so the operator hears about it.
+		utils.ReportError(err, "Message moved to dead-letter directory", "file", fpath, "reason", reason)
+		return false, nil
 	}
 
-	return errCount == 0, sentCount, errCount
+	if err := removeQueueFile(stateDir, id); err != nil {
+		utils.ReportError(err, "Failed to remove sent file", "file", fpath)
+	}
+	if dedup.window > 0 {
+		if err := recordDelivered(stateDir, dedupMsg, time.Now()); err != nil {
+			utils.ReportError(err, "Failed to record delivered message for duplicate suppression", "dir", stateDir)
+		}
+	}
+	return true, nil
+}
+
+// parsedMail is the Telegram-facing view of a queued message.
+type parsedMail struct {
+	subject string
+	body    string
+	// html is true when body is Telegram HTML (converted from a text/html
+	// part) rather than plain text.
+	html bool
+	// long is set for a plain text body over maxInlineBody: body then holds
+	// only its start, and delivery streams the whole body from long.
+	long        *mimeLeaf
+	attachments []mailAttachment
 }
 
-// parseMailMessage extracts Subject and body from an RFC 822 message using
-// net/mail (case-insensitive headers). On parse failure the whole payload is
+// parseMailMessage extracts Subject and body from an RFC 822 message
+// (case-insensitive headers). On parse failure the whole payload is
 // treated as the body so sendmail callers are not bricked by malformed input.
+// Parts are read from payload as they are needed, not loaded whole.
 // Subject values are RFC 2047-decoded so encoded-words from real MTAs show as
 // plain text in Telegram headings instead of raw =?UTF-8?...?= form.
-func parseMailMessage(data []byte, defaultSubject string) (subject, body string) {
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+//
+// MIME bodies are walked and the text/plain part is preferred; a text/html
+// part is converted to Telegram HTML when it is the only alternative. Transfer
+// encodings are removed and the declared charset is converted to UTF-8.
+// Remaining named or non-text parts are returned as attachments.
+func parseMailMessage(payload *io.SectionReader, defaultSubject string) parsedMail {
+	parsed := parsedMail{subject: defaultSubject}
+	header, body, err := readMIMEHeader(payload)
 	if err != nil {
-		return defaultSubject, string(data)
+		parsed.setBody(mimeLeaf{mediaType: defaultMediaType, content: newMIMEContent(payload, "")})
+		return parsed
 	}
+	parsed.subject = mailSubject(header, defaultSubject)
 
-	subject = defaultSubject
-	if s := msg.Header.Get("Subject"); s != "" {
-		subject = decodeMIMEHeader(s)
+	leaves, err := walkMIME(header, body)
+	if len(leaves) == 0 {
+		// Broken multipart framing: show the raw body rather than nothing.
+		slog.Warn("Failed to parse MIME body, sending raw", "error", err)
+		parsed.setBody(mimeLeaf{mediaType: defaultMediaType, content: newMIMEContent(body, "")})
+		return parsed
+	}
+	bodyIdx := selectBodyLeaf(leaves)
+	if bodyIdx >= 0 {
+		parsed.setBody(leaves[bodyIdx])
 	}
+	parsed.attachments = collectAttachments(leaves, bodyIdx)
+	return parsed
+}
 
-	b, err := io.ReadAll(msg.Body)
+// setBody makes leaf the message body. HTML is read whole to be converted;
+// plain text only up to maxInlineBody.
+func (p *parsedMail) setBody(leaf mimeLeaf) {
+	r := leaf.content.open()
+	if leaf.mediaType != "text/html" {
+		r = io.LimitReader(r, maxInlineBody)
+	}
+	raw, err := io.ReadAll(r)
 	if err != nil {
-		// bytes.Reader should not fail; fall back so delivery still works.
-		return defaultSubject, string(data)
+		slog.Warn("Failed to read message body", "error", err)
+	}
+	p.body = decodeCharset(raw, leaf.charset)
+	switch {
+	case leaf.mediaType == "text/html":
+		p.body = telegram.FormatHTML(p.body)
+		p.html = true
+	case leaf.content.size > maxInlineBody:
+		p.long = &leaf
 	}
-	return subject, string(b)
+}
+
+// mailSubject is the message's decoded Subject, or defaultSubject without
+// one.
+func mailSubject(header headerGetter, defaultSubject string) string {
+	if s := header.Get("Subject"); s != "" {
+		return decodeMIMEHeader(s)
+	}
+	return defaultSubject
 }
 
 // decodeMIMEHeader decodes RFC 2047 encoded-words in a header field value.
@@ -278,8 +933,103 @@ func decodeMIMEHeader(value string) string {
 	return decoded
 }
 
-func sendTelegram(client *telegram.Client, chat string, data []byte) error {
-	subject, message := parseMailMessage(data, viper.GetString("default_subject"))
-	hostname := viper.GetString("hostname")
-	return client.Send(chat, subject, message, hostname)
+// messageChats returns the chats a message routes to, from its envelope
+// recipients and To/Cc/Bcc headers. Messages from an SMTP account pinned to
+// a chat go only there.
+func messageChats(router chatRouter, env envelope, payload *io.SectionReader) []string {
+	if env.chat != "" {
+		return []string{env.chat}
+	}
+	header := io.NewSectionReader(payload, 0, payload.Size())
+	return router.chatsFor(append(slices.Clone(env.recipients), headerRecipients(header)...))
+}
+
+// deliverMessage sends a queued payload to every chat its recipients route
+// to. Recipients are the envelope's (sendmail positional arguments) plus the
+// To/Cc/Bcc headers. A failure part-way through a fan-out fails the whole
+// item, so chats that already got the message see it again on retry.
+func deliverMessage(client *telegram.Client, router chatRouter, env envelope, payload *io.SectionReader) error {
+	for _, chat := range messageChats(router, env, payload) {
+		if err := sendTelegram(client, chat, env, payload); err != nil {
+			return fmt.Errorf("chat %s: %w", chat, err)
+		}
+	}
+	return nil
+}
+
+// headingSource is the "#host" part of the Telegram heading. With showSender
+// and a known peer it becomes "host (cron as backup)", or "host (grafana)"
+// for mail from an SMTP account; a sendmail -F name is put in front, as in
+// "host (Nightly backup, cron as backup)".
+func headingSource(hostname string, env envelope, showSender bool) string {
+	if !showSender {
+		return hostname
+	}
+	var parts []string
+	if env.senderName != "" {
+		parts = append(parts, env.senderName)
+	}
+	switch {
+	case env.authUser != "":
+		parts = append(parts, env.authUser)
+	case env.peer != nil:
+		parts = append(parts, env.peer.origin())
+	}
+	if len(parts) == 0 {
+		return hostname
+	}
+	return fmt.Sprintf("%s (%s)", hostname, strings.Join(parts, ", "))
+}
+
+// sendTelegram delivers the message text, then uploads each attachment as a
+// reply to it. Attachments over maxAttachmentSize are listed in the body
+// instead of uploaded. Long bodies and attachments are streamed from
+// payload.
+func sendTelegram(client *telegram.Client, chat string, env envelope, payload *io.SectionReader) error {
+	parsed := parseMailMessage(payload, viper.GetString("default_subject"))
+	hostname := headingSource(viper.GetString("hostname"), env, viper.GetBool("show_sender"))
+	maxAttachmentSize := min(viper.GetInt64("max_attachment_size"), telegram.MaxUploadSize)
+
+	var notes string
+	var uploads []mailAttachment
+	for _, a := range parsed.attachments {
+		if a.content.size > maxAttachmentSize {
+			slog.Warn("Attachment too big, skipping", "filename", a.filename, "size", a.content.size)
+			note := fmt.Sprintf("[attachment %s (%d bytes) not forwarded: over the %d byte limit]", a.filename, a.content.size, maxAttachmentSize)
+			if parsed.html {
+				note = html.EscapeString(note)
+			}
+			notes += "\n" + note
+			continue
+		}
+		uploads = append(uploads, a)
+	}
+
+	var messageID int64
+	var err error
+	if long := parsed.long; long != nil {
+		body := telegram.File{
+			Name: "data.txt",
+			Size: long.content.size + int64(len(notes)),
+			Open: func() io.Reader { return io.MultiReader(long.text(), strings.NewReader(notes)) },
+		}
+		messageID, err = client.SendLong(chat, parsed.subject, body, hostname)
+	} else {
+		send := client.Send
+		if parsed.html {
+			send = client.SendHTML
+		}
+		messageID, err = send(chat, parsed.subject, parsed.body+notes, hostname)
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range uploads {
+		// The main message is already in the chat: failing the queue item here
+		// would re-send it on retry, so attachment errors are only reported.
+		if _, err := client.SendAttachment(chat, messageID, a.content.file(a.filename, a.contentType)); err != nil {
+			utils.ReportError(err, "Failed to send attachment", "filename", a.filename)
+		}
+	}
+	return nil
 }
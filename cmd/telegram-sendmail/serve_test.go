@@ -1,15 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"io"
 	"io/fs"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/lucasew/telegram-sendmail/internal/telegram"
@@ -40,6 +48,72 @@ func TestSetListenerDeadlineUnix(t *testing.T) {
 	}
 }
 
+func TestServeListenersAcceptWithin(t *testing.T) {
+	defer viper.Set("smtp_listen", "")
+	viper.Set("smtp_listen", "tcp:127.0.0.1:0")
+	listeners, resident, err := serveListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != 1 || !listeners[0].smtp || !resident {
+		t.Fatalf("listeners=%+v resident=%v, want one resident SMTP listener", listeners, resident)
+	}
+	l := listeners[0]
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.acceptWithin(50 * time.Millisecond)
+		if conn != nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("idle acceptWithin: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acceptWithin blocked past its deadline")
+	}
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.acceptWithin(5 * time.Second)
+	if err != nil || conn == nil {
+		t.Fatalf("acceptWithin with a waiting client: conn=%v err=%v", conn, err)
+	}
+	conn.Close()
+}
+
+func TestCheckSMTPExposure(t *testing.T) {
+	listen := func(addr string, smtp bool) serveListener {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return serveListener{Listener: l, smtp: smtp}
+	}
+	local := listen("127.0.0.1:0", true)
+	public := listen("0.0.0.0:0", true)
+	wire := listen("0.0.0.0:0", false)
+
+	if err := checkSMTPExposure([]serveListener{local, wire}, nil); err != nil {
+		t.Fatalf("loopback SMTP and a public wire listener: %v", err)
+	}
+	if err := checkSMTPExposure([]serveListener{local, public}, nil); !errors.Is(err, ErrOpenRelay) {
+		t.Fatalf("public SMTP without AUTH: got %v, want ErrOpenRelay", err)
+	}
+	if err := checkSMTPExposure([]serveListener{public}, &smtpCredentials{}); err != nil {
+		t.Fatalf("public SMTP with AUTH: %v", err)
+	}
+}
+
 func TestParseMailMessage(t *testing.T) {
 	const defaultSubject = "Message"
 
@@ -107,12 +181,12 @@ func TestParseMailMessage(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotSubject, gotBody := parseMailMessage([]byte(tt.data), defaultSubject)
-			if gotSubject != tt.wantSubject {
-				t.Errorf("subject: got %q, want %q", gotSubject, tt.wantSubject)
+			got := parseMailMessage(byteSection([]byte(tt.data)), defaultSubject)
+			if got.subject != tt.wantSubject {
+				t.Errorf("subject: got %q, want %q", got.subject, tt.wantSubject)
 			}
-			if gotBody != tt.wantBody {
-				t.Errorf("body: got %q, want %q", gotBody, tt.wantBody)
+			if got.body != tt.wantBody {
+				t.Errorf("body: got %q, want %q", got.body, tt.wantBody)
 			}
 		})
 	}
@@ -155,7 +229,7 @@ func TestProcessQueueContinuesAfterSendFailure(t *testing.T) {
 	client := telegram.NewClient("TOKEN", ts.Client())
 	client.APIBaseURL = ts.URL + "/bot%s"
 
-	empty, sentCount, errCount := processQueue(client, tempDir, "123")
+	empty, sentCount, errCount := processQueue(client, tempDir, chatRouter{defaultChat: "123"}, false)
 	if empty {
 		t.Fatalf("expected queue to remain non-empty because failed item is kept for retry")
 	}
@@ -172,6 +246,82 @@ func TestProcessQueueContinuesAfterSendFailure(t *testing.T) {
 	if _, err := os.Stat(secondFile); !errors.Is(err, fs.ErrNotExist) {
 		t.Fatalf("expected successful file to be removed, got err=%v", err)
 	}
+	status, err := loadQueueStatus(tempDir, "001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Attempts != 1 || !strings.Contains(status.LastError, "boom") || len(status.RecentHistory) != 1 {
+		t.Fatalf("failed attempt not recorded: %+v", status)
+	}
+}
+
+func TestProcessQueueWaitsForBackoff(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, id := range []string{"001", "002"} {
+		if err := os.WriteFile(filepath.Join(tempDir, id), []byte("Subject: "+id+"\n\nbody"), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 001 failed a moment ago and is backing off; 002 is new.
+	if _, err := recordFailedAttempt(tempDir, "001", time.Now(), errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		sent = append(sent, r.FormValue("text"))
+		if _, err := w.Write([]byte(`{"ok":true}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	empty, sentCount, errCount := processQueue(client, tempDir, chatRouter{defaultChat: "123"}, false)
+	if empty || sentCount != 1 || errCount != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d, want 002 sent and 001 waiting", empty, sentCount, errCount)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "002") {
+		t.Fatalf("sent=%q, want only 002", sent)
+	}
+
+	// flush ignores the backoff.
+	empty, sentCount, _ = processQueue(client, tempDir, chatRouter{defaultChat: "123"}, true)
+	if !empty || sentCount != 1 {
+		t.Fatalf("forced pass empty=%v sent=%d", empty, sentCount)
+	}
+}
+
+func TestProcessQueueSkipsLockedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "001")
+	if err := os.WriteFile(path, []byte("Subject: locked\n\nbody"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockQueueFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("locked message was sent: %s", r.URL.Path)
+	}))
+	defer ts.Close()
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	empty, sent, errs := processQueue(client, tempDir, chatRouter{defaultChat: "123"}, false)
+	if empty || sent != 0 || errs != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d, want busy non-empty queue", empty, sent, errs)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("locked file removed: %v", err)
+	}
 }
 
 func TestWriteWireResponse(t *testing.T) {
@@ -207,3 +357,507 @@ func TestWriteWireResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestSendTelegramUploadsAttachmentsAsReplies(t *testing.T) {
+	viper.Set("default_subject", "Message")
+	viper.Set("hostname", "host")
+	viper.Set("max_attachment_size", 4)
+	defer viper.Set("max_attachment_size", defaultMaxAttachmentSize)
+
+	var gotText, gotReplyTo, gotFilename string
+	var uploads atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			gotText = r.FormValue("text")
+			if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":99}}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+		case strings.HasSuffix(r.URL.Path, "/sendDocument"):
+			uploads.Add(1)
+			gotReplyTo = r.FormValue("reply_to_message_id")
+			if _, fh, err := r.FormFile("document"); err == nil {
+				gotFilename = fh.Filename
+			}
+			if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":100}}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	data := "Subject: report\n" +
+		"Content-Type: multipart/mixed; boundary=b\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"done\n" +
+		"--b\n" +
+		"Content-Disposition: attachment; filename=small.txt\n" +
+		"\n" +
+		"tiny\n" +
+		"--b\n" +
+		"Content-Disposition: attachment; filename=big.txt\n" +
+		"\n" +
+		"too large\n" +
+		"--b--\n"
+	if err := sendTelegram(client, "123", envelope{}, byteSection([]byte(data))); err != nil {
+		t.Fatalf("sendTelegram: %v", err)
+	}
+	if uploads.Load() != 1 {
+		t.Fatalf("uploads=%d want 1 (oversize attachment skipped)", uploads.Load())
+	}
+	if gotReplyTo != "99" || gotFilename != "small.txt" {
+		t.Fatalf("upload reply_to=%q filename=%q", gotReplyTo, gotFilename)
+	}
+	if !strings.Contains(gotText, "big.txt") {
+		t.Fatalf("skipped attachment not mentioned in text: %q", gotText)
+	}
+}
+
+func TestDeliverQueueFileStreamsLargePayload(t *testing.T) {
+	viper.Set("default_subject", "Message")
+	viper.Set("hostname", "host")
+
+	// Both parts are far larger than any buffer on the delivery path.
+	body := strings.Repeat("0123456789 log line of a long report\n", 64<<10)
+	attachment := make([]byte, 3<<20)
+	for i := range attachment {
+		attachment[i] = byte(i * 7)
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+
+	stateDir := t.TempDir()
+	id := writeQueued(t, stateDir, 0, 0, "Subject: nightly\r\n"+
+		"Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		body+"\r\n"+
+		"--b\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Disposition: attachment; filename=dump.bin\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		wrapped.String()+"\r\n"+
+		"--b--\r\n")
+
+	var mu sync.Mutex
+	uploads := map[string][sha256.Size]byte{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/sendDocument") {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("multipart: %v", err)
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("next part: %v", err)
+				http.Error(w, "bad form", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "document" {
+				continue
+			}
+			h := sha256.New()
+			if _, err := io.Copy(h, part); err != nil {
+				t.Errorf("read upload: %v", err)
+				http.Error(w, "bad form", http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			uploads[part.FileName()] = [sha256.Size]byte(h.Sum(nil))
+			mu.Unlock()
+		}
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":7}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	lock, err := lockQueueFile(filepath.Join(stateDir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	sent, err := deliverQueueFile(client, stateDir, id, chatRouter{defaultChat: "123"}, lock)
+	if err != nil || !sent {
+		t.Fatalf("deliverQueueFile: sent=%v err=%v", sent, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := uploads["data.txt"], sha256.Sum256([]byte(body)); got != want {
+		t.Errorf("data.txt does not match the message body")
+	}
+	if got, want := uploads["dump.bin"], sha256.Sum256(attachment); got != want {
+		t.Errorf("dump.bin does not match the decoded attachment")
+	}
+	if len(uploads) != 2 {
+		t.Errorf("uploads=%d want 2", len(uploads))
+	}
+}
+
+func TestDeliverMessageFansOutByRecipient(t *testing.T) {
+	viper.Set("default_subject", "Message")
+	viper.Set("hostname", "host")
+
+	var chats []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chats = append(chats, r.FormValue("chat_id"))
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	routes, err := parseRoutes([]string{"root@=ops", "backup@=backups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chatRouter{defaultChat: "default", routes: routes}
+
+	env := envelope{recipients: []string{"root"}}
+	data := "To: backup@example.com\nSubject: s\n\nbody"
+	if err := deliverMessage(client, router, env, byteSection([]byte(data))); err != nil {
+		t.Fatalf("deliverMessage: %v", err)
+	}
+	if strings.Join(chats, ",") != "ops,backups" {
+		t.Fatalf("chats=%v want [ops backups]", chats)
+	}
+}
+
+// submitToHandleConnection runs handleConnection on one Unix socket
+// connection carrying data and returns the wire response.
+func submitToHandleConnection(t *testing.T, stateDir string, data []byte) string {
+	t.Helper()
+	return submitWithLimits(t, stateDir, data, submissionLimits{})
+}
+
+// submitWithLimits is submitToHandleConnection with submission limits.
+func submitWithLimits(t *testing.T, stateDir string, data []byte, limits submissionLimits) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		handleConnection(conn, stateDir, 5, defaultMaxPayloadSize, limits)
+	}()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := closeWrite(conn); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	<-done
+	return string(resp)
+}
+
+// readQueuedEnvelopes returns the envelope and payload of every file in dir.
+func readQueuedEnvelopes(t *testing.T, dir string) ([]envelope, []string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envs []envelope
+	var payloads []string
+	for _, e := range entries {
+		if !isQueueEntry(e) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, payload, ok, err := splitEnvelope(content)
+		if err != nil || !ok {
+			t.Fatalf("queue file %s has no envelope: ok=%v err=%v", e.Name(), ok, err)
+		}
+		envs = append(envs, env)
+		payloads = append(payloads, string(payload))
+	}
+	return envs, payloads
+}
+
+func TestHandleConnectionWritesEnvelope(t *testing.T) {
+	stateDir := t.TempDir()
+	forged := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	wire := envelope{recipients: []string{"root"}, sender: "cron", received: forged}
+
+	if resp := submitToHandleConnection(t, stateDir, wire.encode([]byte("Subject: s\n\nbody"))); resp != wireResponseOK {
+		t.Fatalf("response=%q", resp)
+	}
+	envs, payloads := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 {
+		t.Fatalf("queued %d files, want 1", len(envs))
+	}
+	if envs[0].sender != "cron" || len(envs[0].recipients) != 1 || payloads[0] != "Subject: s\n\nbody" {
+		t.Fatalf("queued envelope=%+v payload=%q", envs[0], payloads[0])
+	}
+	if envs[0].received.Equal(forged) || envs[0].received.IsZero() {
+		t.Fatalf("received must be set by serve, got %v", envs[0].received)
+	}
+}
+
+func TestHandleConnectionRecordsPeer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is Linux only")
+	}
+	stateDir := t.TempDir()
+	// A forged Peer-Uid from the client must be replaced by the kernel's.
+	forged := "telegram-sendmail-envelope/1\nPeer-Uid: 12345\nPeer-Gid: 1\nPeer-Pid: 1\n\nSubject: s\n\nbody"
+	if resp := submitToHandleConnection(t, stateDir, []byte(forged)); resp != wireResponseOK {
+		t.Fatalf("response=%q", resp)
+	}
+	envs, _ := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 || envs[0].peer == nil {
+		t.Fatalf("queued %+v, want a peer", envs)
+	}
+	if envs[0].peer.uid != os.Getuid() || envs[0].peer.pid != os.Getpid() {
+		t.Fatalf("peer=%+v want uid=%d pid=%d", envs[0].peer, os.Getuid(), os.Getpid())
+	}
+}
+
+func TestHeadingSource(t *testing.T) {
+	env := envelope{peer: &peerCred{uid: 34, user: "backup", command: "sendmail", parent: "cron"}}
+	if got := headingSource("host", env, true); got != "host (cron as backup)" {
+		t.Fatalf("headingSource=%q", got)
+	}
+	if got := headingSource("host", env, false); got != "host" {
+		t.Fatalf("headingSource with show_sender off=%q", got)
+	}
+	if got := headingSource("host", envelope{peer: env.peer, authUser: "grafana"}, true); got != "host (grafana)" {
+		t.Fatalf("headingSource for SMTP user=%q", got)
+	}
+	named := envelope{peer: env.peer, senderName: "Nightly backup"}
+	if got := headingSource("host", named, true); got != "host (Nightly backup, cron as backup)" {
+		t.Fatalf("headingSource with -F name=%q", got)
+	}
+	if got := headingSource("host", envelope{}, true); got != "host" {
+		t.Fatalf("headingSource without peer=%q", got)
+	}
+}
+
+func TestHandleConnectionRawPayloadGetsEnvelope(t *testing.T) {
+	stateDir := t.TempDir()
+	if resp := submitToHandleConnection(t, stateDir, []byte("Subject: nc\n\nbody")); resp != wireResponseOK {
+		t.Fatalf("response=%q", resp)
+	}
+	envs, payloads := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 || payloads[0] != "Subject: nc\n\nbody" || envs[0].received.IsZero() {
+		t.Fatalf("queued %+v %q", envs, payloads)
+	}
+}
+
+func TestHandleConnectionRejectsMalformedEnvelope(t *testing.T) {
+	stateDir := t.TempDir()
+	resp := submitToHandleConnection(t, stateDir, []byte("telegram-sendmail-envelope/99\n\nbody"))
+	if resp != wireResponseBadEnvelope {
+		t.Fatalf("response=%q want %q", resp, wireResponseBadEnvelope)
+	}
+}
+
+func TestProcessQueueReadsLegacyRawFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "1700000000000000000"), []byte("To: root\nSubject: legacy\n\nbody"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("default_subject", "Message")
+	viper.Set("hostname", "host")
+
+	var gotChat, gotText string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotChat, gotText = r.FormValue("chat_id"), r.FormValue("text")
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := telegram.NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	routes, err := parseRoutes([]string{"root@=ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, sent, errs := processQueue(client, tempDir, chatRouter{defaultChat: "default", routes: routes}, false)
+	if !empty || sent != 1 || errs != 0 {
+		t.Fatalf("processQueue empty=%v sent=%d errs=%d", empty, sent, errs)
+	}
+	if gotChat != "ops" || !strings.Contains(gotText, "legacy") {
+		t.Fatalf("legacy file sent to %q: %q", gotChat, gotText)
+	}
+}
+
+func TestHandleConnectionRateLimit(t *testing.T) {
+	stateDir := t.TempDir()
+	limits := submissionLimits{messagesPerMinute: 2}
+	for i, want := range []string{wireResponseOK, wireResponseOK, wireResponseRateLimited} {
+		if resp := submitWithLimits(t, stateDir, []byte("Subject: s\n\nbody"), limits); resp != want {
+			t.Fatalf("submission %d: response=%q want %q", i, resp, want)
+		}
+	}
+	envs, _ := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 2 {
+		t.Fatalf("queued %d messages, want 2", len(envs))
+	}
+}
+
+func TestHandleConnectionQueueFull(t *testing.T) {
+	stateDir := t.TempDir()
+	limits := submissionLimits{maxQueueFiles: 1, messagesPerMinute: 10}
+	if resp := submitWithLimits(t, stateDir, []byte("Subject: s\n\nfirst"), limits); resp != wireResponseOK {
+		t.Fatalf("first response=%q", resp)
+	}
+	if resp := submitWithLimits(t, stateDir, []byte("Subject: s\n\nsecond"), limits); resp != wireResponseQueueFull {
+		t.Fatalf("second response=%q want %q", resp, wireResponseQueueFull)
+	}
+	// The rejected message must not count against the submitter.
+	state, err := loadRateLimitState(filepath.Join(stateDir, rateLimitStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, events := range state {
+		if len(events) != 1 {
+			t.Fatalf("uid %s has %d recorded submissions, want 1", key, len(events))
+		}
+	}
+}
+
+func TestReceiveMessageStagesInStateDir(t *testing.T) {
+	env := envelope{sender: "cron"}
+	tests := []struct {
+		name    string
+		payload io.Reader
+		limits  submissionLimits
+		want    string
+		queued  int
+	}{
+		{name: "queued", payload: strings.NewReader("Subject: s\n\nbody"), want: wireResponseOK, queued: 1},
+		{name: "too big", payload: strings.NewReader(strings.Repeat("x", 65)), want: wireResponsePayloadTooBig},
+		{name: "queue full", payload: strings.NewReader("body"), limits: submissionLimits{maxQueueBytes: 1}, want: wireResponseQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir := t.TempDir()
+			got, err := receiveMessage(stateDir, env, tt.payload, 64, tt.limits)
+			if err != nil || got != tt.want {
+				t.Fatalf("receiveMessage=%q, %v want %q", got, err, tt.want)
+			}
+			// Rejected messages leave no staged file behind.
+			if names := dirNames(t, stateDir); len(names) != tt.queued {
+				t.Fatalf("state dir holds %v, want %d queued file(s)", names, tt.queued)
+			}
+		})
+	}
+
+	stateDir := t.TempDir()
+	if _, err := receiveMessage(stateDir, env, iotest.ErrReader(io.ErrUnexpectedEOF), 64, submissionLimits{}); !errors.Is(err, errReadPayload) {
+		t.Fatalf("read failure: err=%v want errReadPayload", err)
+	}
+	if names := dirNames(t, stateDir); len(names) != 0 {
+		t.Fatalf("read failure left %v", names)
+	}
+}
+
+func TestProcessQueueIgnoresDotfiles(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stateDir, rateLimitStateFile), []byte("{}"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	// A message still being received must not be sent half written.
+	incoming := filepath.Join(stateDir, queueTempPrefix+"01ARYZ6S41TSV4RRFFQ69G5FAV.123")
+	if err := os.WriteFile(incoming, []byte("Subject: s\n\nhalf a mess"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	client := telegram.NewClient("token", nil)
+	empty, sent, failed := processQueue(client, stateDir, chatRouter{defaultChat: "123"}, false)
+	if !empty || sent != 0 || failed != 0 {
+		t.Fatalf("processQueue=%v,%d,%d want empty", empty, sent, failed)
+	}
+	for _, path := range []string{filepath.Join(stateDir, rateLimitStateFile), incoming} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("dotfile touched: %v", err)
+		}
+	}
+}
+
+func TestRemoveStaleQueueTemps(t *testing.T) {
+	stateDir := t.TempDir()
+	now := time.Now()
+	files := map[string]time.Time{
+		queueTempPrefix + "old.1":    now.Add(-2 * staleQueueTempAge),
+		queueTempPrefix + "fresh.2":  now,
+		".old.status":                now.Add(-2 * staleQueueTempAge),
+		"01ARYZ6S41TSV4RRFFQ69G5FAV": now.Add(-2 * staleQueueTempAge),
+	}
+	for name, mtime := range files {
+		path := filepath.Join(stateDir, name)
+		if err := os.WriteFile(path, []byte("x"), queueFilePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := removeStaleQueueTemps(stateDir, now); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{queueTempPrefix + "fresh.2", ".old.status", "01ARYZ6S41TSV4RRFFQ69G5FAV"}
+	slices.Sort(want)
+	if got := dirNames(t, stateDir); !slices.Equal(got, want) {
+		t.Fatalf("left %v, want %v", got, want)
+	}
+}
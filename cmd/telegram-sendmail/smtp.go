@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const (
+	// smtpSocketName is the systemd FileDescriptorName= of a socket that
+	// speaks SMTP instead of the sendmail wire protocol.
+	smtpSocketName = "smtp"
+	// maxSMTPRecipients bounds RCPT TO per message (RFC 5321 requires at
+	// least 100).
+	maxSMTPRecipients = 100
+	// maxSMTPErrors ends sessions that keep sending bad commands.
+	maxSMTPErrors = 10
+	// maxSMTPCommands ends sessions that keep sending commands, valid or not.
+	maxSMTPCommands = 1000
+	// maxSMTPSessionDuration is serve's session bound, however busy the
+	// client keeps it.
+	maxSMTPSessionDuration = 5 * time.Minute
+	// maxSMTPSessions bounds the sessions serve runs at once; more are
+	// turned away with 421.
+	maxSMTPSessions = 16
+)
+
+// smtpConfig is what an SMTP session needs from serve.
+type smtpConfig struct {
+	hostname string
+	stateDir string
+	// timeout bounds each command (and the DATA transfer) and session the
+	// whole session; zero leaves the session unbounded, as in `sendmail -bs`
+	// whose caller owns it.
+	timeout time.Duration
+	session time.Duration
+	maxSize int64
+	limits  submissionLimits
+	// submit, when set, replaces receiveMessage, as in `sendmail -bs`
+	// which forwards to serve.
+	submit func(env envelope, payload []byte) string
+	// creds, when set, makes AUTH mandatory before MAIL. tls enables
+	// STARTTLS, and with it AUTH is only offered on encrypted sessions.
+	creds *smtpCredentials
+	tls   *tls.Config
+}
+
+// smtpSession is one SMTP connection. Only the transaction fields are reset
+// by RSET, HELO/EHLO and a finished DATA.
+type smtpSession struct {
+	cfg    smtpConfig
+	conn   net.Conn
+	text   *textproto.Conn
+	peer   *peerCred
+	helo   string
+	errors int
+	// deadline is when the session ends, whatever the client is doing;
+	// zero without cfg.session.
+	deadline time.Time
+	// secure is set once STARTTLS completed; auth once AUTH succeeded.
+	secure bool
+	auth   *smtpAuthUser
+
+	from    string
+	hasFrom bool
+	rcpts   []string
+}
+
+// handleSMTPConnection runs an SMTP session on conn and queues each message
+// through receiveMessage (or cfg.submit), like handleConnection does for the
+// sendmail wire protocol.
+func handleSMTPConnection(conn net.Conn, cfg smtpConfig) {
+	peer, err := peerCredentials(conn)
+	if err != nil {
+		slog.Debug("No peer credentials for SMTP connection", "error", err)
+	}
+	s := &smtpSession{cfg: cfg, conn: conn, text: textproto.NewConn(conn), peer: peer}
+	// s.conn, so a TLS session ends with close_notify.
+	defer func() { s.conn.Close() }()
+	if err := s.serve(); err != nil && !errors.Is(err, io.EOF) {
+		slog.Warn("SMTP session ended", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
+
+// smtpSessions runs SMTP sessions beside the serve loop, so a slow or idle
+// client holds up neither sendmail submissions nor delivery. Only the serve
+// loop starts sessions.
+type smtpSessions struct {
+	wg     sync.WaitGroup
+	active atomic.Int32
+}
+
+// start runs a session on conn in the background, or turns conn away when
+// maxSMTPSessions are running.
+func (g *smtpSessions) start(conn net.Conn, cfg smtpConfig) {
+	if g.active.Load() >= maxSMTPSessions {
+		slog.Warn("Too many SMTP sessions, refusing connection", "remote", conn.RemoteAddr())
+		if err := conn.SetDeadline(time.Now().Add(time.Second)); err == nil {
+			if err := textproto.NewConn(conn).PrintfLine("421 4.3.2 %s Too many connections, try again later", cfg.hostname); err != nil {
+				slog.Debug("Failed to turn away SMTP connection", "error", err)
+			}
+		}
+		conn.Close()
+		return
+	}
+	g.active.Add(1)
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.active.Add(-1)
+		handleSMTPConnection(conn, cfg)
+	}()
+}
+
+// busy reports whether any session is running.
+func (g *smtpSessions) busy() bool {
+	return g.active.Load() > 0
+}
+
+// wait blocks until every session ended; maxSMTPSessionDuration bounds it.
+func (g *smtpSessions) wait() {
+	g.wg.Wait()
+}
+
+func (s *smtpSession) serve() error {
+	if s.cfg.session > 0 {
+		s.deadline = time.Now().Add(s.cfg.session)
+	}
+	if err := s.reply(220, "%s ESMTP telegram-sendmail", s.cfg.hostname); err != nil {
+		return err
+	}
+	for commands := 1; ; commands++ {
+		if err := s.extendDeadline(); err != nil {
+			return err
+		}
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if commands > maxSMTPCommands {
+			return s.reply(421, "4.7.0 Too many commands, closing connection")
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		arg = strings.TrimSpace(arg)
+
+		var quit bool
+		switch verb {
+		case "HELO", "EHLO":
+			err = s.handleHello(verb, arg)
+		case "MAIL":
+			err = s.handleMail(arg)
+		case "RCPT":
+			err = s.handleRcpt(arg)
+		case "DATA":
+			err = s.handleData()
+		case "STARTTLS":
+			err = s.handleStartTLS(arg)
+		case "AUTH":
+			err = s.handleAuth(arg)
+		case "RSET":
+			s.reset()
+			err = s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			err = s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			err = s.reply(252, "2.5.0 Cannot VRFY user, but will accept message")
+		case "QUIT":
+			err, quit = s.reply(221, "2.0.0 Bye"), true
+		default:
+			err = s.fail(502, "5.5.2 Command not recognized")
+		}
+		if err != nil || quit {
+			return err
+		}
+		if s.errors >= maxSMTPErrors {
+			return s.reply(421, "4.7.0 Too many errors, closing connection")
+		}
+	}
+}
+
+// extendDeadline gives the client cfg.timeout for its next command or the
+// DATA transfer, but never past the session deadline, so a client cannot
+// hold serve by sending NOOP just often enough.
+func (s *smtpSession) extendDeadline() error {
+	deadline := time.Now().Add(s.cfg.timeout)
+	if !s.deadline.IsZero() && deadline.After(s.deadline) {
+		deadline = s.deadline
+	}
+	return s.conn.SetDeadline(deadline)
+}
+
+func (s *smtpSession) reply(code int, format string, args ...any) error {
+	return s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// fail replies with an error and counts it towards maxSMTPErrors.
+func (s *smtpSession) fail(code int, msg string) error {
+	s.errors++
+	return s.reply(code, "%s", msg)
+}
+
+func (s *smtpSession) reset() {
+	s.from, s.hasFrom, s.rcpts = "", false, nil
+}
+
+func (s *smtpSession) handleHello(verb, arg string) error {
+	if arg == "" {
+		return s.fail(501, "5.5.4 Domain name required")
+	}
+	s.reset()
+	s.helo = arg
+	if verb == "HELO" {
+		return s.reply(250, "%s", s.cfg.hostname)
+	}
+	lines := []string{
+		s.cfg.hostname,
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+		"SIZE " + strconv.FormatInt(s.cfg.maxSize, 10),
+	}
+	if s.cfg.tls != nil && !s.secure {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.authOffered() {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := s.text.PrintfLine("250%s%s", sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *smtpSession) handleMail(arg string) error {
+	switch {
+	case s.helo == "":
+		return s.fail(503, "5.5.1 Send HELO/EHLO first")
+	case s.hasFrom:
+		return s.fail(503, "5.5.1 Sender already given")
+	case s.cfg.creds != nil && s.auth == nil:
+		return s.fail(530, "5.7.0 Authentication required")
+	}
+	addr, params, err := parseSMTPPath(arg, "FROM:")
+	if err != nil {
+		return s.fail(501, "5.5.4 "+err.Error())
+	}
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return s.fail(501, "5.5.4 Invalid SIZE")
+			}
+			if size > s.cfg.maxSize {
+				return s.fail(552, "5.3.4 Message size exceeds fixed limit")
+			}
+		case "BODY":
+			if v := strings.ToUpper(value); v != "7BIT" && v != "8BITMIME" {
+				return s.fail(501, "5.5.4 Unsupported BODY type")
+			}
+		case "AUTH":
+			// RFC 4954 submitter identity; the session's own account is used.
+		default:
+			return s.fail(555, "5.5.4 Unsupported parameter "+key)
+		}
+	}
+	s.from, s.hasFrom = addr, true
+	return s.reply(250, "2.1.0 OK")
+}
+
+func (s *smtpSession) handleRcpt(arg string) error {
+	if !s.hasFrom {
+		return s.fail(503, "5.5.1 Send MAIL first")
+	}
+	addr, params, err := parseSMTPPath(arg, "TO:")
+	if err != nil {
+		return s.fail(501, "5.5.4 "+err.Error())
+	}
+	if addr == "" {
+		return s.fail(501, "5.1.3 Recipient address required")
+	}
+	if len(params) > 0 {
+		return s.fail(555, "5.5.4 Unsupported parameter "+params[0])
+	}
+	if len(s.rcpts) >= maxSMTPRecipients {
+		return s.reply(452, "4.5.3 Too many recipients")
+	}
+	s.rcpts = append(s.rcpts, addr)
+	return s.reply(250, "2.1.5 OK")
+}
+
+func (s *smtpSession) handleData() error {
+	if len(s.rcpts) == 0 {
+		return s.fail(503, "5.5.1 Send RCPT first")
+	}
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+	if err := s.extendDeadline(); err != nil {
+		return err
+	}
+	// DotReader undoes dot-stuffing and turns CRLF into LF, the line ending
+	// of sendmail payloads.
+	data := s.text.DotReader()
+	env := envelope{recipients: s.rcpts, sender: s.from}
+	if s.auth != nil {
+		env.authUser, env.chat = s.auth.name, s.auth.chat
+	}
+	s.reset()
+	response, err := s.cfg.enqueue(env, data, s.peer)
+	if err != nil {
+		return err
+	}
+	// Consume the rest (all of an oversized message) so the client sees our
+	// reply after its final dot.
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return err
+	}
+	code, msg := smtpReply(response)
+	return s.reply(code, "%s", msg)
+}
+
+// authOffered reports whether AUTH may be used now: credentials are
+// configured and, when STARTTLS is available, the session is encrypted.
+func (s *smtpSession) authOffered() bool {
+	return s.cfg.creds != nil && (s.cfg.tls == nil || s.secure)
+}
+
+func (s *smtpSession) handleStartTLS(arg string) error {
+	switch {
+	case s.cfg.tls == nil:
+		return s.fail(502, "5.5.2 Command not recognized")
+	case s.secure:
+		return s.fail(503, "5.5.1 TLS already active")
+	case arg != "":
+		return s.fail(501, "5.5.4 Syntax: STARTTLS")
+	}
+	if err := s.reply(220, "2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(s.conn, s.cfg.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+	// RFC 3207: the client starts over with EHLO; nothing said in clear
+	// text carries over.
+	s.conn, s.text = tlsConn, textproto.NewConn(tlsConn)
+	s.secure, s.helo, s.auth = true, "", nil
+	s.reset()
+	return nil
+}
+
+func (s *smtpSession) handleAuth(arg string) error {
+	switch {
+	case s.cfg.creds == nil:
+		return s.fail(502, "5.5.2 Command not recognized")
+	case !s.authOffered():
+		return s.fail(538, "5.7.11 Encryption required, use STARTTLS first")
+	case s.helo == "":
+		return s.fail(503, "5.5.1 Send EHLO first")
+	case s.auth != nil:
+		return s.fail(503, "5.5.1 Already authenticated")
+	case s.hasFrom:
+		return s.fail(503, "5.5.1 AUTH not allowed during a mail transaction")
+	}
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var user, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		user, password, err = s.authPlain(initial)
+	case "LOGIN":
+		user, password, err = s.authLogin(initial)
+	default:
+		return s.fail(504, "5.5.4 Unsupported authentication mechanism")
+	}
+	if errors.Is(err, errSMTPAuthCancelled) {
+		return s.fail(501, "5.0.0 Authentication cancelled")
+	}
+	if errors.Is(err, errSMTPAuthMalformed) {
+		return s.fail(501, "5.5.2 Malformed authentication response")
+	}
+	if err != nil {
+		return err
+	}
+	account, ok := s.cfg.creds.authenticate(user, password)
+	if !ok {
+		slog.Warn("SMTP authentication failed", "remote", s.conn.RemoteAddr(), "user", user)
+		return s.fail(535, "5.7.8 Authentication credentials invalid")
+	}
+	s.auth = &account
+	return s.reply(235, "2.7.0 Authentication successful")
+}
+
+var (
+	errSMTPAuthCancelled = errors.New("authentication cancelled")
+	errSMTPAuthMalformed = errors.New("malformed authentication response")
+)
+
+// authPlain reads an RFC 4616 response: authzid NUL authcid NUL password.
+// A different authorization identity is refused.
+func (s *smtpSession) authPlain(initial string) (user, password string, err error) {
+	resp, err := s.authResponse(initial, "")
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(resp), "\x00")
+	if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+		return "", "", errSMTPAuthMalformed
+	}
+	return parts[1], parts[2], nil
+}
+
+// authLogin runs the LOGIN exchange, prompting for what the client did not
+// send with the command.
+func (s *smtpSession) authLogin(initial string) (user, password string, err error) {
+	resp, err := s.authResponse(initial, "Username:")
+	if err != nil {
+		return "", "", err
+	}
+	user = string(resp)
+	if resp, err = s.authResponse("", "Password:"); err != nil {
+		return "", "", err
+	}
+	return user, string(resp), nil
+}
+
+// authResponse decodes a base64 client response: initial when the client
+// sent one with AUTH, otherwise the line it answers a 334 prompt with.
+func (s *smtpSession) authResponse(initial, prompt string) ([]byte, error) {
+	line := initial
+	if line == "" {
+		if err := s.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+			return nil, err
+		}
+		var err error
+		if line, err = s.text.ReadLine(); err != nil {
+			return nil, err
+		}
+	}
+	switch line {
+	case "*":
+		return nil, errSMTPAuthCancelled
+	case "=":
+		// RFC 4954: an empty initial response.
+		return nil, nil
+	}
+	resp, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, errSMTPAuthMalformed
+	}
+	return resp, nil
+}
+
+// enqueue queues a message read from data through submit when set, or
+// receiveMessage. It fails only when reading data does.
+func (c smtpConfig) enqueue(env envelope, data io.Reader, peer *peerCred) (string, error) {
+	if c.submit == nil {
+		env.peer = peer
+		return receiveMessage(c.stateDir, env, data, c.maxSize, c.limits)
+	}
+	// submit may need the message twice (to spool it when serve is down);
+	// it is bounded by maxSize like anywhere else.
+	payload, err := io.ReadAll(io.LimitReader(data, c.maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(payload)) > c.maxSize {
+		return wireResponsePayloadTooBig, nil
+	}
+	return c.submit(env, payload), nil
+}
+
+// smtpReply maps a wire response from receiveMessage to an SMTP reply.
+// Limits the submitter may get under later are temporary (4xx).
+func smtpReply(wireResponse string) (code int, msg string) {
+	switch wireResponse {
+	case wireResponseOK:
+		return 250, "2.0.0 Queued"
+	case wireResponsePayloadTooBig:
+		return 552, "5.3.4 Message too big"
+	case wireResponseRateLimited:
+		return 450, "4.7.1 Rate limit exceeded, try again later"
+	case wireResponseQueueFull:
+		return 452, "4.3.1 Queue full, try again later"
+	default:
+		return 451, "4.3.0 Internal error saving message"
+	}
+}
+
+// parseSMTPPath parses the argument of MAIL ("FROM:<addr> params") or RCPT
+// ("TO:<addr> params"). The null path "<>" yields an empty address.
+func parseSMTPPath(arg, prefix string) (addr string, params []string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("syntax: expected %s<address>", prefix)
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			return "", nil, errors.New("syntax: unterminated <address>")
+		}
+		addr, rest = rest[1:end], rest[end+1:]
+	} else {
+		addr, rest, _ = strings.Cut(rest, " ")
+	}
+	// Drop source routes: <@relay1,@relay2:user@host>.
+	if strings.HasPrefix(addr, "@") {
+		if _, after, ok := strings.Cut(addr, ":"); ok {
+			addr = after
+		}
+	}
+	if strings.ContainsFunc(addr, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+		return "", nil, errors.New("syntax: invalid address")
+	}
+	return addr, strings.Fields(rest), nil
+}
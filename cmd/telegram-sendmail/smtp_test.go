@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpPipe runs handleSMTPConnection on one end of a pipe and returns the
+// other.
+func smtpPipe(t *testing.T, cfg smtpConfig) net.Conn {
+	t.Helper()
+	cfg.hostname, cfg.timeout = "mx.test", 5*time.Second
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleSMTPConnection(server, cfg)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// smtpTestSession is smtpPipe with a textproto client, greeting already read.
+func smtpTestSession(t *testing.T, cfg smtpConfig) *textproto.Conn {
+	t.Helper()
+	text := textproto.NewConn(smtpPipe(t, cfg))
+	if _, msg, err := text.ReadResponse(220); err != nil || !strings.HasPrefix(msg, "mx.test ESMTP") {
+		t.Fatalf("greeting %q: %v", msg, err)
+	}
+	return text
+}
+
+// smtpCmd sends one command and checks the reply code.
+func smtpCmd(t *testing.T, text *textproto.Conn, want int, format string, args ...any) string {
+	t.Helper()
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	code, msg, err := text.ReadResponse(want)
+	if err != nil {
+		t.Fatalf("%s: got %d %q, want %d", format, code, msg, want)
+	}
+	return msg
+}
+
+// smtpData sends a message body after DATA and returns the final reply.
+func smtpData(t *testing.T, text *textproto.Conn, body string) (int, string) {
+	t.Helper()
+	smtpCmd(t, text, 354, "DATA")
+	w := text.DotWriter()
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	code, msg, _ := text.ReadResponse(0)
+	return code, msg
+}
+
+func TestSMTPSessionQueuesMessage(t *testing.T) {
+	stateDir := t.TempDir()
+	text := smtpTestSession(t, smtpConfig{stateDir: stateDir, maxSize: 1024})
+
+	ehlo := smtpCmd(t, text, 250, "EHLO client.test")
+	for _, ext := range []string{"8BITMIME", "SIZE 1024", "ENHANCEDSTATUSCODES"} {
+		if !strings.Contains(ehlo, ext) {
+			t.Fatalf("EHLO reply %q missing %s", ehlo, ext)
+		}
+	}
+	smtpCmd(t, text, 250, "MAIL FROM:<app@host> SIZE=20 BODY=8BITMIME")
+	smtpCmd(t, text, 250, "RCPT TO:<root>")
+	smtpCmd(t, text, 250, "RCPT TO:<ops@example.com>")
+	if code, msg := smtpData(t, text, "Subject: s\r\n\r\n.dotted\r\nbody\r\n"); code != 250 {
+		t.Fatalf("DATA reply %d %q", code, msg)
+	}
+	smtpCmd(t, text, 221, "QUIT")
+
+	envs, payloads := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(envs))
+	}
+	if envs[0].sender != "app@host" || strings.Join(envs[0].recipients, ",") != "root,ops@example.com" {
+		t.Fatalf("queued envelope %+v", envs[0])
+	}
+	if payloads[0] != "Subject: s\n\n.dotted\nbody\n" {
+		t.Fatalf("queued payload %q", payloads[0])
+	}
+}
+
+func TestSMTPSessionCommandOrder(t *testing.T) {
+	text := smtpTestSession(t, smtpConfig{stateDir: t.TempDir(), maxSize: 1024})
+	smtpCmd(t, text, 503, "MAIL FROM:<a@b>")
+	smtpCmd(t, text, 250, "HELO client.test")
+	smtpCmd(t, text, 503, "RCPT TO:<root>")
+	smtpCmd(t, text, 503, "DATA")
+	smtpCmd(t, text, 250, "MAIL FROM:<>")
+	smtpCmd(t, text, 503, "MAIL FROM:<a@b>")
+	smtpCmd(t, text, 250, "RSET")
+	smtpCmd(t, text, 250, "MAIL FROM:<a@b>")
+	smtpCmd(t, text, 501, "RCPT TO:<>")
+	smtpCmd(t, text, 555, "RCPT TO:<root> NOTIFY=NEVER")
+	smtpCmd(t, text, 502, "TURN")
+}
+
+func TestSMTPSessionRejectsOversizedMessages(t *testing.T) {
+	stateDir := t.TempDir()
+	text := smtpTestSession(t, smtpConfig{stateDir: stateDir, maxSize: 16})
+	smtpCmd(t, text, 250, "EHLO client.test")
+	smtpCmd(t, text, 552, "MAIL FROM:<a@b> SIZE=17")
+	smtpCmd(t, text, 250, "MAIL FROM:<a@b>")
+	smtpCmd(t, text, 250, "RCPT TO:<root>")
+	if code, _ := smtpData(t, text, strings.Repeat("x", 100)+"\r\n"); code != 552 {
+		t.Fatalf("oversized DATA reply %d, want 552", code)
+	}
+	// The session stays usable after the rejected message.
+	smtpCmd(t, text, 250, "NOOP")
+	if envs, _ := readQueuedEnvelopes(t, stateDir); len(envs) != 0 {
+		t.Fatalf("queued %d messages, want 0", len(envs))
+	}
+}
+
+func TestSMTPSessionRateLimit(t *testing.T) {
+	stateDir := t.TempDir()
+	text := smtpTestSession(t, smtpConfig{stateDir: stateDir, maxSize: 1024, limits: submissionLimits{messagesPerMinute: 1}})
+	smtpCmd(t, text, 250, "EHLO client.test")
+	for i, want := range []int{250, 450} {
+		smtpCmd(t, text, 250, "MAIL FROM:<a@b>")
+		smtpCmd(t, text, 250, "RCPT TO:<root>")
+		if code, msg := smtpData(t, text, "Subject: s\r\n\r\nbody\r\n"); code != want {
+			t.Fatalf("message %d: reply %d %q, want %d", i, code, msg, want)
+		}
+	}
+}
+
+func TestSMTPReply(t *testing.T) {
+	for response, want := range map[string]int{
+		wireResponseOK:            250,
+		wireResponsePayloadTooBig: 552,
+		wireResponseSaveFailed:    451,
+		wireResponseRateLimited:   450,
+		wireResponseQueueFull:     452,
+	} {
+		if code, _ := smtpReply(response); code != want {
+			t.Errorf("smtpReply(%q)=%d want %d", response, code, want)
+		}
+	}
+}
+
+func TestParseSMTPPath(t *testing.T) {
+	for _, tc := range []struct {
+		arg, addr string
+		params    int
+		wantErr   bool
+	}{
+		{arg: "FROM:<a@b>", addr: "a@b"},
+		{arg: "from: <a@b> SIZE=10 BODY=7BIT", addr: "a@b", params: 2},
+		{arg: "FROM:<>", addr: ""},
+		{arg: "FROM:a@b", addr: "a@b"},
+		{arg: "FROM:<@relay:a@b>", addr: "a@b"},
+		{arg: "TO:<a@b>", wantErr: true},
+		{arg: "FROM:<a@b", wantErr: true},
+		{arg: "FROM:<a b@c>", wantErr: true},
+	} {
+		addr, params, err := parseSMTPPath(tc.arg, "FROM:")
+		if (err != nil) != tc.wantErr || addr != tc.addr || len(params) != tc.params {
+			t.Errorf("parseSMTPPath(%q)=%q %v %v", tc.arg, addr, params, err)
+		}
+	}
+}
+
+func TestSMTPSessionDeadline(t *testing.T) {
+	text := smtpTestSession(t, smtpConfig{session: 200 * time.Millisecond})
+	// NOOPs well inside the per-command timeout must not keep it open.
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		id, err := text.Cmd("NOOP")
+		if err == nil {
+			text.StartResponse(id)
+			_, _, err = text.ReadResponse(250)
+			text.EndResponse(id)
+		}
+		if err != nil {
+			if time.Since(start) < 200*time.Millisecond {
+				t.Fatalf("session ended early: %v", err)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("session outlived its deadline")
+}
+
+func TestSMTPSessionCommandLimit(t *testing.T) {
+	text := smtpTestSession(t, smtpConfig{})
+	for range maxSMTPCommands {
+		smtpCmd(t, text, 250, "NOOP")
+	}
+	smtpCmd(t, text, 421, "NOOP")
+}
+
+func TestSMTPSessionsLimit(t *testing.T) {
+	var sessions smtpSessions
+	cfg := smtpConfig{hostname: "mx.test", timeout: 5 * time.Second}
+	var clients []*textproto.Conn
+	for range maxSMTPSessions {
+		server, client := net.Pipe()
+		sessions.start(server, cfg)
+		text := textproto.NewConn(client)
+		if _, _, err := text.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, text)
+	}
+
+	server, client := net.Pipe()
+	go sessions.start(server, cfg)
+	if code, msg, err := textproto.NewConn(client).ReadResponse(421); err != nil {
+		t.Fatalf("extra session got %d %q, want 421", code, msg)
+	}
+	client.Close()
+
+	if !sessions.busy() {
+		t.Fatal("sessions not busy")
+	}
+	for _, text := range clients {
+		smtpCmd(t, text, 221, "QUIT")
+		text.Close()
+	}
+	sessions.wait()
+	if sessions.busy() {
+		t.Fatal("sessions busy after wait")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lucasew/telegram-sendmail/internal/telegram"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrSMTPTLSKeyPair is returned when only one of the STARTTLS certificate
+// and key is configured.
+var ErrSMTPTLSKeyPair = errors.New("smtp_tls_cert and smtp_tls_key must be set together")
+
+// smtpCredential is one account of the SMTP credentials file.
+type smtpCredential struct {
+	hash []byte
+	// chat, when set, receives every message the account submits,
+	// regardless of recipients.
+	chat string
+}
+
+// smtpCredentials is a loaded credentials file.
+type smtpCredentials struct {
+	// users maps SMTP AUTH user names to their accounts.
+	users map[string]smtpCredential
+	// dummy is compared against for unknown users, at the highest cost
+	// in the file, so a failed login takes as long whether or not the
+	// user exists.
+	dummy []byte
+}
+
+// smtpAuthUser is an authenticated SMTP session's account.
+type smtpAuthUser struct {
+	name string
+	chat string
+}
+
+// dummySMTPHash is the dummy hash for files whose highest cost is
+// bcrypt.DefaultCost, so the common case does not pay for hashing at
+// startup.
+var dummySMTPHash = []byte("$2a$10$gwXFgaPxQLTMv22sj2OTP.34mOXfKxV8kV/4V2MW8Gwcx/TG6HL5q")
+
+// loadSMTPCredentials reads a credentials file: one "user:bcrypt-hash" line
+// per account, as printed by `htpasswd -nB user`, optionally followed by
+// ":chat_id[:thread_id]". Blank lines and lines starting with # are
+// skipped.
+func loadSMTPCredentials(path string) (*smtpCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := &smtpCredentials{users: map[string]smtpCredential{}}
+	maxCost := bcrypt.MinCost
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, rest, _ := strings.Cut(line, ":")
+		hash, chat, _ := strings.Cut(rest, ":")
+		if user == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: want user:bcrypt-hash[:chat]", path, n)
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: %w", path, n, user, err)
+		}
+		maxCost = max(maxCost, cost)
+		if chat != "" {
+			if _, _, err := telegram.ParseChatID(chat); err != nil {
+				return nil, fmt.Errorf("%s:%d: user %s: %w", path, n, user, err)
+			}
+		}
+		if _, ok := creds.users[user]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, n, user)
+		}
+		creds.users[user] = smtpCredential{hash: []byte(hash), chat: chat}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	creds.dummy = dummySMTPHash
+	if maxCost != bcrypt.DefaultCost {
+		if creds.dummy, err = bcrypt.GenerateFromPassword([]byte("dummy"), maxCost); err != nil {
+			return nil, fmt.Errorf("hash dummy SMTP password: %w", err)
+		}
+	}
+	return creds, nil
+}
+
+// authenticate checks a user name and password against the file.
+func (c *smtpCredentials) authenticate(user, password string) (smtpAuthUser, bool) {
+	cred, ok := c.users[user]
+	hash := cred.hash
+	if !ok {
+		hash = c.dummy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return smtpAuthUser{}, false
+	}
+	return smtpAuthUser{name: user, chat: cred.chat}, true
+}
+
+// smtpSecurityFromConfig loads the SMTP credentials file and STARTTLS key
+// pair named in the configuration. Both are optional: without credentials
+// the SMTP listener accepts mail from anyone who can connect, and without a
+// key pair it does not offer STARTTLS.
+func smtpSecurityFromConfig() (*smtpCredentials, *tls.Config, error) {
+	var creds *smtpCredentials
+	if path := viper.GetString("smtp_credentials"); path != "" {
+		var err error
+		if creds, err = loadSMTPCredentials(path); err != nil {
+			return nil, nil, fmt.Errorf("load SMTP credentials: %w", err)
+		}
+	}
+
+	certFile, keyFile := viper.GetString("smtp_tls_cert"), viper.GetString("smtp_tls_key")
+	if (certFile == "") != (keyFile == "") {
+		return nil, nil, ErrSMTPTLSKeyPair
+	}
+	if certFile == "" {
+		return creds, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load SMTP TLS certificate: %w", err)
+	}
+	return creds, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testSMTPHash is bcrypt("secret") at the minimum cost, to keep tests fast.
+const testSMTPHash = "$2a$04$yVp5dZXTECEIHE9qRJHvTO8WDsB3POaGdmb00i06AcC1Nj5xCIRFm"
+
+func writeSMTPCredentials(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "smtp-users")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSMTPCredentials(t *testing.T) {
+	path := writeSMTPCredentials(t, "# containers\n\ngrafana:"+testSMTPHash+":-100123:7\nnas:"+testSMTPHash+"\n")
+	creds, err := loadSMTPCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds.users) != 2 || creds.users["grafana"].chat != "-100123:7" || creds.users["nas"].chat != "" {
+		t.Fatalf("creds=%+v", creds)
+	}
+
+	if user, ok := creds.authenticate("grafana", "secret"); !ok || user.name != "grafana" || user.chat != "-100123:7" {
+		t.Fatalf("authenticate grafana=%+v ok=%v", user, ok)
+	}
+	for _, tc := range [][2]string{{"grafana", "wrong"}, {"nobody", "secret"}, {"", ""}} {
+		if _, ok := creds.authenticate(tc[0], tc[1]); ok {
+			t.Errorf("authenticate(%q, %q) succeeded", tc[0], tc[1])
+		}
+	}
+}
+
+func TestLoadSMTPCredentialsDummyCost(t *testing.T) {
+	if cost, err := bcrypt.Cost(dummySMTPHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("dummySMTPHash cost=%d err=%v", cost, err)
+	}
+	hash5, err := bcrypt.GenerateFromPassword([]byte("secret"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := loadSMTPCredentials(writeSMTPCredentials(t, "a:"+testSMTPHash+"\nb:"+string(hash5)+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost(creds.dummy); err != nil || cost != 5 {
+		t.Fatalf("dummy hash cost=%d err=%v, want 5", cost, err)
+	}
+}
+
+func TestLoadSMTPCredentialsErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"no hash":        "grafana\n",
+		"plain password": "grafana:secret\n",
+		"bad chat":       "grafana:" + testSMTPHash + ":-100123:topic\n",
+		"duplicate":      "a:" + testSMTPHash + "\na:" + testSMTPHash + "\n",
+	} {
+		if _, err := loadSMTPCredentials(writeSMTPCredentials(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSMTPSecurityFromConfigNeedsKeyPair(t *testing.T) {
+	defer viper.Set("smtp_tls_cert", "")
+	viper.Set("smtp_tls_cert", "/etc/cert.pem")
+	if _, _, err := smtpSecurityFromConfig(); !errors.Is(err, ErrSMTPTLSKeyPair) {
+		t.Fatalf("err=%v want %v", err, ErrSMTPTLSKeyPair)
+	}
+}
+
+// testTLSConfigs returns a server config with a self-signed certificate for
+// "localhost" and a client config trusting it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, &tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+func testSMTPCreds(t *testing.T) *smtpCredentials {
+	t.Helper()
+	creds, err := loadSMTPCredentials(writeSMTPCredentials(t, "grafana:"+testSMTPHash+":-100123\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestSMTPSessionStartTLSAndAuth(t *testing.T) {
+	stateDir := t.TempDir()
+	serverTLS, clientTLS := testTLSConfigs(t)
+	// TCP rather than a pipe: both ends send close_notify at QUIT, which
+	// needs buffering.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := l.Accept(); err == nil {
+			handleSMTPConnection(conn, smtpConfig{hostname: "mx.test", timeout: 5 * time.Second, stateDir: stateDir, maxSize: 1024, creds: testSMTPCreds(t), tls: serverTLS})
+		}
+	}()
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Fatal("AUTH offered before STARTTLS")
+	}
+	if err := c.Mail("app@host"); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Fatalf("MAIL before AUTH: %v, want 530", err)
+	}
+	if err := c.StartTLS(clientTLS); err != nil {
+		t.Fatal(err)
+	}
+	if ok, mechs := c.Extension("AUTH"); !ok || !strings.Contains(mechs, "PLAIN") {
+		t.Fatalf("AUTH after STARTTLS: %v %q", ok, mechs)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "grafana", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("app@host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("root"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: s\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	envs, _ := readQueuedEnvelopes(t, stateDir)
+	if len(envs) != 1 || envs[0].authUser != "grafana" || envs[0].chat != "-100123" {
+		t.Fatalf("queued %+v, want grafana pinned to -100123", envs)
+	}
+	if chats := messageChats(chatRouter{defaultChat: "default"}, envs[0], nil); len(chats) != 1 || chats[0] != "-100123" {
+		t.Fatalf("pinned message routes to %v", chats)
+	}
+}
+
+func TestSMTPSessionAuthRequiresTLS(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	text := smtpTestSession(t, smtpConfig{stateDir: t.TempDir(), maxSize: 1024, creds: testSMTPCreds(t), tls: serverTLS})
+	smtpCmd(t, text, 250, "EHLO client.test")
+	smtpCmd(t, text, 538, "AUTH PLAIN AGdyYWZhbmEAc2VjcmV0")
+}
+
+func TestSMTPSessionAuthLogin(t *testing.T) {
+	text := smtpTestSession(t, smtpConfig{stateDir: t.TempDir(), maxSize: 1024, creds: testSMTPCreds(t)})
+	smtpCmd(t, text, 250, "EHLO client.test")
+	// Username: / Password: prompts, answered with "grafana" / "secret".
+	if msg := smtpCmd(t, text, 334, "AUTH LOGIN"); msg != "VXNlcm5hbWU6" {
+		t.Fatalf("username prompt %q", msg)
+	}
+	if msg := smtpCmd(t, text, 334, "Z3JhZmFuYQ=="); msg != "UGFzc3dvcmQ6" {
+		t.Fatalf("password prompt %q", msg)
+	}
+	smtpCmd(t, text, 235, "c2VjcmV0")
+	smtpCmd(t, text, 503, "AUTH PLAIN")
+	smtpCmd(t, text, 250, "MAIL FROM:<a@b> AUTH=<>")
+}
+
+func TestSMTPSessionAuthFailures(t *testing.T) {
+	text := smtpTestSession(t, smtpConfig{stateDir: t.TempDir(), maxSize: 1024, creds: testSMTPCreds(t)})
+	smtpCmd(t, text, 250, "EHLO client.test")
+	// "\x00grafana\x00wrong"
+	smtpCmd(t, text, 535, "AUTH PLAIN AGdyYWZhbmEAd3Jvbmc=")
+	smtpCmd(t, text, 334, "AUTH PLAIN")
+	smtpCmd(t, text, 501, "*")
+	smtpCmd(t, text, 501, "AUTH PLAIN not-base64")
+	smtpCmd(t, text, 504, "AUTH CRAM-MD5")
+	smtpCmd(t, text, 530, "MAIL FROM:<a@b>")
+}
+
+func TestSubmitterKey(t *testing.T) {
+	if got := submitterKey(&peerCred{uid: 1000}, "grafana"); got != "smtp:grafana" {
+		t.Fatalf("submitterKey with SMTP user=%q", got)
+	}
+	if got := submitterKey(&peerCred{uid: 1000}, ""); got != "1000" {
+		t.Fatalf("submitterKey without SMTP user=%q", got)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// writeStateFile replaces the JSON state file name in dir with v. The new
+// content goes to a uniquely named temporary file first, so serve and a
+// queue command never write over each other's, and is synced before and
+// after the rename, so a crash leaves either the old state or the new one.
+// It belongs to dir's owner, as when a queue command run as root saves the
+// state of a serve running as another user.
+func writeStateFile(dir, name string, v any) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// The temporary name keeps the leading dot: never a queue item.
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := chownToDir(f.Name(), dir); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteStateFile(t *testing.T) {
+	dir := t.TempDir()
+	// serve and a queue command may save the same state at once; neither
+	// may fail or leave its temporary file behind.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writeStateFile(dir, floodControlFile, map[string]int{"n": i}); err != nil {
+				t.Errorf("writeStateFile: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if names := dirNames(t, dir); len(names) != 1 || names[0] != floodControlFile {
+		t.Fatalf("dir holds %v", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, floodControlFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("state is not whole JSON: %q: %v", data, err)
+	}
+}
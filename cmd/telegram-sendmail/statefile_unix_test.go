@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStateFilesBelongToStateDirOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root, like the queue commands it covers")
+	}
+	stateDir := t.TempDir()
+	const serviceUID = 65534
+	if err := os.Chown(stateDir, serviceUID, serviceUID); err != nil {
+		t.Fatal(err)
+	}
+	if err := pauseQueue(stateDir, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "1"), []byte("x"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToDeadLetter(stateDir, "1", queueStatus{}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(stateDir, floodControlFile),
+		filepath.Join(stateDir, deadLetterDir),
+		statusPath(filepath.Join(stateDir, deadLetterDir), "1"),
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid := info.Sys().(*syscall.Stat_t).Uid; uid != serviceUID {
+			t.Errorf("%s owned by %d, want %d", path, uid, serviceUID)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxStatusHistory bounds the attempts kept per message; the counters keep
+// the full totals.
+const maxStatusHistory = 10
+
+// ErrInvalidQueueID is returned for IDs that do not name a queue file.
+var ErrInvalidQueueID = errors.New("invalid queue ID")
+
+// deliveryAttempt is one failed delivery of a queued message.
+type deliveryAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// queueStatus is the delivery history of a queued message, kept next to it
+// as ".<id>.status". Only the process holding the message's lock writes it.
+type queueStatus struct {
+	Attempts     int       `json:"attempts"`
+	FirstAttempt time.Time `json:"first_attempt"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	LastError    string    `json:"last_error,omitempty"`
+	// NextAttempt is when serve may retry the message; see retryDelay.
+	NextAttempt   time.Time         `json:"next_attempt"`
+	RecentHistory []deliveryAttempt `json:"recent_history,omitempty"`
+	// DeadReason and DeadAt are set when the message was moved to the
+	// dead-letter directory.
+	DeadReason string    `json:"dead_reason,omitempty"`
+	DeadAt     time.Time `json:"dead_at"`
+}
+
+// queueFilePath resolves id to its file in stateDir. IDs are plain file
+// names; anything that could escape the directory or name a bookkeeping
+// dotfile is rejected.
+func queueFilePath(stateDir, id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("%w %q", ErrInvalidQueueID, id)
+	}
+	return filepath.Join(stateDir, id), nil
+}
+
+func statusPath(stateDir, id string) string {
+	return filepath.Join(stateDir, "."+id+".status")
+}
+
+// loadQueueStatus returns the recorded history for id; a message that was
+// never attempted has an empty status.
+func loadQueueStatus(stateDir, id string) (queueStatus, error) {
+	var status queueStatus
+	data, err := os.ReadFile(statusPath(stateDir, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return queueStatus{}, fmt.Errorf("parse %s: %w", statusPath(stateDir, id), err)
+	}
+	return status, nil
+}
+
+func saveQueueStatus(stateDir, id string, status queueStatus) error {
+	return writeStateFile(stateDir, filepath.Base(statusPath(stateDir, id)), status)
+}
+
+// recordFailedAttempt appends a failed delivery to id's history. A corrupt
+// history is replaced rather than blocking the record.
+func recordFailedAttempt(stateDir, id string, at time.Time, deliveryErr error) (queueStatus, error) {
+	status, loadErr := loadQueueStatus(stateDir, id)
+	status.Attempts++
+	if status.FirstAttempt.IsZero() {
+		status.FirstAttempt = at
+	}
+	status.LastAttempt = at
+	status.LastError = deliveryErr.Error()
+	status.NextAttempt = at.Add(retryDelay(status.Attempts, rand.Float64()))
+	status.RecentHistory = append(status.RecentHistory, deliveryAttempt{At: at, Error: status.LastError})
+	if n := len(status.RecentHistory); n > maxStatusHistory {
+		status.RecentHistory = status.RecentHistory[n-maxStatusHistory:]
+	}
+	return status, errors.Join(loadErr, saveQueueStatus(stateDir, id, status))
+}
+
+// retryDelay is the backoff after the given number of failed attempts:
+// queueRetryDelay doubled per attempt and capped at maxQueueRetryDelay, of
+// which the upper half is scaled by jitter (in [0, 1)) so messages that
+// failed together do not all retry together.
+func retryDelay(attempts int, jitter float64) time.Duration {
+	delay := maxQueueRetryDelay
+	if attempts < 1 {
+		attempts = 1
+	}
+	if shift := attempts - 1; shift < 30 && queueRetryDelay<<shift < maxQueueRetryDelay {
+		delay = queueRetryDelay << shift
+	}
+	return delay/2 + time.Duration(jitter*float64(delay/2))
+}
+
+// removeQueueFile deletes a message and its status. The caller must hold the
+// message's lock.
+func removeQueueFile(stateDir, id string) error {
+	if err := os.Remove(filepath.Join(stateDir, id)); err != nil {
+		return err
+	}
+	if err := os.Remove(statusPath(stateDir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
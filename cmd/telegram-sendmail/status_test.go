@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueFilePath(t *testing.T) {
+	dir := t.TempDir()
+	if got, err := queueFilePath(dir, "1767268800000000000"); err != nil || got != filepath.Join(dir, "1767268800000000000") {
+		t.Fatalf("queueFilePath=%q err=%v", got, err)
+	}
+	for _, id := range []string{"", ".", "..", "../etc/passwd", "a/b", `a\b`, rateLimitStateFile, ".1.status"} {
+		if _, err := queueFilePath(dir, id); !errors.Is(err, ErrInvalidQueueID) {
+			t.Errorf("queueFilePath(%q): got %v, want ErrInvalidQueueID", id, err)
+		}
+	}
+}
+
+func TestRecordFailedAttempt(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range maxStatusHistory + 2 {
+		if _, err := recordFailedAttempt(dir, "1", start.Add(time.Duration(i)*time.Minute), fmt.Errorf("fail %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err := loadQueueStatus(dir, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Attempts != maxStatusHistory+2 || !status.FirstAttempt.Equal(start) {
+		t.Fatalf("status=%+v", status)
+	}
+	if len(status.RecentHistory) != maxStatusHistory || status.RecentHistory[0].Error != "fail 2" {
+		t.Fatalf("history not trimmed to the latest attempts: %+v", status.RecentHistory)
+	}
+	if status.LastError != fmt.Sprintf("fail %d", maxStatusHistory+1) {
+		t.Fatalf("last error=%q", status.LastError)
+	}
+}
+
+func TestRemoveQueueFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1"), []byte("m"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recordFailedAttempt(dir, "1", time.Now(), errors.New("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeQueueFile(dir, "1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(dir, "1"), statusPath(dir, "1")} {
+		if _, err := os.Stat(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s not removed: %v", p, err)
+		}
+	}
+	// A message without status is removed too.
+	if err := os.WriteFile(filepath.Join(dir, "2"), []byte("m"), queueFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeQueueFile(dir, "2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		jitter   float64
+		want     time.Duration
+	}{
+		{attempts: 1, jitter: 0, want: queueRetryDelay / 2},
+		{attempts: 1, jitter: 0.5, want: queueRetryDelay * 3 / 4},
+		{attempts: 2, jitter: 0, want: queueRetryDelay},
+		{attempts: 4, jitter: 0, want: queueRetryDelay * 4},
+		{attempts: 20, jitter: 0, want: maxQueueRetryDelay / 2},
+		{attempts: 1000, jitter: 0.999, want: maxQueueRetryDelay/2 + time.Duration(0.999*float64(maxQueueRetryDelay/2))},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts, tt.jitter); got != tt.want {
+			t.Errorf("retryDelay(%d, %v)=%s want %s", tt.attempts, tt.jitter, got, tt.want)
+		}
+	}
+}
+
+func TestRecordFailedAttemptSchedulesRetry(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	status, err := recordFailedAttempt(dir, "1", at, errors.New("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := status.NextAttempt.Sub(at); d < queueRetryDelay/2 || d >= queueRetryDelay {
+		t.Fatalf("first retry in %s", d)
+	}
+	status, err = recordFailedAttempt(dir, "1", at, errors.New("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := status.NextAttempt.Sub(at); d < queueRetryDelay || d >= 2*queueRetryDelay {
+		t.Fatalf("second retry in %s", d)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+)
+
+// Exit codes from BSD <sysexits.h>, which sendmail callers (cron, mailx,
+// MTAs handing mail to a local sendmail) use to decide between retrying
+// and giving up.
+const (
+	exUsage       = 64 // EX_USAGE: bad command line
+	exDataErr     = 65 // EX_DATAERR: the message itself is unacceptable
+	exUnavailable = 69 // EX_UNAVAILABLE: refused for good
+	exSoftware    = 70 // EX_SOFTWARE: internal error
+	exIOErr       = 74 // EX_IOERR: reading the message failed
+	exTempFail    = 75 // EX_TEMPFAIL: not queued, try again later
+	exProtocol    = 76 // EX_PROTOCOL: serve did not understand the client
+	exNoPerm      = 77 // EX_NOPERM: not allowed to read the queue
+)
+
+// exitError carries the process exit code for an error; Execute exits with
+// it instead of 1.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode tags a non-nil err with code.
+func withExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode is the process exit code for an error returned by Execute.
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return 1
+}
+
+// sendmailExitCode maps a sendmail client error to its sysexits code. Only
+// errors that leave the message unqueued for reasons that may clear up are
+// temporary; a rejection of the message or the command line is final.
+func sendmailExitCode(err error) int {
+	var opErr *net.OpError
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, ErrSendmailUsage), errors.Is(err, ErrUnsupportedSendmailMode):
+		return exUsage
+	case errors.Is(err, ErrPayloadTooBig):
+		return exDataErr
+	case errors.Is(err, ErrBadEnvelope):
+		return exProtocol
+	case errors.Is(err, ErrSocketUnavailable), errors.Is(err, ErrRateLimited),
+		errors.Is(err, ErrQueueFull), errors.Is(err, ErrServerSaveFailed),
+		errors.Is(err, ErrNoServerAck):
+		return exTempFail
+	case errors.Is(err, ErrServerRejected):
+		return exUnavailable
+	case errors.Is(err, ErrQueueNotReadable) && errors.Is(err, fs.ErrPermission):
+		return exNoPerm
+	case errors.Is(err, ErrQueueNotReadable):
+		return exIOErr
+	case errors.As(err, &opErr):
+		// Dial, write or read on the socket failed: serve may be restarting.
+		// Not net.Error, which syscall.Errno also satisfies, so a failed
+		// read of the message (a *fs.PathError) would match too.
+		return exTempFail
+	case errors.As(err, &pathErr):
+		return exIOErr
+	default:
+		return exSoftware
+	}
+}
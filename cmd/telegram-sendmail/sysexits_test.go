@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSendmailExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{&socketUnavailableError{Waited: time.Second, err: errors.New("no such file")}, exTempFail},
+		{&serverRejectedError{detail: wireResponseRateLimited}, exTempFail},
+		{&serverRejectedError{detail: wireResponseQueueFull}, exTempFail},
+		{&serverRejectedError{detail: wireResponseSaveFailed}, exTempFail},
+		{&serverRejectedError{detail: emptyServerResponse}, exTempFail},
+		{&serverRejectedError{detail: wireResponsePayloadTooBig}, exDataErr},
+		{&serverRejectedError{detail: wireResponseBadEnvelope}, exProtocol},
+		{&serverRejectedError{detail: "Error: something new"}, exUnavailable},
+		{fmt.Errorf("%w -bd", ErrUnsupportedSendmailMode), exUsage},
+		{fmt.Errorf("%w: option -f requires a value", ErrSendmailUsage), exUsage},
+		{fmt.Errorf("read server response: %w", &net.OpError{Op: "read", Net: "unix", Err: errors.New("connection reset")}), exTempFail},
+		{&fs.PathError{Op: "read", Path: "/dev/stdin", Err: errors.New("input/output error")}, exIOErr},
+		// syscall.Errno is a net.Error; it must not read as a socket failure.
+		{fmt.Errorf("read message: %w", &fs.PathError{Op: "read", Path: "/dev/stdin", Err: syscall.EIO}), exIOErr},
+		{&fs.PathError{Op: "read", Path: "/dev/stdin", Err: syscall.EAGAIN}, exIOErr},
+		{errors.New("unexpected"), exSoftware},
+	} {
+		if got := sendmailExitCode(tc.err); got != tc.want {
+			t.Errorf("%v: exit code %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if got := exitCode(errors.New("queue: unknown id")); got != 1 {
+		t.Fatalf("untyped error exits %d, want 1", got)
+	}
+	err := fmt.Errorf("wrapped: %w", withExitCode(ErrSocketUnavailable, exTempFail))
+	if got := exitCode(err); got != exTempFail {
+		t.Fatalf("exit code %d, want %d", got, exTempFail)
+	}
+	if withExitCode(nil, exSoftware) != nil {
+		t.Fatal("withExitCode(nil) should be nil")
+	}
+}
@@ -1,16 +1,20 @@
 package telegram
 
 import (
-	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
 	"io"
 	"log/slog"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
@@ -24,23 +28,92 @@ const (
 	maxErrorBodyBytes = 4 << 10 // 4 KiB
 	// defaultHTTPTimeout is used when NewClient is given a nil *http.Client.
 	defaultHTTPTimeout = 30 * time.Second
+	// MaxUploadSize is the Bot API limit for files uploaded via multipart.
+	MaxUploadSize = 50 << 20 // 50 MiB
+	// maxPhotoSize is the Bot API limit for sendPhoto; larger images are
+	// uploaded with sendDocument instead.
+	maxPhotoSize = 10 << 20 // 10 MiB
 )
 
 // Error represents an error returned by the Telegram API.
 type Error struct {
 	StatusCode int
-	Message    string
+	// Message is the raw response body (bounded by maxErrorBodyBytes).
+	Message string
+	// ErrorCode and Description are the Bot API error fields, when the body
+	// was the usual JSON error object.
+	ErrorCode   int
+	Description string
+	// RetryAfter is how long Telegram asks us to wait before the next
+	// request (flood control, usually with 429).
+	RetryAfter time.Duration
+	// MigrateToChatID is the new ID of a group that was upgraded to a
+	// supergroup.
+	MigrateToChatID int64
 }
 
 func (e *Error) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("status %d: %s", e.StatusCode, e.Description)
+	}
 	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
 }
 
+// apiError is the JSON body of a failed Bot API call.
+type apiError struct {
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter      int   `json:"retry_after"`
+		MigrateToChatID int64 `json:"migrate_to_chat_id"`
+	} `json:"parameters"`
+}
+
+// Permanent reports whether resending the same request cannot succeed: the
+// chat or message was rejected (400, e.g. chat not found) or the bot was
+// blocked or removed from the chat (403). Rate limits, server errors and an
+// invalid token (fixed by reconfiguring, after which mail should flow) are
+// transient.
+// A group upgraded to a supergroup is not permanent: the client resends to
+// the new chat.
+func (e *Error) Permanent() bool {
+	if e.MigrateToChatID != 0 {
+		return false
+	}
+	return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusForbidden
+}
+
+// IsPermanent reports whether err wraps an *Error that is Permanent.
+// Network errors are always transient.
+func IsPermanent(err error) bool {
+	var tErr *Error
+	return errors.As(err, &tErr) && tErr.Permanent()
+}
+
+// RetryAfter returns the wait Telegram requested if err wraps a flood
+// control *Error.
+func RetryAfter(err error) (time.Duration, bool) {
+	var tErr *Error
+	if errors.As(err, &tErr) && tErr.RetryAfter > 0 {
+		return tErr.RetryAfter, true
+	}
+	return 0, false
+}
+
 // Client is a Telegram Bot API client.
 type Client struct {
 	token      string
 	httpClient *http.Client
 	APIBaseURL string
+	// OnChatMigrated, if set, is called when Telegram reports that chat was
+	// upgraded to a supergroup with a new ID. Later sends to the old ID go
+	// to the new one for the life of the client.
+	OnChatMigrated func(from, to string)
+	// Limiter, if set, spaces out requests per chat and per bot.
+	Limiter *RateLimiter
+
+	mu         sync.Mutex
+	migrations map[string]string
 }
 
 // NewClient creates a new Telegram client.
@@ -57,6 +130,52 @@ func NewClient(token string, httpClient *http.Client) *Client {
 	}
 }
 
+// MigrateChat makes sends to chat ID from go to chat ID to, e.g. to restore
+// migrations recorded by OnChatMigrated in an earlier run. Topic suffixes
+// (":thread_id") are kept.
+func (c *Client) MigrateChat(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.migrations == nil {
+		c.migrations = map[string]string{}
+	}
+	c.migrations[from] = to
+}
+
+// resolveChat applies recorded migrations to a "chat_id[:thread_id]"
+// destination.
+func (c *Client) resolveChat(dest string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chatID, thread, hasThread := strings.Cut(dest, ":")
+	to, ok := c.migrations[chatID]
+	if !ok {
+		return dest
+	}
+	if hasThread {
+		return to + ":" + thread
+	}
+	return to
+}
+
+// withMigration runs send against dest and, when Telegram reports that the
+// group became a supergroup, records the new ID and runs it once more there.
+func (c *Client) withMigration(dest string, send func(dest string) (int64, error)) (int64, error) {
+	id, err := send(dest)
+	var tErr *Error
+	if !errors.As(err, &tErr) || tErr.MigrateToChatID == 0 {
+		return id, err
+	}
+	from, _, _ := strings.Cut(c.resolveChat(dest), ":")
+	to := strconv.FormatInt(tErr.MigrateToChatID, 10)
+	slog.Warn("Telegram chat was upgraded to a supergroup, resending to the new chat ID", "from", from, "to", to)
+	c.MigrateChat(from, to)
+	if c.OnChatMigrated != nil {
+		c.OnChatMigrated(from, to)
+	}
+	return send(dest)
+}
+
 func checkResponseError(resp *http.Response) error {
 	if resp.StatusCode == http.StatusOK {
 		// Drain the body so net/http can reuse the keep-alive connection.
@@ -78,112 +197,319 @@ func checkResponseError(resp *http.Response) error {
 	if len(body) > maxErrorBodyBytes {
 		msg = string(body[:maxErrorBodyBytes]) + "...(truncated)"
 	}
-	return &Error{StatusCode: resp.StatusCode, Message: msg}
+	tErr := &Error{StatusCode: resp.StatusCode, Message: msg}
+	// Proxies and outages may answer with HTML; only the raw body is kept then.
+	var apiErr apiError
+	if json.Unmarshal(body, &apiErr) == nil {
+		tErr.ErrorCode = apiErr.ErrorCode
+		tErr.Description = apiErr.Description
+		tErr.RetryAfter = time.Duration(apiErr.Parameters.RetryAfter) * time.Second
+		tErr.MigrateToChatID = apiErr.Parameters.MigrateToChatID
+	}
+	return tErr
 }
 
-// Send sends a message to the specified chat.
+// Send sends a message to the specified chat and returns its message ID.
 // It tries to send as a text message first.
 // If the message is too long or the API returns Bad Request (likely due to formatting),
 // it falls back to sending it as a document.
-func (c *Client) Send(chatID, subject, body, hostname string) error {
-	heading := fmt.Sprintf("<b>#%s</b>: %s", html.EscapeString(hostname), html.EscapeString(subject))
+func (c *Client) Send(chatID, subject, body, hostname string) (int64, error) {
+	heading := formatHeading(hostname, subject)
+	text := fmt.Sprintf("%s\n<pre>\n%s\n</pre>", heading, html.EscapeString(body))
+	return c.withMigration(chatID, func(dest string) (int64, error) {
+		return c.sendWithFallback(dest, heading, text, body)
+	})
+}
+
+// SendHTML is Send for a body that is already Telegram HTML (see
+// FormatHTML): it goes out as formatted text instead of escaped inside
+// <pre>. The document fallback carries the PlainText rendering.
+func (c *Client) SendHTML(chatID, subject, body, hostname string) (int64, error) {
+	heading := formatHeading(hostname, subject)
+	return c.withMigration(chatID, func(dest string) (int64, error) {
+		return c.sendWithFallback(dest, heading, heading+"\n"+body, PlainText(body))
+	})
+}
+
+// SendLong is Send for a body too long for a text message, streamed from
+// body instead of held in memory: it goes out as a document with the start
+// of the body in the caption.
+func (c *Client) SendLong(chatID, subject string, body File, hostname string) (int64, error) {
+	heading := formatHeading(hostname, subject)
+	return c.withMigration(chatID, func(dest string) (int64, error) {
+		return c.SendDocument(dest, heading, body)
+	})
+}
 
-	if len(body) <= messageLengthLimit {
-		finalMsg := fmt.Sprintf("%s\n<pre>\n%s\n</pre>", heading, html.EscapeString(body))
-		err := c.SendText(chatID, finalMsg)
+func formatHeading(hostname, subject string) string {
+	return fmt.Sprintf("<b>#%s</b>: %s", html.EscapeString(hostname), html.EscapeString(subject))
+}
+
+// sendWithFallback sends text when content is short enough, and uploads
+// content as a document when it is not or Telegram rejects the markup.
+func (c *Client) sendWithFallback(chatID, heading, text, content string) (int64, error) {
+	if len(content) <= messageLengthLimit {
+		id, err := c.SendText(chatID, text)
 		if err == nil {
-			return nil
+			return id, nil
 		}
 
-		// On Bad Request, fall through to send as document
+		// On Bad Request, fall through to send as document. A migrated chat
+		// rejects the document too, so leave that to withMigration.
 		var tErr *Error
-		if errors.As(err, &tErr) && tErr.StatusCode == http.StatusBadRequest {
+		if errors.As(err, &tErr) && tErr.StatusCode == http.StatusBadRequest && tErr.MigrateToChatID == 0 {
 			slog.Warn("Failed to send as text (bad request), retrying as document", "error", err)
 		} else {
-			return err
+			return 0, err
 		}
 	}
 
-	return c.SendDocument(chatID, heading, body)
+	return c.SendDocument(chatID, heading, NewFile("data.txt", "", strings.NewReader(content), int64(len(content))))
 }
 
-func (c *Client) doRequest(req *http.Request) error {
+// doRequest sends req, which posts to chatID, once the rate limiter allows.
+func (c *Client) doRequest(chatID string, req *http.Request) (int64, error) {
+	if c.Limiter != nil {
+		c.Limiter.Wait(chatID)
+	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	return checkResponseError(resp)
+	if resp.StatusCode == http.StatusOK {
+		return readMessageID(resp.Body), nil
+	}
+	return 0, checkResponseError(resp)
+}
+
+// readMessageID decodes result.message_id from a successful Bot API reply and
+// drains the rest of the body. Decode failures only log: Telegram already
+// accepted the message, so an error here must not trigger a re-send.
+func readMessageID(body io.Reader) int64 {
+	var reply struct {
+		Result struct {
+			MessageID int64 `json:"message_id"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(body).Decode(&reply); err != nil {
+		slog.Warn("decode telegram OK response body", "error", err)
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		slog.Warn("drain telegram OK response body", "error", err)
+	}
+	return reply.Result.MessageID
+}
+
+// ParseChatID splits a destination of the form "chat_id[:message_thread_id]"
+// so forum groups can target a topic. Chat IDs never contain ":" (numeric
+// IDs or @usernames), so a colon always separates the thread.
+func ParseChatID(dest string) (chatID string, threadID int64, err error) {
+	chatID, thread, ok := strings.Cut(dest, ":")
+	if chatID == "" {
+		return "", 0, fmt.Errorf("chat %q: empty chat ID", dest)
+	}
+	if !ok {
+		return chatID, 0, nil
+	}
+	threadID, err = strconv.ParseInt(thread, 10, 64)
+	if err != nil || threadID <= 0 {
+		return "", 0, fmt.Errorf("chat %q: thread ID must be a positive integer", dest)
+	}
+	return chatID, threadID, nil
+}
+
+// chatValues returns the chat_id and, for topic destinations, the
+// message_thread_id fields shared by every send method, after applying
+// chat migrations.
+func (c *Client) chatValues(dest string) (url.Values, error) {
+	chatID, threadID, err := ParseChatID(c.resolveChat(dest))
+	if err != nil {
+		return nil, err
+	}
+	vals := url.Values{"chat_id": {chatID}}
+	if threadID != 0 {
+		vals.Set("message_thread_id", strconv.FormatInt(threadID, 10))
+	}
+	return vals, nil
 }
 
 // SendText sends a text message to the specified chat.
-func (c *Client) SendText(chatID, text string) error {
+func (c *Client) SendText(chatID, text string) (int64, error) {
 	apiURL := fmt.Sprintf(c.APIBaseURL+"/sendMessage", c.token)
-	vals := url.Values{}
-	vals.Set("chat_id", chatID)
+	vals, err := c.chatValues(chatID)
+	if err != nil {
+		return 0, err
+	}
 	vals.Set("parse_mode", "HTML")
 	vals.Set("disable_web_page_preview", "1")
 	vals.Set("text", text)
 
 	req, err := http.NewRequest(http.MethodPost, apiURL, strings.NewReader(vals.Encode()))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	return c.doRequest(req)
+	return c.doRequest(vals.Get("chat_id"), req)
 }
 
-// SendDocument sends a document message to the specified chat.
-func (c *Client) SendDocument(chatID, heading, content string) error {
-	apiURL := fmt.Sprintf(c.APIBaseURL+"/sendDocument", c.token)
-
-	bodyBuf := &bytes.Buffer{}
-	writer := multipart.NewWriter(bodyBuf)
-
-	// Add fields
-	if err := writer.WriteField("chat_id", chatID); err != nil {
-		return err
-	}
-	if err := writer.WriteField("parse_mode", "HTML"); err != nil {
-		return err
-	}
-
+// SendDocument sends doc as a document message to the specified chat, with
+// heading and the start of doc as the caption.
+func (c *Client) SendDocument(chatID, heading string, doc File) (int64, error) {
 	// Caption (byte limits are UTF-8-safe so multi-byte runes are not split)
-	summary := truncateUTF8(content, fileSummaryLength)
+	start, err := io.ReadAll(io.LimitReader(doc.Open(), fileSummaryLength+utf8.UTFMax))
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", doc.Name, err)
+	}
+	summary := truncateUTF8(string(start), fileSummaryLength)
 	caption := fmt.Sprintf(
 		"%s\n<code>%s\n\n⚠️ WARNING: Message too big to be sent as a message. The content is in the file.</code>",
 		heading,
 		html.EscapeString(summary),
 	)
-	if len(caption) > maxCaptionLength {
-		caption = truncateUTF8(caption, maxCaptionLength-3) + "..."
+	fields, err := c.chatValues(chatID)
+	if err != nil {
+		return 0, err
 	}
-	if err := writer.WriteField("caption", caption); err != nil {
-		return err
+	fields.Set("caption", caption)
+	return c.upload("sendDocument", "document", fields, doc)
+}
+
+// File is the content of an upload. Open is called for every request that
+// carries it, so a retry (a photo Telegram refuses, sent again as a
+// document) reads it from the start, and a file section is streamed from
+// disk instead of held in memory.
+type File struct {
+	Name string
+	// ContentType may be empty, in which case the multipart default is used.
+	ContentType string
+	// Size is how many bytes Open yields; it decides whether an image may
+	// go through sendPhoto.
+	Size int64
+	Open func() io.Reader
+}
+
+// NewFile returns a File reading size bytes of r, such as an *os.File.
+func NewFile(name, contentType string, r io.ReaderAt, size int64) File {
+	return File{
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		Open:        func() io.Reader { return io.NewSectionReader(r, 0, size) },
 	}
+}
 
-	// File
-	part, err := writer.CreateFormFile("document", "data.txt")
+// SendAttachment uploads a mail attachment as a reply to replyTo (0 for no
+// reply). Images small enough for sendPhoto are sent as photos so they
+// render inline; anything else, or a photo Telegram refuses, goes through
+// sendDocument with the original filename.
+func (c *Client) SendAttachment(chatID string, replyTo int64, f File) (int64, error) {
+	return c.withMigration(chatID, func(dest string) (int64, error) {
+		return c.sendAttachment(dest, replyTo, f)
+	})
+}
+
+func (c *Client) sendAttachment(chatID string, replyTo int64, f File) (int64, error) {
+	fields, err := c.chatValues(chatID)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if _, err := part.Write([]byte(content)); err != nil {
-		return err
+	fields.Set("caption", html.EscapeString(f.Name))
+	if replyTo != 0 {
+		fields.Set("reply_to_message_id", strconv.FormatInt(replyTo, 10))
+		fields.Set("allow_sending_without_reply", "true")
 	}
 
-	if err := writer.Close(); err != nil {
+	if isPhotoType(f.ContentType) && f.Size <= maxPhotoSize {
+		id, err := c.upload("sendPhoto", "photo", fields, f)
+		if err == nil {
+			return id, nil
+		}
+		var tErr *Error
+		if !errors.As(err, &tErr) || tErr.StatusCode != http.StatusBadRequest || tErr.MigrateToChatID != 0 {
+			return 0, err
+		}
+		slog.Warn("Failed to send as photo (bad request), retrying as document", "error", err)
+	}
+
+	return c.upload("sendDocument", "document", fields, f)
+}
+
+// isPhotoType reports whether sendPhoto accepts the media type. GIFs are
+// left to sendDocument because sendPhoto would flatten animations.
+func isPhotoType(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// upload posts a multipart/form-data request carrying f as one file under
+// field.
+//
+// The body is written through a pipe while the request is sent, so neither
+// the encoded form nor, for a file section, f is ever held in memory.
+func (c *Client) upload(method, field string, fields url.Values, f File) (int64, error) {
+	apiURL := fmt.Sprintf(c.APIBaseURL+"/"+method, c.token)
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	req, err := http.NewRequest(http.MethodPost, apiURL, pr)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// The transport closes pr once it is done with the body, also on
+	// failure, which unblocks the writer.
+	go func() {
+		pw.CloseWithError(writeUpload(writer, field, fields, f.Name, f.ContentType, f.Open()))
+	}()
+	return c.doRequest(fields.Get("chat_id"), req)
+}
+
+// writeUpload writes the form for upload: the fields, then the file.
+func writeUpload(writer *multipart.Writer, field string, fields url.Values, filename, contentType string, content io.Reader) error {
+	if err := writer.WriteField("parse_mode", "HTML"); err != nil {
 		return err
 	}
+	for key, values := range fields {
+		value := values[0]
+		if key == "caption" && len(value) > maxCaptionLength {
+			value = truncateUTF8(value, maxCaptionLength-3) + "..."
+		}
+		if err := writer.WriteField(key, value); err != nil {
+			return err
+		}
+	}
 
-	req, err := http.NewRequest(http.MethodPost, apiURL, bodyBuf)
+	part, err := createFormFile(writer, field, filename, contentType)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if _, err := io.Copy(part, content); err != nil {
+		return err
+	}
+	return writer.Close()
+}
 
-	return c.doRequest(req)
+// createFormFile is multipart.Writer.CreateFormFile with an explicit part
+// Content-Type so Telegram sees the attachment's real media type.
+func createFormFile(w *multipart.Writer, field, filename, contentType string) (io.Writer, error) {
+	if contentType == "" {
+		return w.CreateFormFile(field, filename)
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+		"name":     field,
+		"filename": filename,
+	}))
+	h.Set("Content-Type", contentType)
+	return w.CreatePart(h)
 }
 
 // truncateUTF8 returns s shortened to at most maxBytes without splitting a
@@ -1,11 +1,16 @@
 package telegram
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
@@ -66,7 +71,7 @@ func TestClient_SendText(t *testing.T) {
 	client := NewClient("TOKEN", ts.Client())
 	client.APIBaseURL = ts.URL + "/bot%s"
 
-	err := client.SendText("123", "Hello World")
+	_, err := client.SendText("123", "Hello World")
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -98,7 +103,7 @@ func TestClient_Send_Fallback(t *testing.T) {
 	client := NewClient("TOKEN", ts.Client())
 	client.APIBaseURL = ts.URL + "/bot%s"
 
-	err := client.Send("123", "Subject", "Body", "Host")
+	_, err := client.Send("123", "Subject", "Body", "Host")
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -107,6 +112,206 @@ func TestClient_Send_Fallback(t *testing.T) {
 	}
 }
 
+func TestClient_Send_ReturnsMessageID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":42}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	id, err := client.Send("123", "Subject", "Body", "Host")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if id != 42 {
+		t.Fatalf("message id=%d want 42", id)
+	}
+}
+
+func TestClient_SendAttachment(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		photoStatus int
+		wantPaths   []string
+	}{
+		{name: "document", contentType: "application/pdf", wantPaths: []string{"sendDocument"}},
+		{name: "photo", contentType: "image/png", photoStatus: http.StatusOK, wantPaths: []string{"sendPhoto"}},
+		{name: "rejected photo falls back", contentType: "image/jpeg", photoStatus: http.StatusBadRequest, wantPaths: []string{"sendPhoto", "sendDocument"}},
+		{name: "gif as document", contentType: "image/gif", wantPaths: []string{"sendDocument"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				paths []string
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+				mu.Lock()
+				paths = append(paths, method)
+				mu.Unlock()
+				if err := r.ParseMultipartForm(1 << 20); err != nil {
+					t.Errorf("parse multipart: %v", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if got := r.FormValue("reply_to_message_id"); got != "7" {
+					t.Errorf("reply_to_message_id=%q want 7", got)
+				}
+				field := "document"
+				if method == "sendPhoto" {
+					field = "photo"
+				}
+				_, fh, err := r.FormFile(field)
+				if err != nil {
+					t.Errorf("form file %s: %v", field, err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if fh.Filename != "report.bin" {
+					t.Errorf("filename=%q", fh.Filename)
+				}
+				if got := fh.Header.Get("Content-Type"); got != tt.contentType {
+					t.Errorf("part content type=%q want %q", got, tt.contentType)
+				}
+				if method == "sendPhoto" && tt.photoStatus != http.StatusOK {
+					w.WriteHeader(tt.photoStatus)
+					if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: PHOTO_INVALID_DIMENSIONS"}`)); err != nil {
+						t.Errorf("write response: %v", err)
+					}
+					return
+				}
+				if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":8}}`)); err != nil {
+					t.Errorf("write response: %v", err)
+				}
+			}))
+			defer ts.Close()
+
+			client := NewClient("TOKEN", ts.Client())
+			client.APIBaseURL = ts.URL + "/bot%s"
+
+			id, err := client.SendAttachment("123", 7, NewFile("report.bin", tt.contentType, strings.NewReader("data"), 4))
+			if err != nil {
+				t.Fatalf("SendAttachment: %v", err)
+			}
+			if id != 8 {
+				t.Fatalf("message id=%d want 8", id)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(paths, ",") != strings.Join(tt.wantPaths, ",") {
+				t.Fatalf("calls=%v want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+// patternReader is size bytes of a repeating pattern, generated on read so
+// a test can upload more than it could sensibly hold.
+type patternReader struct{ size int64 }
+
+func (p patternReader) ReadAt(b []byte, off int64) (int, error) {
+	if off >= p.size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if rest := p.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	for i := range n {
+		b[i] = byte((off + int64(i)) % 251)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestClient_SendAttachmentStreamsUpload(t *testing.T) {
+	// Larger than the multipart, bufio and pipe buffers, and still under
+	// maxPhotoSize so the photo attempt and its document retry both run.
+	content := patternReader{size: maxPhotoSize - 1}
+	want := sha256.New()
+	if _, err := io.Copy(want, io.NewSectionReader(content, 0, content.size)); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		mu.Lock()
+		paths = append(paths, method)
+		mu.Unlock()
+		if r.ContentLength != -1 {
+			t.Errorf("%s: content length %d, want a streamed body", method, r.ContentLength)
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("multipart reader: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		got := sha256.New()
+		var size int64
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Errorf("next part: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			if size, err = io.Copy(got, part); err != nil {
+				t.Errorf("read file part: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if size != content.size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+			t.Errorf("%s: uploaded %d bytes, want the %d of content", method, size, content.size)
+		}
+		if method == "sendPhoto" {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: IMAGE_PROCESS_FAILED"}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+			return
+		}
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":8}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	// The document retry must upload the whole content again, not what the
+	// photo request left unread.
+	if _, err := client.SendAttachment("123", 0, NewFile("big.png", "image/png", content, content.size)); err != nil {
+		t.Fatalf("SendAttachment: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(paths, ",") != "sendPhoto,sendDocument" {
+		t.Fatalf("calls=%v", paths)
+	}
+}
+
 func TestClient_Send_EscapesHostnameAndSubject(t *testing.T) {
 	// Hostname and subject are embedded in HTML parse_mode markup; both must
 	// be escaped so HOSTNAME env / unusual subjects cannot break the payload.
@@ -126,7 +331,7 @@ func TestClient_Send_EscapesHostnameAndSubject(t *testing.T) {
 	client := NewClient("TOKEN", ts.Client())
 	client.APIBaseURL = ts.URL + "/bot%s"
 
-	err := client.Send("123", "a <b> subj", "body", `host&"x`)
+	_, err := client.Send("123", "a <b> subj", "body", `host&"x`)
 	if err != nil {
 		t.Fatalf("Send: %v", err)
 	}
@@ -183,7 +388,7 @@ func TestCheckResponseErrorTruncatesBody(t *testing.T) {
 	client := NewClient("TOKEN", ts.Client())
 	client.APIBaseURL = ts.URL + "/bot%s"
 
-	err := client.SendText("123", "hi")
+	_, err := client.SendText("123", "hi")
 	if err == nil {
 		t.Fatal("expected error from 500 response")
 	}
@@ -199,6 +404,48 @@ func TestCheckResponseErrorTruncatesBody(t *testing.T) {
 	}
 }
 
+func TestCheckResponseErrorParsesAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		if _, err := w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	_, err := client.SendText("123", "hi")
+	var tErr *Error
+	if !errors.As(err, &tErr) {
+		t.Fatalf("expected *Error, got %T %v", err, err)
+	}
+	if tErr.ErrorCode != 429 || tErr.Description != "Too Many Requests: retry after 7" || tErr.RetryAfter != 7*time.Second {
+		t.Fatalf("parsed error=%+v", tErr)
+	}
+	if got := err.Error(); got != "status 429: Too Many Requests: retry after 7" {
+		t.Fatalf("Error()=%q", got)
+	}
+	if wait, ok := RetryAfter(fmt.Errorf("chat 123: %w", err)); !ok || wait != 7*time.Second {
+		t.Fatalf("RetryAfter=%s,%v", wait, ok)
+	}
+	if _, ok := RetryAfter(&Error{StatusCode: http.StatusBadGateway}); ok {
+		t.Fatal("RetryAfter reported flood control for a 502")
+	}
+}
+
+func TestCheckResponseErrorMigrateToChatID(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Body:       io.NopCloser(strings.NewReader(`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-1001234567890}}`)),
+	}
+	var tErr *Error
+	if err := checkResponseError(resp); !errors.As(err, &tErr) || tErr.MigrateToChatID != -1001234567890 {
+		t.Fatalf("checkResponseError=%+v", err)
+	}
+}
+
 func TestNewClientNilUsesTimeout(t *testing.T) {
 	c := NewClient("TOKEN", nil)
 	if c.httpClient == nil {
@@ -216,3 +463,168 @@ func TestNewClientKeepsProvidedClient(t *testing.T) {
 		t.Fatal("expected provided client to be retained")
 	}
 }
+
+func TestParseChatID(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantChat   string
+		wantThread int64
+		wantErr    bool
+	}{
+		{in: "-100123", wantChat: "-100123"},
+		{in: "@channel", wantChat: "@channel"},
+		{in: "-100123:42", wantChat: "-100123", wantThread: 42},
+		{in: "", wantErr: true},
+		{in: ":42", wantErr: true},
+		{in: "-100123:", wantErr: true},
+		{in: "-100123:abc", wantErr: true},
+		{in: "-100123:0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			chat, thread, err := ParseChatID(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChatID(%q) err=%v wantErr=%v", tt.in, err, tt.wantErr)
+			}
+			if chat != tt.wantChat || thread != tt.wantThread {
+				t.Fatalf("ParseChatID(%q)=%q,%d want %q,%d", tt.in, chat, thread, tt.wantChat, tt.wantThread)
+			}
+		})
+	}
+}
+
+func TestClient_ThreadIDOnEveryCall(t *testing.T) {
+	// Text rejected -> document fallback -> attachment: all must carry the topic.
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			err = r.ParseForm()
+		} else {
+			err = r.ParseMultipartForm(1 << 20)
+		}
+		if err != nil {
+			t.Errorf("parse form: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		seen = append(seen, r.FormValue("chat_id")+"/"+r.FormValue("message_thread_id"))
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request"}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+			return
+		}
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":5}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	id, err := client.Send("-100123:42", "Subject", "Body", "Host")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := client.SendAttachment("-100123:42", id, NewFile("a.txt", "text/plain", strings.NewReader("x"), 1)); err != nil {
+		t.Fatalf("SendAttachment: %v", err)
+	}
+	want := []string{"-100123/42", "-100123/42", "-100123/42"}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("chat/thread per call=%v want %v", seen, want)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "chat not found", err: &Error{StatusCode: http.StatusBadRequest}, want: true},
+		{name: "bot kicked", err: &Error{StatusCode: http.StatusForbidden}, want: true},
+		{name: "wrapped", err: fmt.Errorf("chat 1: %w", &Error{StatusCode: http.StatusForbidden}), want: true},
+		{name: "chat migrated", err: &Error{StatusCode: http.StatusBadRequest, MigrateToChatID: -100123}, want: false},
+		{name: "invalid token", err: &Error{StatusCode: http.StatusUnauthorized}, want: false},
+		{name: "rate limited", err: &Error{StatusCode: http.StatusTooManyRequests}, want: false},
+		{name: "server error", err: &Error{StatusCode: http.StatusBadGateway}, want: false},
+		{name: "network", err: errors.New("dial tcp: connection refused"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Fatalf("IsPermanent(%v)=%v want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_ChatMigration(t *testing.T) {
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var chat string
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("parse multipart: %v", err)
+			}
+			chat = r.FormValue("chat_id")
+		} else {
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("parse form: %v", err)
+			}
+			chat = r.FormValue("chat_id")
+		}
+		seen = append(seen, chat)
+		if chat == "-123" {
+			w.WriteHeader(http.StatusBadRequest)
+			if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-100123}}`)); err != nil {
+				t.Errorf("write response: %v", err)
+			}
+			return
+		}
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":5}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+	var migrated []string
+	client.OnChatMigrated = func(from, to string) { migrated = append(migrated, from+"->"+to) }
+
+	id, err := client.Send("-123", "subj", "body", "host")
+	if err != nil || id != 5 {
+		t.Fatalf("Send id=%d err=%v", id, err)
+	}
+	// Later sends to the old ID go straight to the new chat.
+	if _, err := client.SendAttachment("-123", id, NewFile("a.txt", "text/plain", strings.NewReader("x"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-123", "-100123", "-100123"}; !slices.Equal(seen, want) {
+		t.Fatalf("chats=%v want %v (no document fallback on migration)", seen, want)
+	}
+	if want := []string{"-123->-100123"}; !slices.Equal(migrated, want) {
+		t.Fatalf("OnChatMigrated calls=%v want %v", migrated, want)
+	}
+}
+
+func TestClient_MigrateChatKeepsThread(t *testing.T) {
+	client := NewClient("TOKEN", nil)
+	client.MigrateChat("-1", "-1001")
+	for dest, want := range map[string]string{"-1": "-1001", "-1:7": "-1001:7", "-2": "-2"} {
+		if got := client.resolveChat(dest); got != want {
+			t.Errorf("resolveChat(%q)=%q want %q", dest, got, want)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// inlineTags maps source tags onto the formatting subset accepted by the
+// Bot API HTML parse mode. Anything not listed is stripped (its text kept).
+var inlineTags = map[atom.Atom]string{
+	atom.B:      "b",
+	atom.Strong: "b",
+	atom.I:      "i",
+	atom.Em:     "i",
+	atom.U:      "u",
+	atom.Ins:    "u",
+	atom.S:      "s",
+	atom.Strike: "s",
+	atom.Del:    "s",
+	atom.Code:   "code",
+	atom.Tt:     "code",
+	atom.Kbd:    "code",
+	atom.Pre:    "pre",
+	atom.A:      "a",
+	// blockquote is also a block element; see blockTags.
+	atom.Blockquote: "blockquote",
+}
+
+// blockTags end the current line before and after their content.
+var blockTags = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Table: true, atom.Ul: true,
+	atom.Ol: true, atom.Pre: true, atom.Blockquote: true, atom.Hr: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true,
+	atom.H6: true, atom.Dl: true, atom.Center: true, atom.Form: true,
+}
+
+// hiddenTags have content that is never rendered as text.
+var hiddenTags = map[atom.Atom]bool{
+	atom.Head: true, atom.Title: true, atom.Script: true, atom.Style: true,
+	atom.Template: true, atom.Noscript: true,
+}
+
+// FormatHTML converts an HTML mail body into Telegram's HTML parse-mode
+// subset: b, i, u, s, a, code, pre and blockquote pass through (with common
+// synonyms such as strong/em mapped), everything else is stripped to text.
+// Lists become bullet or numbered lines and table rows become " | "
+// separated lines so monitoring mails stay readable.
+func FormatHTML(src string) string {
+	c := &htmlConverter{}
+	z := nethtml.NewTokenizer(strings.NewReader(src))
+	// ErrorToken means io.EOF here: strings.Reader has no other failure.
+	for z.Next() != nethtml.ErrorToken {
+		c.token(z.Token())
+	}
+	return c.finish()
+}
+
+// PlainText strips Telegram HTML produced by FormatHTML back to plain text,
+// for document fallbacks where markup would be noise.
+func PlainText(telegramHTML string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(telegramHTML))
+	for {
+		switch z.Next() {
+		case nethtml.ErrorToken:
+			return b.String()
+		case nethtml.TextToken:
+			b.WriteString(z.Token().Data)
+		}
+	}
+}
+
+// stackTag is an element on the converter stack. written is false for tags
+// that were suppressed (their end tag must not be emitted).
+type stackTag struct {
+	tag     string
+	written bool
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+// htmlConverter accumulates Telegram HTML while tracking open tags so the
+// output is always well nested, even when the source HTML is not.
+type htmlConverter struct {
+	out    strings.Builder
+	open   []stackTag // Telegram tags currently open, innermost last
+	hidden int        // depth inside hiddenTags
+	pre    int        // depth inside pre (whitespace preserved)
+	lists  []htmlList
+	// cellCount is the number of cells already written on the current row.
+	cellCount int
+	// pendingSpace defers collapsed whitespace until the next word so lines
+	// never end or start with a space.
+	pendingSpace bool
+}
+
+func (c *htmlConverter) token(t nethtml.Token) {
+	switch t.Type {
+	case nethtml.TextToken:
+		if c.hidden == 0 {
+			c.text(t.Data)
+		}
+	case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+		if hiddenTags[t.DataAtom] {
+			if t.Type == nethtml.StartTagToken {
+				c.hidden++
+			}
+			return
+		}
+		if c.hidden == 0 {
+			c.start(t)
+		}
+	case nethtml.EndTagToken:
+		if hiddenTags[t.DataAtom] {
+			if c.hidden > 0 {
+				c.hidden--
+			}
+			return
+		}
+		if c.hidden == 0 {
+			c.end(t)
+		}
+	}
+}
+
+func (c *htmlConverter) start(t nethtml.Token) {
+	if blockTags[t.DataAtom] {
+		c.paragraph()
+	}
+	switch t.DataAtom {
+	case atom.Br:
+		c.newline()
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		c.openTag("b", "")
+	case atom.Ul, atom.Ol:
+		c.lists = append(c.lists, htmlList{ordered: t.DataAtom == atom.Ol})
+	case atom.Li:
+		c.newline()
+		indent := strings.Repeat("  ", max(len(c.lists)-1, 0))
+		if n := len(c.lists); n > 0 && c.lists[n-1].ordered {
+			c.lists[n-1].n++
+			c.raw(fmt.Sprintf("%s%d. ", indent, c.lists[n-1].n))
+		} else {
+			c.raw(indent + "• ")
+		}
+	case atom.Tr:
+		c.newline()
+		c.cellCount = 0
+	case atom.Td, atom.Th:
+		if c.cellCount > 0 {
+			c.raw(" | ")
+		}
+		c.cellCount++
+		if t.DataAtom == atom.Th {
+			c.openTag("b", "")
+		}
+	case atom.Img:
+		if alt := attr(t, "alt"); alt != "" {
+			c.text("[" + alt + "]")
+		}
+	case atom.A:
+		c.openTag("a", safeHref(attr(t, "href")))
+	default:
+		if tag, ok := inlineTags[t.DataAtom]; ok {
+			c.openTag(tag, "")
+		}
+	}
+	if t.DataAtom == atom.Pre {
+		c.pre++
+	}
+}
+
+func (c *htmlConverter) end(t nethtml.Token) {
+	switch t.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		c.closeTag("b")
+	case atom.Ul, atom.Ol:
+		if len(c.lists) > 0 {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+	case atom.Tr:
+		c.newline()
+	default:
+		if tag, ok := inlineTags[t.DataAtom]; ok {
+			c.closeTag(tag)
+		}
+	}
+	if t.DataAtom == atom.Pre && c.pre > 0 {
+		c.pre--
+	}
+	if blockTags[t.DataAtom] {
+		c.paragraph()
+	}
+}
+
+// openTag writes a Telegram tag. Nothing may nest inside pre/code (Bot API
+// rule) and links cannot nest, so those cases only keep the text.
+func (c *htmlConverter) openTag(tag, href string) {
+	if c.isOpen("pre") || c.isOpen("code") || (tag == "a" && (href == "" || c.isOpen("a"))) {
+		c.open = append(c.open, stackTag{tag: tag})
+		return
+	}
+	c.flushSpace()
+	if tag == "a" {
+		fmt.Fprintf(&c.out, `<a href="%s">`, html.EscapeString(href))
+	} else {
+		c.out.WriteString("<" + tag + ">")
+	}
+	c.open = append(c.open, stackTag{tag: tag, written: true})
+}
+
+// closeTag closes tag and anything opened after it. Stray end tags with no
+// matching start are ignored.
+func (c *htmlConverter) closeTag(tag string) {
+	idx := -1
+	for i := len(c.open) - 1; i >= 0; i-- {
+		if c.open[i].tag == tag {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return
+	}
+	c.closeFrom(idx)
+}
+
+// closeFrom emits end tags for c.open[idx:] innermost first and pops them.
+func (c *htmlConverter) closeFrom(idx int) {
+	for i := len(c.open) - 1; i >= idx; i-- {
+		if c.open[i].written {
+			c.out.WriteString("</" + c.open[i].tag + ">")
+		}
+	}
+	c.open = c.open[:idx]
+}
+
+// isOpen reports whether tag is open and was actually written.
+func (c *htmlConverter) isOpen(tag string) bool {
+	for _, t := range c.open {
+		if t.tag == tag && t.written {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *htmlConverter) text(s string) {
+	if c.pre > 0 {
+		c.flushSpace()
+		c.out.WriteString(html.EscapeString(s))
+		return
+	}
+	for i, word := range strings.Fields(s) {
+		if i > 0 || startsWithSpace(s) {
+			c.space()
+		}
+		c.flushSpace()
+		c.out.WriteString(html.EscapeString(word))
+	}
+	if endsWithSpace(s) {
+		c.space()
+	}
+}
+
+// raw writes list/table decoration, dropping any pending word space.
+func (c *htmlConverter) raw(s string) {
+	c.pendingSpace = false
+	c.out.WriteString(html.EscapeString(s))
+}
+
+func (c *htmlConverter) space() {
+	if !c.atLineStart() {
+		c.pendingSpace = true
+	}
+}
+
+func (c *htmlConverter) flushSpace() {
+	if c.pendingSpace {
+		c.out.WriteByte(' ')
+		c.pendingSpace = false
+	}
+}
+
+func (c *htmlConverter) atLineStart() bool {
+	s := c.out.String()
+	return s == "" || strings.HasSuffix(s, "\n")
+}
+
+func (c *htmlConverter) newline() {
+	c.pendingSpace = false
+	if !c.atLineStart() {
+		c.out.WriteByte('\n')
+	}
+}
+
+// paragraph ends the current line and leaves one blank line, without ever
+// stacking more than one.
+func (c *htmlConverter) paragraph() {
+	c.newline()
+	s := c.out.String()
+	if s != "" && !strings.HasSuffix(s, "\n\n") {
+		c.out.WriteByte('\n')
+	}
+}
+
+func (c *htmlConverter) finish() string {
+	c.closeFrom(0)
+	return strings.TrimSpace(c.out.String())
+}
+
+func attr(t nethtml.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// safeHref keeps only link schemes Telegram accepts; javascript: and
+// relative URLs (meaningless outside the mail client) are dropped.
+func safeHref(href string) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto", "tg":
+		return u.String()
+	default:
+		return ""
+	}
+}
+
+func startsWithSpace(s string) bool {
+	return s != "" && strings.TrimLeft(s, " \t\r\n\f") != s
+}
+
+func endsWithSpace(s string) bool {
+	return s != "" && strings.TrimRight(s, " \t\r\n\f") != s
+}
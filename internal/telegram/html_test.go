@@ -0,0 +1,129 @@
+package telegram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "supported tags pass through",
+			in:   "<b>bold</b> <i>it</i> <u>un</u> <s>st</s> <code>x</code>",
+			want: "<b>bold</b> <i>it</i> <u>un</u> <s>st</s> <code>x</code>",
+		},
+		{
+			name: "synonyms are mapped",
+			in:   "<strong>a</strong><em>b</em><del>c</del>",
+			want: "<b>a</b><i>b</i><s>c</s>",
+		},
+		{
+			name: "unsupported tags stripped and text escaped",
+			in:   "<span style='x'>1 &lt; 2 &amp; <font>3</font></span>",
+			want: "1 &lt; 2 &amp; 3",
+		},
+		{
+			name: "head script and style dropped",
+			in:   "<html><head><title>T</title><style>p{}</style></head><body><script>x()</script><p>hi</p></body></html>",
+			want: "hi",
+		},
+		{
+			name: "paragraphs and breaks",
+			in:   "<p>one</p><p>two<br>three</p>",
+			want: "one\n\ntwo\nthree",
+		},
+		{
+			name: "whitespace collapsed outside pre",
+			in:   "<div>  a \n\t b  </div>",
+			want: "a b",
+		},
+		{
+			name: "pre keeps whitespace and drops nested formatting",
+			in:   "<pre>  x  <b>y</b>\n z</pre>",
+			want: "<pre>  x  y\n z</pre>",
+		},
+		{
+			name: "safe links kept, unsafe dropped",
+			in:   `<a href="https://example.com/?a=1&amp;b=2">ok</a> <a href="javascript:alert(1)">bad</a>`,
+			want: `<a href="https://example.com/?a=1&amp;b=2">ok</a> bad`,
+		},
+		{
+			name: "unordered and ordered lists",
+			in:   "<ul><li>a</li><li>b</li></ul><ol><li>x</li><li>y</li></ol>",
+			want: "• a\n• b\n\n1. x\n2. y",
+		},
+		{
+			name: "table rows",
+			in:   "<table><tr><th>Host</th><th>State</th></tr><tr><td>db1</td><td>down</td></tr></table>",
+			want: "<b>Host</b> | <b>State</b>\ndb1 | down",
+		},
+		{
+			name: "headings become bold lines",
+			in:   "<h1>Alert</h1>body",
+			want: "<b>Alert</b>\n\nbody",
+		},
+		{
+			name: "unclosed and misnested tags are balanced",
+			in:   "<b>a<i>b</b>c",
+			want: "<b>a<i>b</i></b>c",
+		},
+		{
+			name: "blockquote",
+			in:   "<blockquote>quoted</blockquote>after",
+			want: "<blockquote>quoted</blockquote>\n\nafter",
+		},
+		{
+			name: "image alt text",
+			in:   `graph: <img src="cid:1" alt="CPU">`,
+			want: "graph: [CPU]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatHTML(tt.in); got != tt.want {
+				t.Fatalf("FormatHTML(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	got := PlainText("<b>a &amp; b</b>\n<a href=\"https://x\">link</a>")
+	if got != "a & b\nlink" {
+		t.Fatalf("PlainText=%q", got)
+	}
+}
+
+func TestClient_SendHTML(t *testing.T) {
+	var gotText, gotMode string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotText = r.FormValue("text")
+		gotMode = r.FormValue("parse_mode")
+		if _, err := w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+
+	if _, err := client.SendHTML("123", "Subj", "<b>down</b>", "host"); err != nil {
+		t.Fatalf("SendHTML: %v", err)
+	}
+	if gotMode != "HTML" {
+		t.Fatalf("parse_mode=%q", gotMode)
+	}
+	if gotText != "<b>#host</b>: Subj\n<b>down</b>" {
+		t.Fatalf("text=%q", gotText)
+	}
+	if strings.Contains(gotText, "<pre>") {
+		t.Fatalf("HTML body must not be wrapped in <pre>: %q", gotText)
+	}
+}
@@ -0,0 +1,138 @@
+package telegram
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a RateLimiter, so tests can run without
+// sleeping.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Rate allows Events requests per Per, with up to Burst of them back to
+// back. Events <= 0 disables the limit.
+type Rate struct {
+	Events int
+	Per    time.Duration
+	Burst  int
+}
+
+func (r Rate) enabled() bool {
+	return r.Events > 0 && r.Per > 0
+}
+
+// tokenBucket is a token bucket that lets callers reserve a token ahead of
+// time: tokens may go negative, and the deficit is how long to wait.
+type tokenBucket struct {
+	interval time.Duration // time to earn one token
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(r Rate, now time.Time) *tokenBucket {
+	burst := float64(max(r.Burst, 1))
+	return &tokenBucket{
+		interval: r.Per / time.Duration(r.Events),
+		burst:    burst,
+		tokens:   burst,
+		last:     now,
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+float64(elapsed)/float64(b.interval))
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.interval))
+}
+
+// full reports whether the bucket has refilled to its burst by now, so it
+// is no different from a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+float64(now.Sub(b.last))/float64(b.interval) >= b.burst
+}
+
+// RateLimiter spaces out Bot API requests per chat and across the bot so
+// bursts are smoothed before Telegram answers with 429. It is safe for
+// concurrent use.
+type RateLimiter struct {
+	perChat Rate
+	global  Rate
+	clock   Clock
+
+	mu    sync.Mutex
+	chats map[string]*tokenBucket
+	// pruned is when full chat buckets were last dropped from chats.
+	pruned      time.Time
+	globalState *tokenBucket
+}
+
+// NewRateLimiter returns a limiter applying perChat to each chat and global
+// to all requests. A nil clock uses the system time.
+func NewRateLimiter(perChat, global Rate, clock Clock) *RateLimiter {
+	if clock == nil {
+		clock = realClock{}
+	}
+	l := &RateLimiter{perChat: perChat, global: global, clock: clock, chats: map[string]*tokenBucket{}, pruned: clock.Now()}
+	if global.enabled() {
+		l.globalState = newTokenBucket(global, clock.Now())
+	}
+	return l
+}
+
+// Wait blocks until a request to chatID may be sent.
+func (l *RateLimiter) Wait(chatID string) {
+	if d := l.reserve(chatID); d > 0 {
+		l.clock.Sleep(d)
+	}
+}
+
+func (l *RateLimiter) reserve(chatID string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	var wait time.Duration
+	if l.perChat.enabled() {
+		l.prune(now)
+		bucket, ok := l.chats[chatID]
+		if !ok {
+			bucket = newTokenBucket(l.perChat, now)
+			l.chats[chatID] = bucket
+		}
+		wait = bucket.reserve(now)
+	}
+	if l.globalState != nil {
+		wait = max(wait, l.globalState.reserve(now))
+	}
+	return wait
+}
+
+// prune drops the buckets of chats that have been quiet long enough to
+// refill, at most once per perChat.Per, so chats does not grow with every
+// chat ever sent to.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.perChat.Per {
+		return
+	}
+	l.pruned = now
+	for chatID, bucket := range l.chats {
+		if bucket.full(now) {
+			delete(l.chats, chatID)
+		}
+	}
+}
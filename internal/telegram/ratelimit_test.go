@@ -0,0 +1,115 @@
+package telegram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when slept on.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimiterPerChat(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(Rate{Events: 20, Per: time.Minute, Burst: 2}, Rate{}, clock)
+
+	for range 4 {
+		l.Wait("a")
+	}
+	// Two in the burst, then one every 3s.
+	want := []time.Duration{3 * time.Second, 3 * time.Second}
+	if len(clock.slept) != len(want) || clock.slept[0] != want[0] || clock.slept[1] != want[1] {
+		t.Fatalf("slept=%v want %v", clock.slept, want)
+	}
+	// Another chat has its own bucket.
+	l.Wait("b")
+	if len(clock.slept) != 2 {
+		t.Fatalf("chat b waited: %v", clock.slept)
+	}
+	// Idle time refills the bucket, up to the burst.
+	clock.now = clock.now.Add(time.Hour)
+	l.Wait("a")
+	l.Wait("a")
+	if len(clock.slept) != 2 {
+		t.Fatalf("refilled chat waited: %v", clock.slept)
+	}
+}
+
+func TestRateLimiterPrunesRefilledChats(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	l := NewRateLimiter(Rate{Events: 1, Per: time.Minute, Burst: 1}, Rate{}, clock)
+
+	l.Wait("a")
+	clock.now = start.Add(30 * time.Second)
+	l.Wait("b")
+	clock.now = start.Add(time.Minute)
+	l.Wait("c")
+	if len(l.chats) != 2 || l.chats["a"] != nil {
+		t.Fatalf("chats=%v, want the refilled bucket of a dropped", l.chats)
+	}
+	// b has only refilled halfway: its bucket is kept, so b still waits.
+	l.Wait("b")
+	if len(clock.slept) != 1 || clock.slept[0] != 30*time.Second {
+		t.Fatalf("slept=%v, want b to wait 30s", clock.slept)
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(Rate{}, Rate{Events: 2, Per: time.Second, Burst: 2}, clock)
+	for _, chat := range []string{"a", "b", "c", "d"} {
+		l.Wait(chat)
+	}
+	if len(clock.slept) != 2 || clock.slept[0] != 500*time.Millisecond {
+		t.Fatalf("slept=%v, want two 500ms waits", clock.slept)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(Rate{}, Rate{}, clock)
+	for range 100 {
+		l.Wait("a")
+	}
+	if len(clock.slept) != 0 {
+		t.Fatalf("disabled limiter slept %v", clock.slept)
+	}
+}
+
+func TestClient_UsesLimiter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write([]byte(`{"ok":true}`)); err != nil {
+			t.Errorf("write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	client := NewClient("TOKEN", ts.Client())
+	client.APIBaseURL = ts.URL + "/bot%s"
+	client.Limiter = NewRateLimiter(Rate{Events: 1, Per: time.Second, Burst: 1}, Rate{}, clock)
+
+	if _, err := client.SendText("123:7", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendDocument("123", "two", NewFile("data.txt", "", strings.NewReader("body"), 4)); err != nil {
+		t.Fatal(err)
+	}
+	// Topic and plain sends share the chat's bucket.
+	if len(clock.slept) != 1 || clock.slept[0] != time.Second {
+		t.Fatalf("slept=%v, want one 1s wait", clock.slept)
+	}
+}
@@ -3,6 +3,7 @@ let
   inherit (lib) mkEnableOption mkIf mkOption types;
   cfg = config.services.telegram-sendmail;
   socketPath = "/run/telegram-sendmail/socket.sock";
+  maildropDir = "/var/spool/telegram-sendmail";
   serviceName = "telegram-sendmail";
 
   src = ./.;
@@ -10,7 +11,7 @@ let
     pname = "telegram-sendmail";
     version = src.rev or "dirty";
     inherit src;
-    vendorHash = "sha256-ofMGVrFz9SofDITDr4JBUCuT0Lpd1YDXamKwowUgVuI=";
+    vendorHash = "sha256-jaxx/XOp4noeAClTibgXFOBEPOPWrVu04yqWKHvgeZ8=";
   };
 in
 {
@@ -46,6 +47,23 @@ in
       };
     };
 
+    # Maildrop: sendmail spools here while the socket is unavailable.
+    # World-writable but not listable, sticky; stale partial writes expire.
+    systemd.tmpfiles.rules = [
+      "d ${maildropDir} 0755 root root -"
+      "d ${maildropDir}/tmp 1733 root root 36h"
+      "d ${maildropDir}/new 1733 root root -"
+    ];
+
+    systemd.paths.telegram-sendmail = {
+      description = "Telegram Sendmail Maildrop";
+      wantedBy = [ "paths.target" ];
+      pathConfig = {
+        DirectoryNotEmpty = "${maildropDir}/new";
+        Unit = "telegram-sendmail.service";
+      };
+    };
+
     systemd.services.telegram-sendmail = {
       description = "Telegram Sendmail Service";
       requires = [ "telegram-sendmail.socket" ];
@@ -58,6 +76,8 @@ in
         Restart = "on-failure";
         RestartSec = 1;
         EnvironmentFile = [ cfg.credentialFile ];
+        # "+": root, to read and remove the messages users spooled.
+        ExecStartPre = "+${telegram-sendmail-pkg}/bin/telegram-sendmail queue pickup";
         ExecStart = "${telegram-sendmail-pkg}/bin/telegram-sendmail serve ${lib.escapeShellArgs cfg.extraArgs}";
       };
     };
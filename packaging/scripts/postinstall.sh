@@ -1,5 +1,5 @@
 #!/bin/sh
-# Seed secrets file and arm the socket unit (SPEC lifecycle: postinstall).
+# Seed secrets file and arm the socket and path units (SPEC lifecycle: postinstall).
 set -e
 
 EXAMPLE=/usr/share/doc/telegram-sendmail/telegram-sendmail.env.example
@@ -17,8 +17,13 @@ elif [ -f "$ENVFILE" ]; then
 	chmod 0600 "$ENVFILE" || true
 fi
 
+if command -v systemd-tmpfiles >/dev/null 2>&1; then
+	# Maildrop for sendmail while the socket is down; boot creates it too.
+	systemd-tmpfiles --create telegram-sendmail.conf || true
+fi
+
 if command -v systemctl >/dev/null 2>&1 && [ -d /run/systemd/system ]; then
 	systemctl daemon-reload || true
 	# Enable only — do not start (fresh env still has placeholders).
-	systemctl enable telegram-sendmail.socket || true
+	systemctl enable telegram-sendmail.socket telegram-sendmail.path || true
 fi
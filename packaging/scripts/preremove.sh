@@ -16,6 +16,7 @@ case "${1:-}" in
 esac
 
 if command -v systemctl >/dev/null 2>&1 && [ -d /run/systemd/system ]; then
+	systemctl disable --now telegram-sendmail.path 2>/dev/null || true
 	systemctl disable --now telegram-sendmail.socket 2>/dev/null || true
 	systemctl stop telegram-sendmail.service 2>/dev/null || true
 	systemctl daemon-reload || true